@@ -0,0 +1,275 @@
+// Package cattletest provides a fake Cattle API for tests.  It answers the
+// schema calls of the API client, accepts the subscription of an event router
+// over websocket and records everything published.
+package cattletest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rancher/event-subscriber/events"
+	"github.com/rancher/go-rancher/v3"
+)
+
+// Timeout is how long the server waits for a subscriber or a reply
+var Timeout = 10 * time.Second
+
+type Server struct {
+	// URL of the API, for ClientOpts.Url
+	URL string
+
+	server   *httptest.Server
+	upgrader websocket.Upgrader
+
+	lock      sync.Mutex
+	changed   *sync.Cond
+	conn      *websocket.Conn
+	published []*client.Publish
+	nextID    int
+}
+
+// NewServer starts a fake Cattle API, it has to be closed when done
+func NewServer() *Server {
+	s := &Server{}
+	s.changed = sync.NewCond(&s.lock)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3", s.root)
+	mux.HandleFunc("/v3/schemas", s.schemas)
+	mux.HandleFunc("/v3/subscribe", s.subscribe)
+	mux.HandleFunc("/v3/publish", s.publish)
+
+	s.server = httptest.NewServer(mux)
+	s.URL = s.server.URL + "/v3"
+	return s
+}
+
+// Opts returns the options for a client of the server
+func (s *Server) Opts() *client.ClientOpts {
+	return &client.ClientOpts{
+		Url:       s.URL,
+		AccessKey: "access",
+		SecretKey: "secret",
+	}
+}
+
+func (s *Server) Close() {
+	s.lock.Lock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.lock.Unlock()
+
+	s.server.Close()
+}
+
+func (s *Server) root(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("X-API-Schemas", s.URL+"/schemas")
+	writeJSON(rw, http.StatusOK, map[string]interface{}{
+		"type":  "apiVersion",
+		"links": map[string]string{"schemas": s.URL + "/schemas"},
+	})
+}
+
+func (s *Server) schemas(rw http.ResponseWriter, req *http.Request) {
+	schemas := client.Schemas{}
+	for _, name := range []string{"subscribe", "publish"} {
+		schemas.Data = append(schemas.Data, client.Schema{
+			Resource: client.Resource{
+				Id:   name,
+				Type: "schema",
+				Links: map[string]string{
+					"self":       s.URL + "/schemas/" + name,
+					"collection": s.URL + "/" + name,
+				},
+			},
+			PluralName:        name,
+			CollectionMethods: []string{"GET", "POST"},
+		})
+	}
+	writeJSON(rw, http.StatusOK, schemas)
+}
+
+func (s *Server) subscribe(rw http.ResponseWriter, req *http.Request) {
+	conn, err := s.upgrader.Upgrade(rw, req, nil)
+	if err != nil {
+		return
+	}
+
+	s.lock.Lock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.conn = conn
+	s.changed.Broadcast()
+	s.lock.Unlock()
+
+	// Reading answers the pings of the router
+	for {
+		if _, _, err := conn.NextReader(); err != nil {
+			break
+		}
+	}
+
+	s.lock.Lock()
+	if s.conn == conn {
+		s.conn = nil
+	}
+	s.lock.Unlock()
+	conn.Close()
+}
+
+func (s *Server) publish(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	publish := &client.Publish{}
+	if err := json.NewDecoder(req.Body).Decode(publish); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.lock.Lock()
+	s.published = append(s.published, publish)
+	s.changed.Broadcast()
+	s.lock.Unlock()
+
+	writeJSON(rw, http.StatusCreated, publish)
+}
+
+func writeJSON(rw http.ResponseWriter, status int, obj interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(obj)
+}
+
+// wait waits up to Timeout for the condition, which is checked with the lock
+// held
+func (s *Server) wait(condition func() bool) bool {
+	timer := time.AfterFunc(Timeout, func() {
+		s.lock.Lock()
+		s.changed.Broadcast()
+		s.lock.Unlock()
+	})
+	defer timer.Stop()
+
+	deadline := time.Now().Add(Timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		s.changed.Wait()
+	}
+	return true
+}
+
+// WaitForSubscriber waits until an event router is connected
+func (s *Server) WaitForSubscriber() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.wait(func() bool { return s.conn != nil }) {
+		return fmt.Errorf("no subscriber after %v", Timeout)
+	}
+	return nil
+}
+
+// Send pushes an event to the connected event router
+func (s *Server) Send(event *events.Event) error {
+	bytes, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.wait(func() bool { return s.conn != nil }) {
+		return fmt.Errorf("no subscriber after %v", Timeout)
+	}
+	return s.conn.WriteMessage(websocket.TextMessage, bytes)
+}
+
+// Sync sends a metadata.sync event with the request, which can be a
+// MetadataSyncRequest or a map for fields it does not have, and returns the
+// data of the reply
+func (s *Server) Sync(request interface{}) (map[string]interface{}, error) {
+	s.lock.Lock()
+	s.nextID++
+	id := "sync-" + strconv.Itoa(s.nextID)
+	s.lock.Unlock()
+
+	err := s.Send(&events.Event{
+		Name:    "metadata.sync",
+		ID:      id,
+		ReplyTo: "reply." + id,
+		Data: map[string]interface{}{
+			"metadataSyncRequest": request,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := s.WaitForPublish(func(publish *client.Publish) bool {
+		if publish.PreviousId == id {
+			return true
+		}
+		for _, previous := range publish.PreviousIds {
+			if previous == id {
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return nil, fmt.Errorf("no reply to %s: %v", id, err)
+	}
+
+	if reply.Transitioning == "error" {
+		return nil, fmt.Errorf("%s failed: %s", id, reply.TransitioningMessage)
+	}
+	return reply.Data, nil
+}
+
+// WaitForPublish returns the first publish matching f, waiting for it if it
+// has not been published yet
+func (s *Server) WaitForPublish(f func(*client.Publish) bool) (*client.Publish, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var found *client.Publish
+	ok := s.wait(func() bool {
+		for _, publish := range s.published {
+			if f(publish) {
+				found = publish
+				return true
+			}
+		}
+		return false
+	})
+	if !ok {
+		return nil, fmt.Errorf("nothing published after %v", Timeout)
+	}
+	return found, nil
+}
+
+// Published returns the names of everything published so far in order
+func (s *Server) Published() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var names []string
+	for _, publish := range s.published {
+		names = append(names, publish.Name)
+	}
+	return names
+}
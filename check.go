@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/codegangsta/cli"
+	"github.com/rancher/metadata/consistency"
+	"github.com/rancher/metadata/content/memory"
+	"github.com/rancher/metadata/subscriber"
+)
+
+func checkMain(ctx *cli.Context) error {
+	keys, err := commandDataKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	store := memory.NewMemoryStore()
+	generation, err := subscriber.Load(ctx.String("data-dir"), store, keys)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed to load %s: %v", ctx.String("data-dir"), err), 2)
+	}
+	if generation == "" {
+		return cli.NewExitError(fmt.Sprintf("No persisted generation found in %s", ctx.String("data-dir")), 2)
+	}
+
+	report := consistency.Check(store, ctx.Args().First())
+
+	if ctx.Bool("json") {
+		if err := json.NewEncoder(os.Stdout).Encode(report); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("Generation %s: %d problems\n", generation, len(report.Problems))
+		for _, problem := range report.Problems {
+			fmt.Println(problem)
+		}
+	}
+
+	if len(report.Problems) > 0 {
+		return cli.NewExitError("", 1)
+	}
+	return nil
+}
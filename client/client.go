@@ -0,0 +1,369 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rancher/metadata/types"
+)
+
+const (
+	DefaultURL = "http://169.254.169.250:9346/latest"
+
+	defaultRetries = 5
+	defaultBackoff = 500 * time.Millisecond
+	maxBackoff     = 10 * time.Second
+)
+
+var ErrNotFound = errors.New("not found")
+
+// Client reads the metadata API of one version, such as DefaultURL
+type Client struct {
+	url     string
+	http    *http.Client
+	retries int
+	backoff time.Duration
+	maxWait time.Duration
+}
+
+func New(url string) *Client {
+	return &Client{
+		url:     strings.TrimRight(url, "/"),
+		http:    &http.Client{},
+		retries: defaultRetries,
+		backoff: defaultBackoff,
+		maxWait: time.Minute,
+	}
+}
+
+// SetRetries sets how many times a failed request is retried and the initial
+// delay between attempts, which doubles after every attempt
+func (c *Client) SetRetries(retries int, backoff time.Duration) {
+	c.retries = retries
+	c.backoff = backoff
+}
+
+// SetMaxWait sets how long the server holds a watch request open before it is
+// sent again
+func (c *Client) SetMaxWait(maxWait time.Duration) {
+	c.maxWait = maxWait
+}
+
+type statusError struct {
+	method string
+	url    string
+	status string
+	code   int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.method, e.url, e.status)
+}
+
+// retryable is false for requests the server rejected, they get the same
+// answer when sent again
+func retryable(err error) bool {
+	if err == ErrNotFound {
+		return false
+	}
+	if e, ok := err.(*statusError); ok {
+		return e.code < 400 || e.code >= 500
+	}
+	return true
+}
+
+func (c *Client) get(ctx context.Context, path string, query url.Values, accept string) ([]byte, error) {
+	body, _, err := c.request(ctx, "GET", path, query, accept, nil)
+	return body, err
+}
+
+func (c *Client) request(ctx context.Context, method, path string, query url.Values, accept string, content []byte) ([]byte, http.Header, error) {
+	u := c.url + "/" + strings.TrimLeft(path, "/")
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		body, header, err := c.requestOnce(ctx, method, u, accept, content)
+		if err == nil || !retryable(err) || attempt >= c.retries {
+			return body, header, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (c *Client) requestOnce(ctx context.Context, method, u, accept string, content []byte) ([]byte, http.Header, error) {
+	var reader io.Reader
+	if content != nil {
+		reader = bytes.NewReader(content)
+	}
+
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", accept)
+	if content != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil, ErrNotFound
+	case resp.StatusCode != http.StatusOK:
+		return nil, nil, &statusError{
+			method: method,
+			url:    u,
+			status: resp.Status,
+			code:   resp.StatusCode,
+		}
+	}
+
+	return body, resp.Header, nil
+}
+
+// GetValue returns the plain text form of a path
+func (c *Client) GetValue(path string) (string, error) {
+	body, err := c.get(context.Background(), path, nil, "text/plain")
+	return string(body), err
+}
+
+// GetJSON decodes the JSON form of a path into out
+func (c *Client) GetJSON(path string, out interface{}) error {
+	body, err := c.get(context.Background(), path, nil, "application/json")
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, out)
+}
+
+// GetBatch decodes the JSON forms of several paths into the values of outs,
+// keyed by path.  The paths are all read from the same version of the
+// metadata.  It fails with ErrNotFound if one of them does not exist.
+func (c *Client) GetBatch(outs map[string]interface{}) error {
+	paths := make([]string, 0, len(outs))
+	for path := range outs {
+		paths = append(paths, path)
+	}
+
+	content, err := json.Marshal(paths)
+	if err != nil {
+		return err
+	}
+
+	body, _, err := c.request(context.Background(), "POST", "batch", nil, "application/json", content)
+	if err != nil {
+		return err
+	}
+
+	results := map[string]struct {
+		Value json.RawMessage `json:"value"`
+		Error string          `json:"error"`
+	}{}
+	if err := json.Unmarshal(body, &results); err != nil {
+		return err
+	}
+
+	for path, out := range outs {
+		result, ok := results[path]
+		switch {
+		case !ok || result.Error == "Not found":
+			return ErrNotFound
+		case result.Error != "":
+			return fmt.Errorf("%s: %s", path, result.Error)
+		}
+		if err := json.Unmarshal(result.Value, out); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) GetVersion() (string, error) {
+	return c.GetValue("version")
+}
+
+func (c *Client) GetSelf() (types.MetadataSelf, error) {
+	var result types.MetadataSelf
+	return result, c.GetJSON("self", &result)
+}
+
+func (c *Client) GetSelfContainer() (types.ContainerResponse, error) {
+	var result types.ContainerResponse
+	return result, c.GetJSON("self/container", &result)
+}
+
+func (c *Client) GetSelfService() (types.ServiceResponse, error) {
+	var result types.ServiceResponse
+	return result, c.GetJSON("self/service", &result)
+}
+
+func (c *Client) GetSelfStack() (types.StackResponse, error) {
+	var result types.StackResponse
+	return result, c.GetJSON("self/stack", &result)
+}
+
+func (c *Client) GetSelfHost() (types.HostResponse, error) {
+	var result types.HostResponse
+	return result, c.GetJSON("self/host", &result)
+}
+
+func (c *Client) GetSelfNetwork() (types.NetworkResponse, error) {
+	var result types.NetworkResponse
+	return result, c.GetJSON("self/network", &result)
+}
+
+func (c *Client) GetEnvironment() (types.EnvironmentResponse, error) {
+	var result types.EnvironmentResponse
+	return result, c.GetJSON("", &result)
+}
+
+func (c *Client) GetStacks() ([]types.StackResponse, error) {
+	var result []types.StackResponse
+	return result, c.GetJSON("stacks", &result)
+}
+
+func (c *Client) GetServices() ([]types.ServiceResponse, error) {
+	var result []types.ServiceResponse
+	return result, c.GetJSON("services", &result)
+}
+
+func (c *Client) GetContainers() ([]types.ContainerResponse, error) {
+	var result []types.ContainerResponse
+	return result, c.GetJSON("containers", &result)
+}
+
+func (c *Client) GetHosts() ([]types.HostResponse, error) {
+	var result []types.HostResponse
+	return result, c.GetJSON("hosts", &result)
+}
+
+func (c *Client) GetNetworks() ([]types.NetworkResponse, error) {
+	var result []types.NetworkResponse
+	return result, c.GetJSON("networks", &result)
+}
+
+func (c *Client) GetStackByName(name string) (types.StackResponse, error) {
+	var result types.StackResponse
+	return result, c.GetJSON("stacks/"+url.QueryEscape(name), &result)
+}
+
+func (c *Client) GetServiceByName(stackName, name string) (types.ServiceResponse, error) {
+	var result types.ServiceResponse
+	return result, c.GetJSON(fmt.Sprintf("stacks/%s/services/%s", url.QueryEscape(stackName), url.QueryEscape(name)), &result)
+}
+
+func (c *Client) GetContainerByName(stackName, name string) (types.ContainerResponse, error) {
+	containers, err := c.GetContainers()
+	if err != nil {
+		return types.ContainerResponse{}, err
+	}
+
+	for _, container := range containers {
+		if strings.EqualFold(container.StackName, stackName) && strings.EqualFold(container.Name, name) {
+			return container, nil
+		}
+	}
+
+	return types.ContainerResponse{}, ErrNotFound
+}
+
+func (c *Client) GetHostByName(name string) (types.HostResponse, error) {
+	var result types.HostResponse
+	return result, c.GetJSON("hosts/"+url.QueryEscape(name), &result)
+}
+
+// Watch sends the JSON form of the value of a path on the returned channel,
+// first its current value and then every new value as it changes, so changes
+// below an object are seen too.  Each request waits on the server until the
+// ETag of the value changes.  The channel is closed when ctx is done.
+func (c *Client) Watch(ctx context.Context, path string) <-chan string {
+	result := make(chan string)
+
+	go func() {
+		defer close(result)
+
+		var (
+			value string
+			etag  string
+			known bool
+			pause = c.backoff
+		)
+		for ctx.Err() == nil {
+			query := url.Values{}
+			if known {
+				query.Set("wait", "true")
+				query.Set("value", etag)
+				query.Set("maxWait", fmt.Sprint(int(c.maxWait/time.Second)))
+			}
+
+			body, header, err := c.request(ctx, "GET", path, query, "application/json", nil)
+			if err != nil {
+				// Retries are exhausted or the path does not exist yet, poll
+				// again after a pause
+				select {
+				case <-ctx.Done():
+				case <-time.After(maxBackoff):
+				}
+				continue
+			}
+
+			newValue := string(body)
+			if known && newValue == value {
+				// The wait timed out, or the server does not know ETags and
+				// answers at once, don't ask again right away
+				select {
+				case <-ctx.Done():
+				case <-time.After(pause):
+				}
+				pause *= 2
+				if pause > maxBackoff {
+					pause = maxBackoff
+				}
+				continue
+			}
+
+			value, etag, known = newValue, header.Get("ETag"), true
+			pause = c.backoff
+			select {
+			case <-ctx.Done():
+			case result <- value:
+			}
+		}
+	}()
+
+	return result
+}
@@ -0,0 +1,221 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// counter counts the requests of a test server
+type counter struct {
+	n int32
+}
+
+func (c *counter) count(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&c.n, 1)
+		f(w, req)
+	}
+}
+
+func (c *counter) get() int {
+	return int(atomic.LoadInt32(&c.n))
+}
+
+func newClient(url string) *Client {
+	c := New(url)
+	c.SetRetries(3, time.Millisecond)
+	return c
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		status   int
+		requests int
+	}{
+		{http.StatusInternalServerError, 4},
+		{http.StatusServiceUnavailable, 4},
+		{http.StatusBadRequest, 1},
+		{http.StatusForbidden, 1},
+		{http.StatusNotFound, 1},
+	}
+
+	for _, test := range tests {
+		requests := &counter{}
+		ts := httptest.NewServer(requests.count(func(w http.ResponseWriter, req *http.Request) {
+			http.Error(w, "failed", test.status)
+		}))
+
+		_, err := newClient(ts.URL).GetValue("version")
+		ts.Close()
+
+		if err == nil {
+			t.Errorf("%d: expected an error", test.status)
+		}
+		if test.status == http.StatusNotFound && err != ErrNotFound {
+			t.Errorf("%d: expected ErrNotFound, got %v", test.status, err)
+		}
+		if requests.get() != test.requests {
+			t.Errorf("%d: expected %d requests, got %d", test.status, test.requests, requests.get())
+		}
+	}
+}
+
+func TestRetrySucceeds(t *testing.T) {
+	requests := &counter{}
+	ts := httptest.NewServer(requests.count(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&requests.n) < 3 {
+			http.Error(w, "failed", http.StatusBadGateway)
+			return
+		}
+		fmt.Fprint(w, "42")
+	}))
+	defer ts.Close()
+
+	if value, err := newClient(ts.URL).GetValue("version"); err != nil || value != "42" {
+		t.Errorf("Expected 42 after retries, got %q %v", value, err)
+	}
+}
+
+// etagServer serves a JSON value with an ETag and holds wait requests for the
+// current ETag until the value changes, as the metadata server does
+type etagServer struct {
+	sync.Mutex
+	version int
+	changed chan struct{}
+}
+
+func newETagServer() *etagServer {
+	return &etagServer{
+		changed: make(chan struct{}),
+	}
+}
+
+func (s *etagServer) current() (string, string, chan struct{}) {
+	s.Lock()
+	defer s.Unlock()
+	return fmt.Sprintf(`{"version":%d}`+"\n", s.version), strconv.Quote(strconv.Itoa(s.version)), s.changed
+}
+
+func (s *etagServer) change() {
+	s.Lock()
+	defer s.Unlock()
+	s.version++
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *etagServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, etag, changed := s.current()
+	query := req.URL.Query()
+	if query.Get("wait") == "true" && query.Get("value") == etag {
+		maxWait, _ := strconv.Atoi(query.Get("maxWait"))
+		select {
+		case <-changed:
+		case <-time.After(time.Duration(maxWait) * time.Second):
+		}
+		body, etag, _ = s.current()
+	}
+
+	w.Header().Set("ETag", etag)
+	fmt.Fprint(w, body)
+}
+
+func receive(t *testing.T, values <-chan string) string {
+	select {
+	case value := <-values:
+		return value
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a value")
+		return ""
+	}
+}
+
+func expectNothing(t *testing.T, values <-chan string, wait time.Duration) {
+	select {
+	case value := <-values:
+		t.Errorf("Expected no value, got %q", value)
+	case <-time.After(wait):
+	}
+}
+
+func TestWatch(t *testing.T) {
+	server := newETagServer()
+	requests := &counter{}
+	ts := httptest.NewServer(requests.count(server.ServeHTTP))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	values := newClient(ts.URL).Watch(ctx, "self/container")
+	if value := receive(t, values); value != `{"version":0}`+"\n" {
+		t.Errorf("Expected the current value first, got %q", value)
+	}
+
+	expectNothing(t, values, 200*time.Millisecond)
+	if requests.get() > 2 {
+		t.Errorf("Expected the watch to wait on the server, got %d requests", requests.get())
+	}
+
+	server.change()
+	if value := receive(t, values); value != `{"version":1}`+"\n" {
+		t.Errorf("Expected the new value, got %q", value)
+	}
+
+	cancel()
+	for range values {
+	}
+}
+
+// TestWatchWithoutETag checks that a server that answers wait requests at
+// once with the same value is not polled in a busy loop
+func TestWatchWithoutETag(t *testing.T) {
+	requests := &counter{}
+	ts := httptest.NewServer(requests.count(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, `{"name":"web"}`)
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := New(ts.URL)
+	c.SetRetries(0, 50*time.Millisecond)
+	values := c.Watch(ctx, "self/stack")
+	receive(t, values)
+	expectNothing(t, values, 500*time.Millisecond)
+
+	// 50, 100 and 200ms pauses fit in 500ms
+	if n := requests.get(); n > 5 {
+		t.Errorf("Expected the unchanged value to be polled with pauses, got %d requests", n)
+	}
+
+	cancel()
+	for range values {
+	}
+}
+
+func TestWatchNotFound(t *testing.T) {
+	requests := &counter{}
+	ts := httptest.NewServer(requests.count(func(w http.ResponseWriter, req *http.Request) {
+		http.NotFound(w, req)
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	for value := range newClient(ts.URL).Watch(ctx, "self/service") {
+		t.Errorf("Expected no value for a missing path, got %q", value)
+	}
+	if n := requests.get(); n != 1 {
+		t.Errorf("Expected a missing path to be polled after a pause, got %d requests", n)
+	}
+}
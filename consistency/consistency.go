@@ -0,0 +1,169 @@
+package consistency
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/rancher/go-rancher/v3"
+	"github.com/rancher/metadata/content"
+	"github.com/rancher/metadata/types/convert"
+)
+
+const (
+	BrokenLink      = "broken_link"
+	MissingLBTarget = "missing_lb_target"
+	MissingHost     = "missing_host"
+	MissingNetwork  = "missing_network"
+	MissingService  = "missing_service"
+	UnknownInstance = "unknown_instance"
+)
+
+type Problem struct {
+	Kind            string             `json:"kind"`
+	Type            content.ObjectType `json:"type"`
+	UUID            string             `json:"uuid"`
+	Name            string             `json:"name"`
+	EnvironmentUUID string             `json:"environment_uuid"`
+	Reference       string             `json:"reference"`
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s %s (%s) references %s", p.Kind, p.Type, p.Name, p.UUID, p.Reference)
+}
+
+type Report struct {
+	Version  string    `json:"version"`
+	Problems []Problem `json:"problems"`
+}
+
+// Check reports references between objects in the store that do not resolve.
+// If environmentUUID is not empty only objects of that environment are checked.
+func Check(store content.Store, environmentUUID string) *Report {
+	report := &Report{
+		Problems: []Problem{},
+	}
+
+	store.View(func() {
+		report.Version = store.Version()
+
+		for _, obj := range store.All(content.ContainerType) {
+			container := obj.(*client.InstanceInfo)
+			if environmentUUID == "" || container.EnvironmentUuid == environmentUUID {
+				report.Problems = append(report.Problems, checkContainer(store, container)...)
+			}
+		}
+
+		for _, obj := range store.All(content.ServiceType) {
+			service := obj.(*client.ServiceInfo)
+			if environmentUUID == "" || service.EnvironmentUuid == environmentUUID {
+				report.Problems = append(report.Problems, checkService(store, service)...)
+			}
+		}
+	})
+
+	sort.Slice(report.Problems, func(i, j int) bool {
+		left, right := report.Problems[i], report.Problems[j]
+		if left.UUID != right.UUID {
+			return left.UUID < right.UUID
+		}
+		if left.Kind != right.Kind {
+			return left.Kind < right.Kind
+		}
+		return left.Reference < right.Reference
+	})
+
+	return report
+}
+
+func checkContainer(store content.Store, container *client.InstanceInfo) []Problem {
+	var result []Problem
+
+	problem := func(kind, reference string) {
+		result = append(result, Problem{
+			Kind:            kind,
+			Type:            content.ContainerType,
+			UUID:            container.Uuid,
+			Name:            container.Name,
+			EnvironmentUUID: container.EnvironmentUuid,
+			Reference:       reference,
+		})
+	}
+
+	if container.HostId != "" && store.HostByID(container.HostId) == nil {
+		problem(MissingHost, container.HostId)
+	}
+
+	if container.NetworkId != "" && store.NetworkByID(container.NetworkId) == nil {
+		problem(MissingNetwork, container.NetworkId)
+	}
+
+	if container.ServiceId != "" && store.ServiceByID(container.ServiceId) == nil {
+		problem(MissingService, container.ServiceId)
+	}
+
+	stackName := ""
+	if stack := store.StackByID(container.StackId); stack != nil {
+		stackName = stack.Name
+	}
+
+	for _, link := range container.Links {
+		targetStack, targetName := convert.LinkTarget(stackName, link.Name)
+		if store.ContainerByName(container.EnvironmentUuid, targetStack, targetName) == nil {
+			problem(BrokenLink, link.Name)
+		}
+	}
+
+	return result
+}
+
+func checkService(store content.Store, service *client.ServiceInfo) []Problem {
+	var result []Problem
+
+	problem := func(kind, reference string) {
+		result = append(result, Problem{
+			Kind:            kind,
+			Type:            content.ServiceType,
+			UUID:            service.Uuid,
+			Name:            service.Name,
+			EnvironmentUUID: service.EnvironmentUuid,
+			Reference:       reference,
+		})
+	}
+
+	for _, id := range service.InstanceIds {
+		if store.ContainerByID(id) == nil {
+			problem(UnknownInstance, id)
+		}
+	}
+
+	stackName := ""
+	if stack := store.StackByID(service.StackId); stack != nil {
+		stackName = stack.Name
+	}
+
+	for _, link := range service.Links {
+		targetStack, targetName := convert.LinkTarget(stackName, link.Name)
+		if store.ServiceByName(service.EnvironmentUuid, targetStack, targetName) == nil {
+			problem(BrokenLink, link.Name)
+		}
+	}
+
+	if service.LbConfig == nil {
+		return result
+	}
+
+	for _, rule := range service.LbConfig.PortRules {
+		if rule.InstanceId != "" && store.ContainerByID(rule.InstanceId) == nil {
+			problem(MissingLBTarget, rule.InstanceId)
+		}
+
+		if rule.ServiceId != "" {
+			target := store.ServiceByID(rule.ServiceId)
+			if target == nil || store.StackByID(target.StackId) == nil {
+				problem(MissingLBTarget, rule.ServiceId)
+			}
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,160 @@
+package consistency
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/rancher/metadata/content"
+	"github.com/rancher/metadata/content/memory"
+)
+
+func object(infoType, id string, fields map[string]interface{}) map[string]interface{} {
+	obj := map[string]interface{}{
+		"infoType":        infoType,
+		"infoTypeId":      id,
+		"uuid":            infoType + "-" + id,
+		"environmentUuid": "env-1",
+	}
+	for key, value := range fields {
+		obj[key] = value
+	}
+	return obj
+}
+
+func links(names ...string) []interface{} {
+	var result []interface{}
+	for _, name := range names {
+		result = append(result, map[string]interface{}{"name": name})
+	}
+	return result
+}
+
+func newStore(t *testing.T) content.Store {
+	store := memory.NewMemoryStore()
+	for _, obj := range []map[string]interface{}{
+		object("environment", "1", map[string]interface{}{"uuid": "env-1", "name": "Default"}),
+		object("environment", "2", map[string]interface{}{"uuid": "env-2", "name": "Other"}),
+		object("host", "1", map[string]interface{}{"name": "host-1"}),
+		object("network", "1", map[string]interface{}{"name": "managed"}),
+		object("stack", "1", map[string]interface{}{"name": "web"}),
+		object("stack", "2", map[string]interface{}{"name": "db"}),
+
+		// Resolves
+		object("service", "1", map[string]interface{}{
+			"name":        "nginx",
+			"stackId":     "1",
+			"instanceIds": []interface{}{"1"},
+			"links":       links("db/mysql"),
+		}),
+		object("service", "2", map[string]interface{}{
+			"name":    "mysql",
+			"stackId": "2",
+		}),
+		object("instance", "1", map[string]interface{}{
+			"name":      "nginx-1",
+			"stackId":   "1",
+			"serviceId": "1",
+			"hostId":    "1",
+			"networkId": "1",
+			"links":     links("db/mysql-1"),
+		}),
+		object("instance", "2", map[string]interface{}{
+			"name":    "mysql-1",
+			"stackId": "2",
+		}),
+
+		// Broken
+		object("instance", "3", map[string]interface{}{
+			"name":      "orphan",
+			"stackId":   "1",
+			"serviceId": "99",
+			"hostId":    "99",
+			"networkId": "99",
+			"links":     links("nginx-1", "missing"),
+		}),
+		object("service", "3", map[string]interface{}{
+			"name":        "api",
+			"stackId":     "1",
+			"instanceIds": []interface{}{"1", "98"},
+			"links":       links("nginx", "mysql"),
+		}),
+		object("service", "4", map[string]interface{}{
+			"name":    "lb",
+			"stackId": "1",
+			"lbConfig": map[string]interface{}{
+				"portRules": []interface{}{
+					map[string]interface{}{"instanceId": "1", "serviceId": "1"},
+					map[string]interface{}{"instanceId": "97"},
+					map[string]interface{}{"serviceId": "96"},
+					map[string]interface{}{"serviceId": "5"},
+				},
+			},
+		}),
+		// Its stack is gone
+		object("service", "5", map[string]interface{}{
+			"name":    "gone",
+			"stackId": "95",
+		}),
+
+		object("instance", "4", map[string]interface{}{
+			"name":            "elsewhere",
+			"environmentUuid": "env-2",
+			"hostId":          "94",
+		}),
+	} {
+		if err := store.Add(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func problems(report *Report) string {
+	var result []string
+	for _, problem := range report.Problems {
+		result = append(result, fmt.Sprintf("%s %s %s", problem.UUID, problem.Kind, problem.Reference))
+	}
+	return strings.Join(result, "\n")
+}
+
+func TestCheck(t *testing.T) {
+	store := newStore(t)
+
+	expected := strings.Join([]string{
+		"instance-3 broken_link missing",
+		"instance-3 missing_host 99",
+		"instance-3 missing_network 99",
+		"instance-3 missing_service 99",
+		"instance-4 missing_host 94",
+		"service-3 broken_link mysql",
+		"service-3 unknown_instance 98",
+		"service-4 missing_lb_target 5",
+		"service-4 missing_lb_target 96",
+		"service-4 missing_lb_target 97",
+	}, "\n")
+
+	report := Check(store, "")
+	if actual := problems(report); actual != expected {
+		t.Errorf("Expected problems\n%s\ngot\n%s", expected, actual)
+	}
+	if report.Version != store.Version() {
+		t.Errorf("Expected version %s, got %s", store.Version(), report.Version)
+	}
+
+	problem := report.Problems[0]
+	if problem.Type != content.ContainerType || problem.Name != "orphan" || problem.EnvironmentUUID != "env-1" {
+		t.Errorf("Expected the problem of container orphan, got %+v", problem)
+	}
+}
+
+func TestCheckEnvironment(t *testing.T) {
+	store := newStore(t)
+
+	if actual := problems(Check(store, "env-2")); actual != "instance-4 missing_host 94" {
+		t.Errorf("Expected only the problems of env-2, got\n%s", actual)
+	}
+	if report := Check(store, "env-3"); len(report.Problems) != 0 {
+		t.Errorf("Expected no problems in an unknown environment, got %v", report.Problems)
+	}
+}
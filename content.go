@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"github.com/rancher/metadata/content"
+	"github.com/rancher/metadata/content/memory"
+	"github.com/rancher/metadata/server"
+	"github.com/rancher/metadata/subscriber"
+)
+
+type snapshot struct {
+	Generation string                 `json:"generation"`
+	Objects    map[string]interface{} `json:"objects"`
+}
+
+func loadContent(ctx *cli.Context) (content.Store, string, error) {
+	if !ctx.GlobalBool("debug") {
+		// Loading logs every object
+		logrus.SetLevel(logrus.WarnLevel)
+	}
+
+	keys, err := commandDataKeys(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	dir := ctx.String("data-dir")
+	store := memory.NewMemoryStore()
+	generation, err := subscriber.Load(dir, store, keys)
+	if err != nil {
+		return nil, "", cli.NewExitError(fmt.Sprintf("Failed to load %s: %v", dir, err), 2)
+	}
+	if generation == "" {
+		return nil, "", cli.NewExitError(fmt.Sprintf("No persisted generation found in %s", dir), 2)
+	}
+	return store, generation, nil
+}
+
+func contentLsMain(ctx *cli.Context) error {
+	objectTypes := content.Types
+	if ctx.String("type") != "" {
+		objectType, ok := parseType(ctx.String("type"))
+		if !ok {
+			return cli.NewExitError(fmt.Sprintf("Unknown type %s", ctx.String("type")), 2)
+		}
+		objectTypes = []content.ObjectType{objectType}
+	}
+
+	store, generation, err := loadContent(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Generation %s\n", generation)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tUUID\tNAME\tENVIRONMENT")
+	for _, objectType := range objectTypes {
+		var rows []string
+		for _, obj := range store.All(objectType) {
+			rows = append(rows, fmt.Sprintf("%s\t%s\t%s\t%s", objectType,
+				field(obj, "Uuid"), field(obj, "Name"), field(obj, "EnvironmentUuid")))
+		}
+		sort.Strings(rows)
+		for _, row := range rows {
+			fmt.Fprintln(w, row)
+		}
+	}
+	return w.Flush()
+}
+
+func parseType(name string) (content.ObjectType, bool) {
+	for _, objectType := range content.Types {
+		if string(objectType) == name {
+			return objectType, true
+		}
+	}
+	return "", false
+}
+
+func field(obj interface{}, name string) string {
+	if v, ok := content.GetValue(obj, name); ok && v != nil {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+func contentShowMain(ctx *cli.Context) error {
+	store, _, err := loadContent(ctx)
+	if err != nil {
+		return err
+	}
+
+	p := strings.Trim(ctx.Args().First(), "/")
+	var segments []string
+	if p != "" {
+		segments = strings.Split(p, "/")
+	}
+
+	var (
+		bytes []byte
+		found bool
+	)
+	store.View(func() {
+		var val interface{}
+		val, found = server.Lookup(store, ctx.String("api-version"), ctx.String("ip"), segments)
+		if found {
+			bytes, err = json.MarshalIndent(val, "", "  ")
+		}
+	})
+
+	if !found {
+		return cli.NewExitError(fmt.Sprintf("Not found: %s", p), 1)
+	} else if err != nil {
+		return cli.NewExitError(err.Error(), 2)
+	}
+
+	fmt.Println(string(bytes))
+	return nil
+}
+
+func contentVerifyMain(ctx *cli.Context) error {
+	keys, err := commandDataKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	dir := ctx.String("data-dir")
+	snapshot, err := subscriber.ReadSnapshot(dir, keys)
+	if err != nil {
+		fmt.Println(err)
+		return cli.NewExitError("", 1)
+	}
+
+	if snapshot == nil {
+		return verifyFiles(dir, keys)
+	}
+
+	if snapshot.Corrupt != nil {
+		fmt.Println(snapshot.Corrupt)
+	}
+	fmt.Printf("Generation %s: %d objects, %d log records\n", snapshot.Generation, len(snapshot.Objects), snapshot.Records)
+	if snapshot.Corrupt != nil {
+		return cli.NewExitError("", 1)
+	}
+	return nil
+}
+
+func verifyFiles(dir string, keys *subscriber.Keys) error {
+	generation, files, err := subscriber.Files(dir, keys)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed to read %s: %v", dir, err), 2)
+	}
+	if generation == "" {
+		return cli.NewExitError(fmt.Sprintf("No persisted generation found in %s", dir), 2)
+	}
+
+	failed := 0
+	for _, filename := range files {
+		obj, err := subscriber.ReadObject(filename, keys)
+		if err == nil {
+			if uuid, _ := obj["uuid"].(string); uuid == "" {
+				err = fmt.Errorf("missing uuid")
+			} else if uuid != path.Base(filename) {
+				err = fmt.Errorf("uuid %s does not match the file name", uuid)
+			}
+		}
+
+		if err != nil {
+			failed++
+			fmt.Printf("%s: %v\n", filename, err)
+		}
+	}
+
+	fmt.Printf("Generation %s: %d files, %d invalid\n", generation, len(files), failed)
+	if failed > 0 {
+		return cli.NewExitError("", 1)
+	}
+	return nil
+}
+
+func contentExportMain(ctx *cli.Context) error {
+	keys, err := commandDataKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	dir := ctx.String("data-dir")
+	generation, objects, err := subscriber.ReadGeneration(dir, keys)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed to load %s: %v", dir, err), 2)
+	}
+	if generation == "" {
+		return cli.NewExitError(fmt.Sprintf("No persisted generation found in %s", dir), 2)
+	}
+
+	var out io.Writer = os.Stdout
+	if output := ctx.String("output"); output != "" && output != "-" {
+		f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 2)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(snapshot{
+		Generation: generation,
+		Objects:    objects,
+	})
+}
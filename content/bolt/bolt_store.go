@@ -0,0 +1,445 @@
+// Package bolt implements a content.Store persisted in a bbolt database.
+// Objects are kept as synced, next to secondary indexes that answer the
+// lookups of the store without scanning, and every sync is applied in one
+// transaction.  Opening a store does not read the objects, they are decoded on
+// first use and cached.
+package bolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher/v3"
+	"github.com/rancher/metadata/content"
+	"go.etcd.io/bbolt"
+	"golang.org/x/sync/syncmap"
+)
+
+var (
+	// uuid => revision (8 bytes big endian) + object as synced in JSON
+	objectsBucket = []byte("objects")
+	// type:id => uuid
+	idsBucket = []byte("ids")
+	// type \0 uuid
+	typesBucket = []byte("types")
+	// environment uuid \0 type \0 uuid
+	environmentsBucket = []byte("environments")
+	// stack id \0 type \0 uuid
+	stacksBucket = []byte("stacks")
+	// environment uuid \0 type \0 stack id \0 lowercase name \0 uuid
+	namesBucket = []byte("names")
+	// primary IP \0 uuid
+	ipsBucket = []byte("ips")
+	// uuid of the system environments
+	systemBucket = []byte("system")
+	// versionKey and generationKey
+	metaBucket = []byte("meta")
+
+	indexBuckets = [][]byte{
+		idsBucket,
+		typesBucket,
+		environmentsBucket,
+		stacksBucket,
+		namesBucket,
+		ipsBucket,
+		systemBucket,
+	}
+
+	versionKey    = []byte("version")
+	generationKey = []byte("generation")
+
+	selfHostID = ""
+)
+
+type Store struct {
+	db *bbolt.DB
+
+	// lock serializes the writes and holds them off during View
+	lock sync.RWMutex
+	// version is only written with the lock held, and read atomically by
+	// Version which may be called during View
+	version    int64
+	generation string
+	log        *content.ChangeLog
+
+	// cache holds the decoded objects, it is only used if the revision of an
+	// entry matches the object read from the database
+	cache syncmap.Map // string(uuid) => *entry
+}
+
+type entry struct {
+	revision   uint64
+	objectType content.ObjectType
+	obj        interface{}
+}
+
+// NewBoltStore opens the store in file, creating it with the mode if it does
+// not exist
+func NewBoltStore(file string, mode os.FileMode) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(file), mode|(mode&0444)>>2); err != nil {
+		return nil, err
+	}
+
+	db, err := bbolt.Open(file, mode, &bbolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	m := &Store{
+		db:      db,
+		version: int64(time.Now().Nanosecond()),
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range append([][]byte{objectsBucket, metaBucket}, indexBuckets...) {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		meta := tx.Bucket(metaBucket)
+		if version := meta.Get(versionKey); version != nil {
+			m.version = int64(binary.BigEndian.Uint64(version))
+		}
+		m.generation = string(meta.Get(generationKey))
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	m.log = content.NewChangeLog(int(m.version))
+	logrus.Infof("Opened %s at version %d, generation %q", file, m.version, m.generation)
+
+	return m, nil
+}
+
+func (m *Store) Close() error {
+	return m.db.Close()
+}
+
+func (m *Store) view(f func(tx *bbolt.Tx)) {
+	m.db.View(func(tx *bbolt.Tx) error {
+		f(tx)
+		return nil
+	})
+}
+
+// get returns the object with the uuid, decoding it if it is not cached
+func (m *Store) get(tx *bbolt.Tx, uuid string) (content.ObjectType, interface{}) {
+	value := tx.Bucket(objectsBucket).Get([]byte(uuid))
+	if len(value) < 8 {
+		return "", nil
+	}
+
+	revision := binary.BigEndian.Uint64(value)
+	if cached, ok := m.cache.Load(uuid); ok && cached.(*entry).revision == revision {
+		return cached.(*entry).objectType, cached.(*entry).obj
+	}
+
+	objectType, obj := decode(value)
+	if obj == nil {
+		return "", nil
+	}
+
+	m.cache.Store(uuid, &entry{
+		revision:   revision,
+		objectType: objectType,
+		obj:        obj,
+	})
+	return objectType, obj
+}
+
+// scan calls f with the uuid ending each key of the bucket with the prefix
+// until it returns false
+func scan(tx *bbolt.Tx, bucket []byte, prefix string, f func(uuid string) bool) {
+	c := tx.Bucket(bucket).Cursor()
+	p := []byte(prefix)
+	for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Next() {
+		if !f(string(k[bytes.LastIndexByte(k, 0)+1:])) {
+			return
+		}
+	}
+}
+
+func key(parts ...string) string {
+	return strings.Join(parts, "\x00")
+}
+
+func (m *Store) newObject(objectType content.ObjectType, obj interface{}, c content.Client) content.Object {
+	return content.ObjectFactories[objectType](obj, c, m)
+}
+
+func (m *Store) Environment(c content.Client) content.Object {
+	result := m.clientEnvironment(c)
+	if result == nil {
+		return nil
+	}
+
+	return m.newObject(content.EnvironmentType, result, c)
+}
+
+func (m *Store) clientEnvironment(c content.Client) *client.EnvironmentInfo {
+	var result *client.EnvironmentInfo
+
+	m.view(func(tx *bbolt.Tx) {
+		if container := m.instanceByIP(tx, c.IP); container != nil {
+			result = m.environment(tx, container.EnvironmentUuid)
+			return
+		}
+
+		scan(tx, systemBucket, "", func(uuid string) bool {
+			result = m.environment(tx, uuid)
+			return result == nil
+		})
+	})
+
+	return result
+}
+
+func (m *Store) environment(tx *bbolt.Tx, uuid string) *client.EnvironmentInfo {
+	_, obj := m.get(tx, uuid)
+	env, _ := obj.(*client.EnvironmentInfo)
+	return env
+}
+
+func (m *Store) instanceByIP(tx *bbolt.Tx, ip string) *client.InstanceInfo {
+	var result *client.InstanceInfo
+
+	if ip == "" {
+		return nil
+	}
+
+	scan(tx, ipsBucket, key(ip, ""), func(uuid string) bool {
+		_, obj := m.get(tx, uuid)
+		result, _ = obj.(*client.InstanceInfo)
+		return result == nil
+	})
+
+	return result
+}
+
+// byName returns the first object of the type in the stack of the environment
+// with the name, ignoring case
+func (m *Store) byName(tx *bbolt.Tx, environmentUUID string, objectType content.ObjectType, stackID, name string) interface{} {
+	var result interface{}
+
+	scan(tx, namesBucket, key(environmentUUID, string(objectType), stackID, strings.ToLower(name), ""), func(uuid string) bool {
+		_, result = m.get(tx, uuid)
+		return result == nil
+	})
+
+	return result
+}
+
+func (m *Store) stackByName(tx *bbolt.Tx, environmentUUID, stackName string) *client.StackInfo {
+	stack, _ := m.byName(tx, environmentUUID, content.StackType, "", stackName).(*client.StackInfo)
+	return stack
+}
+
+func (m *Store) ServiceByName(environmentUUID, stackName, name string) *client.ServiceInfo {
+	var result *client.ServiceInfo
+
+	m.view(func(tx *bbolt.Tx) {
+		if stack := m.stackByName(tx, environmentUUID, stackName); stack != nil {
+			result, _ = m.byName(tx, environmentUUID, content.ServiceType, stack.InfoTypeId, name).(*client.ServiceInfo)
+		}
+	})
+
+	return result
+}
+
+func (m *Store) ContainerByName(environmentUUID, stackName, name string) *client.InstanceInfo {
+	var result *client.InstanceInfo
+
+	m.view(func(tx *bbolt.Tx) {
+		if stack := m.stackByName(tx, environmentUUID, stackName); stack != nil {
+			result, _ = m.byName(tx, environmentUUID, content.ContainerType, stack.InfoTypeId, name).(*client.InstanceInfo)
+		}
+	})
+
+	return result
+}
+
+func (m *Store) ByStack(objectType content.ObjectType, c content.Client, stackUUID string) []content.Object {
+	var result []content.Object
+
+	m.view(func(tx *bbolt.Tx) {
+		_, obj := m.get(tx, stackUUID)
+		stack, ok := obj.(*client.StackInfo)
+		if !ok {
+			return
+		}
+
+		scan(tx, stacksBucket, key(stack.InfoTypeId, string(objectType), ""), func(uuid string) bool {
+			if _, obj := m.get(tx, uuid); obj != nil {
+				result = append(result, m.newObject(objectType, obj, c))
+			}
+			return true
+		})
+	})
+
+	return result
+}
+
+func (m *Store) ByEnvironment(objectType content.ObjectType, c content.Client, environmentUUID string) []content.Object {
+	var result []content.Object
+
+	m.view(func(tx *bbolt.Tx) {
+		env := m.environment(tx, environmentUUID)
+		if env == nil {
+			return
+		}
+
+		bucket, prefix := environmentsBucket, key(environmentUUID, string(objectType), "")
+		if env.System {
+			bucket, prefix = typesBucket, key(string(objectType), "")
+		}
+
+		scan(tx, bucket, prefix, func(uuid string) bool {
+			if _, obj := m.get(tx, uuid); obj != nil {
+				result = append(result, m.newObject(objectType, obj, c))
+			}
+			return true
+		})
+	})
+
+	return result
+}
+
+func (m *Store) IDtoUUID(objectType content.ObjectType, id string) string {
+	var result string
+	m.view(func(tx *bbolt.Tx) {
+		result = string(tx.Bucket(idsBucket).Get([]byte(fmt.Sprintf("%s:%s", objectType, id))))
+	})
+	return result
+}
+
+func (m *Store) byID(objectType content.ObjectType, id string) interface{} {
+	var result interface{}
+	m.view(func(tx *bbolt.Tx) {
+		uuid := tx.Bucket(idsBucket).Get([]byte(fmt.Sprintf("%s:%s", objectType, id)))
+		if uuid != nil {
+			_, result = m.get(tx, string(uuid))
+		}
+	})
+	return result
+}
+
+func (m *Store) ServiceByID(id string) *client.ServiceInfo {
+	result, _ := m.byID(content.ServiceType, id).(*client.ServiceInfo)
+	return result
+}
+
+func (m *Store) StackByID(id string) *client.StackInfo {
+	result, _ := m.byID(content.StackType, id).(*client.StackInfo)
+	return result
+}
+
+func (m *Store) HostByID(id string) *client.HostInfo {
+	result, _ := m.byID(content.HostType, id).(*client.HostInfo)
+	return result
+}
+
+func (m *Store) NetworkByID(id string) *client.NetworkInfo {
+	result, _ := m.byID(content.NetworkType, id).(*client.NetworkInfo)
+	return result
+}
+
+func (m *Store) ContainerByID(id string) *client.InstanceInfo {
+	result, _ := m.byID(content.ContainerType, id).(*client.InstanceInfo)
+	return result
+}
+
+func (m *Store) EnvironmentByUUID(uuid string) *client.EnvironmentInfo {
+	var result *client.EnvironmentInfo
+	m.view(func(tx *bbolt.Tx) {
+		result = m.environment(tx, uuid)
+	})
+	return result
+}
+
+func (m *Store) Object(uuid string, c content.Client) content.Object {
+	var result content.Object
+	m.view(func(tx *bbolt.Tx) {
+		if objectType, obj := m.get(tx, uuid); obj != nil {
+			result = m.newObject(objectType, obj, c)
+		}
+	})
+	return result
+}
+
+func (m *Store) All(objectType content.ObjectType) []interface{} {
+	var result []interface{}
+	m.view(func(tx *bbolt.Tx) {
+		scan(tx, typesBucket, key(string(objectType), ""), func(uuid string) bool {
+			if _, obj := m.get(tx, uuid); obj != nil {
+				result = append(result, obj)
+			}
+			return true
+		})
+	})
+	return result
+}
+
+func (m *Store) SelfContainer(c content.Client) *client.InstanceInfo {
+	var result *client.InstanceInfo
+	m.view(func(tx *bbolt.Tx) {
+		result = m.instanceByIP(tx, c.IP)
+	})
+	return result
+}
+
+func (m *Store) SelfHost(c content.Client) content.Object {
+	if selfHostID == "" {
+		selfContainerID := content.SelfContainerID()
+		if selfContainerID == "" {
+			return nil
+		}
+
+		for _, obj := range m.All(content.ContainerType) {
+			if instance := obj.(*client.InstanceInfo); instance.ExternalId == selfContainerID {
+				selfHostID = instance.HostId
+				break
+			}
+		}
+
+		if selfHostID == "" {
+			return nil
+		}
+	}
+
+	return m.Object(m.IDtoUUID(content.HostType, selfHostID), c)
+}
+
+func (m *Store) Subscribe(c content.Client, f content.ChangeListener) func() {
+	return m.log.Subscribe(m.clientEnvironment(c), f)
+}
+
+func (m *Store) Changes(c content.Client, since int) ([]content.Change, string, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	changes, ok := m.log.Since(m.clientEnvironment(c), since, int(m.version))
+	return changes, strconv.FormatInt(m.version, 10), ok
+}
+
+func (m *Store) View(f func()) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	f()
+}
+
+func (m *Store) Version() string {
+	return strconv.FormatInt(atomic.LoadInt64(&m.version), 10)
+}
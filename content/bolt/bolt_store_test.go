@@ -0,0 +1,191 @@
+package bolt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/rancher/go-rancher/v3"
+	"github.com/rancher/metadata/content"
+	"github.com/rancher/metadata/content/contenttest"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var stores []*Store
+	defer func() {
+		for _, store := range stores {
+			store.Close()
+		}
+	}()
+
+	contenttest.RunStoreTests(t, func() content.Store {
+		store, err := NewBoltStore(filepath.Join(dir, strconv.Itoa(len(stores)), "metadata.db"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores = append(stores, store)
+		return store
+	})
+}
+
+func TestReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "metadata.db")
+
+	store, err := NewBoltStore(file, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Reload(map[string]interface{}{
+		"env": map[string]interface{}{
+			"infoType":   "environment",
+			"infoTypeId": "1",
+			"uuid":       "env",
+			"name":       "Default",
+		},
+		"stack": map[string]interface{}{
+			"infoType":        "stack",
+			"infoTypeId":      "2",
+			"uuid":            "stack",
+			"name":            "App",
+			"environmentUuid": "env",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Apply(map[string]interface{}{
+		"service": map[string]interface{}{
+			"infoType":        "service",
+			"infoTypeId":      "3",
+			"uuid":            "service",
+			"name":            "web",
+			"stackId":         "2",
+			"environmentUuid": "env",
+		},
+	}, map[string]interface{}{
+		"stack-gone": map[string]interface{}{
+			"infoType":   "stack",
+			"infoTypeId": "4",
+			"uuid":       "stack-gone",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(&client.MetadataSyncRequest{Generation: "g1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	version := store.Version()
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = NewBoltStore(file, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	generation, vals, err := store.Restore()
+	if err != nil || generation != "g1" || vals != nil {
+		t.Errorf("Expected generation g1 without objects, got %q %v %v", generation, vals, err)
+	}
+	if store.Version() != version {
+		t.Errorf("Expected version %s, got %s", version, store.Version())
+	}
+	if service := store.ServiceByName("env", "app", "WEB"); service == nil || service.Uuid != "service" {
+		t.Errorf("Expected service web in stack app, got %v", service)
+	}
+	if uuid := store.IDtoUUID(content.StackType, "2"); uuid != "stack" {
+		t.Errorf("Expected stack:2 to be stack, got %q", uuid)
+	}
+
+	if err := store.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if generation, _, _ := store.Restore(); generation != "" {
+		t.Errorf("Expected no generation after Clear, got %q", generation)
+	}
+}
+
+func TestWriteFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewBoltStore(filepath.Join(dir, "metadata.db"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stack := map[string]interface{}{
+		"infoType":   "stack",
+		"infoTypeId": "2",
+		"uuid":       "stack",
+		"name":       "app",
+	}
+	if err := store.Add(stack); err != nil {
+		t.Fatal(err)
+	}
+	version := store.Version()
+
+	// Writes to a closed database fail like those to a full disk
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add(stack); err == nil {
+		t.Errorf("Add: expected an error")
+	}
+	if err := store.Remove(stack); err == nil {
+		t.Errorf("Remove: expected an error")
+	}
+	if err := store.Apply(map[string]interface{}{"stack": stack}, nil); err == nil {
+		t.Errorf("Apply: expected an error")
+	}
+	if err := store.Reload(map[string]interface{}{}); err == nil {
+		t.Errorf("Reload: expected an error")
+	}
+	if store.Version() != version {
+		t.Errorf("Expected version %s after the failed writes, got %s", version, store.Version())
+	}
+}
+
+func BenchmarkStore(b *testing.B) {
+	dir, err := ioutil.TempDir("", "bolt-store")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var stores []*Store
+	defer func() {
+		for _, store := range stores {
+			store.Close()
+		}
+	}()
+
+	contenttest.RunStoreBenchmarks(b, func() content.Store {
+		store, err := NewBoltStore(filepath.Join(dir, strconv.Itoa(len(stores)), "metadata.db"), 0600)
+		if err != nil {
+			b.Fatal(err)
+		}
+		stores = append(stores, store)
+		return store
+	})
+}
@@ -0,0 +1,47 @@
+package bolt
+
+import (
+	"github.com/rancher/go-rancher/v3"
+	"go.etcd.io/bbolt"
+)
+
+// The store persists its own content, so it is also the persistence of the
+// subscriber and only has to keep the generation next to the content
+
+// Save records the generation of a sync that has been applied
+func (m *Store) Save(request *client.MetadataSyncRequest) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if request.Generation == m.generation {
+		return nil
+	}
+	return m.setGeneration(request.Generation)
+}
+
+// Restore returns the persisted generation, the content is already in the
+// store so no objects are returned
+func (m *Store) Restore() (string, map[string]interface{}, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.generation, nil, nil
+}
+
+func (m *Store) Clear() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.setGeneration("")
+}
+
+func (m *Store) setGeneration(generation string) error {
+	err := m.db.Update(func(tx *bbolt.Tx) error {
+		if generation == "" {
+			return tx.Bucket(metaBucket).Delete(generationKey)
+		}
+		return tx.Bucket(metaBucket).Put(generationKey, []byte(generation))
+	})
+	if err == nil {
+		m.generation = generation
+	}
+	return err
+}
@@ -0,0 +1,338 @@
+package bolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher/v3"
+	"github.com/rancher/metadata/content"
+	"go.etcd.io/bbolt"
+)
+
+// batch is a write transaction, its changes are recorded and its objects
+// cached once it is committed
+type batch struct {
+	tx      *bbolt.Tx
+	version int64
+	changes []change
+	cached  map[string]*entry
+}
+
+type change struct {
+	revision        int64
+	action          content.ChangeAction
+	objectType      content.ObjectType
+	uuid            string
+	environmentUUID string
+}
+
+type index struct {
+	bucket []byte
+	key    string
+	value  string
+}
+
+// update runs f in a write transaction and commits it.  If either fails
+// nothing is changed.
+func (m *Store) update(f func(b *batch) error) error {
+	m.lock.Lock()
+
+	b := &batch{
+		version: m.version,
+		cached:  map[string]*entry{},
+	}
+
+	err := m.db.Update(func(tx *bbolt.Tx) error {
+		b.tx = tx
+		if err := f(b); err != nil {
+			return err
+		}
+
+		version := make([]byte, 8)
+		binary.BigEndian.PutUint64(version, uint64(b.version))
+		return tx.Bucket(metaBucket).Put(versionKey, version)
+	})
+	if err != nil {
+		m.lock.Unlock()
+		return err
+	}
+
+	for uuid, cached := range b.cached {
+		if cached == nil {
+			m.cache.Delete(uuid)
+		} else {
+			m.cache.Store(uuid, cached)
+		}
+	}
+
+	changes := make([]content.Change, 0, len(b.changes))
+	for _, c := range b.changes {
+		changes = append(changes, m.log.Record(int(c.revision), c.action, c.objectType, c.uuid, c.environmentUUID))
+	}
+
+	atomic.StoreInt64(&m.version, b.version)
+	m.lock.Unlock()
+
+	m.log.Notify(changes...)
+	return nil
+}
+
+func (m *Store) Add(val map[string]interface{}) error {
+	return m.update(func(b *batch) error {
+		return b.add(val)
+	})
+}
+
+func (m *Store) Remove(val map[string]interface{}) error {
+	return m.update(func(b *batch) error {
+		return b.remove(val)
+	})
+}
+
+// Apply implements content.Batch, the sync is applied in a single transaction
+func (m *Store) Apply(updates, removes map[string]interface{}) error {
+	return m.update(func(b *batch) error {
+		for _, obj := range updates {
+			if val, ok := obj.(map[string]interface{}); ok {
+				if err := b.add(val); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, obj := range removes {
+			if val, ok := obj.(map[string]interface{}); ok {
+				if err := b.remove(val); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// Reload replaces the content in a single transaction, only the objects that
+// changed are written
+func (m *Store) Reload(vals map[string]interface{}) error {
+	return m.update(func(b *batch) error {
+		keep := map[string]bool{}
+		for _, rawVal := range vals {
+			if val, ok := rawVal.(map[string]interface{}); ok {
+				uuid, _ := val["uuid"].(string)
+				keep[uuid] = true
+				if err := b.add(val); err != nil {
+					return err
+				}
+			}
+		}
+
+		var removes []string
+		c := b.tx.Bucket(objectsBucket).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if !keep[string(k)] {
+				removes = append(removes, string(k))
+			}
+		}
+
+		for _, uuid := range removes {
+			if err := b.delete(uuid); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// add stores an object as synced, unless it is already stored as is
+func (b *batch) add(val map[string]interface{}) error {
+	infoType, _ := val["infoType"].(string)
+	id, _ := val["infoTypeId"].(string)
+	uuid, _ := val["uuid"].(string)
+
+	logrus.Infof("Adding %s %s:%s", uuid, infoType, id)
+
+	objects := b.tx.Bucket(objectsBucket)
+	objectType, obj, err := content.DecodeUpdate(val, func(uuid string) bool {
+		return objects.Get([]byte(uuid)) != nil
+	})
+	if obj == nil {
+		return err
+	}
+	content.Intern(obj)
+
+	data, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+
+	action := content.ChangeAdd
+	if old := objects.Get([]byte(uuid)); old != nil {
+		if len(old) >= 8 && bytes.Equal(old[8:], data) {
+			return nil
+		}
+		oldType, oldObj := decode(old)
+		if err := b.deleteIndexes(oldType, uuid, oldObj); err != nil {
+			return err
+		}
+		action = content.ChangeUpdate
+	}
+
+	b.version++
+	value := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint64(value, uint64(b.version))
+	if err := objects.Put([]byte(uuid), append(value, data...)); err != nil {
+		return err
+	}
+
+	for _, index := range indexes(objectType, uuid, obj) {
+		if err := b.tx.Bucket(index.bucket).Put([]byte(index.key), []byte(index.value)); err != nil {
+			return err
+		}
+	}
+
+	b.cached[uuid] = &entry{
+		revision:   uint64(b.version),
+		objectType: objectType,
+		obj:        obj,
+	}
+	b.changes = append(b.changes, change{
+		revision:        b.version,
+		action:          action,
+		objectType:      objectType,
+		uuid:            uuid,
+		environmentUUID: content.EnvironmentUUID(obj),
+	})
+	return nil
+}
+
+func (b *batch) remove(val map[string]interface{}) error {
+	// Removes carry the object as synced, not as decoded by Add
+	id, _ := val["infoTypeId"].(string)
+	if id == "" && val["id"] != nil {
+		id = fmt.Sprint(val["id"])
+	}
+	uuid, _ := val["uuid"].(string)
+	infoType, _ := val["infoType"].(string)
+
+	logrus.Infof("Removing %s %s:%s", uuid, infoType, id)
+	if uuid == "" || id == "" || infoType == "" {
+		return nil
+	}
+
+	return b.delete(uuid)
+}
+
+// delete removes the object with the uuid and its indexes
+func (b *batch) delete(uuid string) error {
+	objects := b.tx.Bucket(objectsBucket)
+	old := objects.Get([]byte(uuid))
+	if old == nil {
+		return nil
+	}
+
+	objectType, obj := decode(old)
+	if err := b.deleteIndexes(objectType, uuid, obj); err != nil {
+		return err
+	}
+	if err := objects.Delete([]byte(uuid)); err != nil {
+		return err
+	}
+
+	b.version++
+	b.cached[uuid] = nil
+	if obj != nil {
+		b.changes = append(b.changes, change{
+			revision:        b.version,
+			action:          content.ChangeRemove,
+			objectType:      objectType,
+			uuid:            uuid,
+			environmentUUID: content.EnvironmentUUID(obj),
+		})
+	}
+	return nil
+}
+
+func (b *batch) deleteIndexes(objectType content.ObjectType, uuid string, obj interface{}) error {
+	for _, index := range indexes(objectType, uuid, obj) {
+		bucket := b.tx.Bucket(index.bucket)
+		// An object with the same type and id may have replaced this one
+		if index.value != "" && string(bucket.Get([]byte(index.key))) != index.value {
+			continue
+		}
+		if err := bucket.Delete([]byte(index.key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decode decodes an object as stored
+func decode(value []byte) (content.ObjectType, interface{}) {
+	if len(value) < 8 {
+		return "", nil
+	}
+
+	val := map[string]interface{}{}
+	if err := json.Unmarshal(value[8:], &val); err != nil {
+		return "", nil
+	}
+
+	objectType, obj, _ := content.Decode(val)
+	content.Intern(obj)
+	return objectType, obj
+}
+
+// indexes returns the index entries of an object
+func indexes(objectType content.ObjectType, uuid string, obj interface{}) []index {
+	if obj == nil {
+		return nil
+	}
+
+	id, _ := getString(obj, "InfoTypeId")
+	result := []index{
+		{idsBucket, fmt.Sprintf("%s:%s", objectType, id), uuid},
+		{typesBucket, key(string(objectType), uuid), ""},
+	}
+
+	if environmentUUID, ok := getString(obj, "EnvironmentUuid"); ok {
+		result = append(result, index{environmentsBucket, key(environmentUUID, string(objectType), uuid), ""})
+	}
+
+	if stackID, ok := getString(obj, "StackId"); ok {
+		result = append(result, index{stacksBucket, key(stackID, string(objectType), uuid), ""})
+	}
+
+	switch obj := obj.(type) {
+	case *client.StackInfo:
+		result = append(result, index{namesBucket, key(obj.EnvironmentUuid, string(objectType), "", strings.ToLower(obj.Name), uuid), ""})
+	case *client.ServiceInfo:
+		result = append(result, index{namesBucket, key(obj.EnvironmentUuid, string(objectType), obj.StackId, strings.ToLower(obj.Name), uuid), ""})
+	case *client.InstanceInfo:
+		result = append(result, index{namesBucket, key(obj.EnvironmentUuid, string(objectType), obj.StackId, strings.ToLower(obj.Name), uuid), ""})
+		if obj.PrimaryIp != "" {
+			result = append(result, index{ipsBucket, key(obj.PrimaryIp, uuid), ""})
+		}
+	case *client.EnvironmentInfo:
+		if obj.System {
+			result = append(result, index{systemBucket, uuid, ""})
+		}
+	}
+
+	return result
+}
+
+func getString(obj interface{}, key string) (string, bool) {
+	val, ok := content.GetValue(obj, key)
+	if !ok {
+		return "", false
+	}
+	str, ok := val.(string)
+	return str, ok
+}
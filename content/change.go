@@ -0,0 +1,23 @@
+package content
+
+type ChangeAction string
+
+const (
+	ChangeAdd    = ChangeAction("add")
+	ChangeUpdate = ChangeAction("update")
+	ChangeRemove = ChangeAction("remove")
+)
+
+type Change struct {
+	Revision         int          `json:"revision"`
+	PreviousRevision int          `json:"previous_revision"`
+	Action           ChangeAction `json:"action"`
+	Type             ObjectType   `json:"type"`
+	UUID             string       `json:"uuid"`
+	EnvironmentUUID  string       `json:"environment_uuid"`
+}
+
+// ChangeListener is called after a change has been applied to the store.
+// Listeners are called synchronously from the goroutine that applied the
+// change and must not block.
+type ChangeListener func(change Change)
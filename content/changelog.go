@@ -0,0 +1,130 @@
+package content
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/rancher/go-rancher/v3"
+)
+
+const changeLogSize = 4096
+
+// ChangeLog keeps the recent changes of a store and notifies its listeners.
+// Record and Since are serialized by the store's own lock, listeners have
+// their own.
+type ChangeLog struct {
+	changes   []Change
+	floor     int
+	revisions map[string]int
+
+	listenersLock sync.Mutex
+	listeners     map[int]listener
+	nextListener  int
+}
+
+type listener struct {
+	env *client.EnvironmentInfo
+	f   ChangeListener
+}
+
+// NewChangeLog returns an empty log of a store currently at version
+func NewChangeLog(version int) *ChangeLog {
+	return &ChangeLog{
+		floor:     version,
+		revisions: map[string]int{},
+		listeners: map[int]listener{},
+	}
+}
+
+// Record appends a change made at revision to an object of the environment
+func (l *ChangeLog) Record(revision int, action ChangeAction, objectType ObjectType, uuid, environmentUUID string) Change {
+	change := Change{
+		Revision:         revision,
+		PreviousRevision: l.revisions[uuid],
+		Action:           action,
+		Type:             objectType,
+		UUID:             uuid,
+		EnvironmentUUID:  environmentUUID,
+	}
+
+	if action == ChangeRemove {
+		delete(l.revisions, uuid)
+	} else {
+		l.revisions[uuid] = revision
+	}
+
+	l.changes = append(l.changes, change)
+	if len(l.changes) > changeLogSize {
+		l.changes = l.changes[len(l.changes)-changeLogSize:]
+		l.floor = l.changes[0].Revision - 1
+	}
+
+	return change
+}
+
+// Since implements Store.Changes for a store at version, env is the
+// environment of the client or nil if it is not known yet, in which case every
+// change is returned as Subscribe delivers them
+func (l *ChangeLog) Since(env *client.EnvironmentInfo, since, version int) ([]Change, bool) {
+	if since < l.floor || since > version {
+		return nil, false
+	}
+
+	result := []Change{}
+	start := sort.Search(len(l.changes), func(i int) bool {
+		return l.changes[i].Revision > since
+	})
+
+	for _, change := range l.changes[start:] {
+		if env == nil || visible(env, change) {
+			result = append(result, change)
+		}
+	}
+
+	return result, true
+}
+
+// Subscribe implements Store.Subscribe for a client of the environment env
+func (l *ChangeLog) Subscribe(env *client.EnvironmentInfo, f ChangeListener) func() {
+	l.listenersLock.Lock()
+	id := l.nextListener
+	l.nextListener++
+	l.listeners[id] = listener{
+		env: env,
+		f:   f,
+	}
+	l.listenersLock.Unlock()
+
+	return func() {
+		l.listenersLock.Lock()
+		delete(l.listeners, id)
+		l.listenersLock.Unlock()
+	}
+}
+
+// Notify calls the listeners the changes are visible to, it must be called
+// after the store's lock has been released
+func (l *ChangeLog) Notify(changes ...Change) {
+	if len(changes) == 0 {
+		return
+	}
+
+	l.listenersLock.Lock()
+	listeners := make([]listener, 0, len(l.listeners))
+	for _, listener := range l.listeners {
+		listeners = append(listeners, listener)
+	}
+	l.listenersLock.Unlock()
+
+	for _, change := range changes {
+		for _, listener := range listeners {
+			if listener.env == nil || visible(listener.env, change) {
+				listener.f(change)
+			}
+		}
+	}
+}
+
+func visible(env *client.EnvironmentInfo, change Change) bool {
+	return env.System || change.EnvironmentUUID == env.Uuid
+}
@@ -0,0 +1,158 @@
+package contenttest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/metadata/content"
+)
+
+// footprintContainers are the sizes of the environments the footprint is
+// measured with
+var footprintContainers = []int{10000, 50000}
+
+// RunStoreBenchmarks measures the allocations of a content.Store on Add and
+// when serving, and the heap it retains per container
+func RunStoreBenchmarks(b *testing.B, factory Factory) {
+	if !testing.Verbose() {
+		logrus.SetOutput(ioutil.Discard)
+	}
+
+	b.Run("Add", func(b *testing.B) {
+		benchmarkAdd(b, factory)
+	})
+	for _, n := range footprintContainers {
+		n := n
+		b.Run(fmt.Sprintf("Footprint%d", n), func(b *testing.B) {
+			benchmarkFootprint(b, factory, n)
+		})
+	}
+	b.Run("ByEnvironment", func(b *testing.B) {
+		benchmarkByEnvironment(b, factory)
+	})
+}
+
+// containers returns n containers of environment env-a as they are synced,
+// decoded from JSON so that no two share their strings.  They are spread over
+// 20 stacks of 5 services and 100 hosts, with the labels Rancher sets.
+func containers(n int) []map[string]interface{} {
+	result := make([]map[string]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		stack := i % 20
+		service := i % 100
+		data := fmt.Sprintf(`{
+			"infoType": "instance",
+			"infoTypeId": "%[1]d",
+			"uuid": "container-%[1]d",
+			"name": "stack-%[2]d-service-%[3]d-%[1]d",
+			"environmentUuid": "env-a",
+			"stackId": "%[2]d",
+			"serviceId": "%[3]d",
+			"serviceIds": ["%[3]d"],
+			"hostId": "%[4]d",
+			"primaryIp": "10.42.%[5]d.%[6]d",
+			"state": "running",
+			"healthState": "healthy",
+			"dns": ["169.254.169.250"],
+			"dnsSearch": ["stack-%[2]d.rancher.internal", "rancher.internal"],
+			"labels": {
+				"io.rancher.container.uuid": "container-%[1]d",
+				"io.rancher.container.ip": "10.42.%[5]d.%[6]d/16",
+				"io.rancher.container.pull_image": "always",
+				"io.rancher.project.name": "stack-%[2]d",
+				"io.rancher.project_service.name": "stack-%[2]d/service-%[3]d",
+				"io.rancher.stack.name": "stack-%[2]d",
+				"io.rancher.stack_service.name": "stack-%[2]d/service-%[3]d",
+				"io.rancher.service.launch.config": "io.rancher.service.primary.launch.config",
+				"io.rancher.scheduler.affinity:host_label": "role=worker"
+			}
+		}`, i+1000, stack, service, i%100, i/250, i%250+1)
+
+		obj := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(data), &obj); err != nil {
+			panic(err)
+		}
+		result = append(result, obj)
+	}
+	return result
+}
+
+func benchmarkAdd(b *testing.B, factory Factory) {
+	store := factory()
+	if err := store.Add(environment("env-a", "1", "A", false)); err != nil {
+		b.Fatal(err)
+	}
+	objects := containers(b.N)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for _, obj := range objects {
+		if err := store.Add(obj); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkFootprint logs the heap the store retains, the difference of the
+// heap in use after a GC before and after the store is filled
+func benchmarkFootprint(b *testing.B, factory Factory, n int) {
+	var stats runtime.MemStats
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		runtime.GC()
+		runtime.ReadMemStats(&stats)
+		before := int64(stats.HeapAlloc)
+		objects := containers(n)
+		b.StartTimer()
+
+		store := factory()
+		if err := store.Add(environment("env-a", "1", "A", false)); err != nil {
+			b.Fatal(err)
+		}
+		for _, obj := range objects {
+			if err := store.Add(obj); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		b.StopTimer()
+		// Only what the store kept of the synced objects remains
+		objects = nil
+		runtime.GC()
+		runtime.ReadMemStats(&stats)
+		if i == b.N-1 {
+			retained := int64(stats.HeapAlloc) - before
+			b.Logf("Retained heap after GC: %d bytes for %d containers, %d bytes per container",
+				retained, n, retained/int64(n))
+		}
+		runtime.KeepAlive(store)
+		b.StartTimer()
+	}
+}
+
+func benchmarkByEnvironment(b *testing.B, factory Factory) {
+	store := factory()
+	if err := store.Add(environment("env-a", "1", "A", false)); err != nil {
+		b.Fatal(err)
+	}
+	for _, obj := range containers(1000) {
+		if err := store.Add(obj); err != nil {
+			b.Fatal(err)
+		}
+	}
+	c := content.Client{IP: "10.42.0.1"}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, obj := range store.ByEnvironment(content.ContainerType, c, "env-a") {
+			if _, err := obj.Map(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,664 @@
+// Package contenttest provides a conformance suite for implementations of
+// content.Store.
+package contenttest
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/metadata/content"
+	// Registers the object factories the stores wrap their objects with
+	_ "github.com/rancher/metadata/types/convert"
+)
+
+// Factory returns a new empty store
+type Factory func() content.Store
+
+// RunStoreTests runs the behavior every content.Store is expected to have
+// against stores returned by factory, each test gets a new store
+func RunStoreTests(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		f    func(*testing.T, content.Store)
+	}{
+		{"AddAndLookup", testAddAndLookup},
+		{"Update", testUpdate},
+		{"Remove", testRemove},
+		{"Reload", testReload},
+		{"Undecodable", testUndecodable},
+		{"IDtoUUID", testIDtoUUID},
+		{"ByName", testByName},
+		{"EnvironmentIsolation", testEnvironmentIsolation},
+		{"SystemEnvironment", testSystemEnvironment},
+		{"Order", testOrder},
+		{"Self", testSelf},
+		{"Object", testObject},
+		{"Version", testVersion},
+		{"Changes", testChanges},
+		{"ChangesUnknownClient", testChangesUnknownClient},
+		{"Subscribe", testSubscribe},
+		{"SubscribeUnknownClient", testSubscribeUnknownClient},
+		{"View", testView},
+	}
+
+	for _, test := range tests {
+		f := test.f
+		t.Run(test.name, func(t *testing.T) {
+			f(t, factory())
+		})
+	}
+}
+
+const (
+	clientA = "10.42.0.1"
+	clientB = "10.42.0.2"
+	unknown = "10.42.0.99"
+)
+
+func environment(uuid, id, name string, system bool) map[string]interface{} {
+	return map[string]interface{}{
+		"infoType":   "environment",
+		"infoTypeId": id,
+		"uuid":       uuid,
+		"name":       name,
+		"system":     system,
+	}
+}
+
+func object(infoType, uuid, id, name, environmentUUID string, fields ...interface{}) map[string]interface{} {
+	obj := map[string]interface{}{
+		"infoType":        infoType,
+		"infoTypeId":      id,
+		"uuid":            uuid,
+		"name":            name,
+		"environmentUuid": environmentUUID,
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		obj[fields[i].(string)] = fields[i+1]
+	}
+	return obj
+}
+
+// fixture is two environments with the same stack, service and container
+// names, so lookups that ignore the environment get caught, and a system
+// environment
+func fixture() []map[string]interface{} {
+	return []map[string]interface{}{
+		environment("env-a", "1", "a", false),
+		environment("env-b", "2", "b", false),
+		environment("env-system", "3", "system", true),
+		object("host", "host-a", "10", "host-a", "env-a", "agentIp", "192.168.0.1"),
+		object("network", "network-a", "20", "managed", "env-a"),
+		object("stack", "stack-a", "30", "web", "env-a"),
+		object("stack", "stack-b", "31", "web", "env-b"),
+		object("service", "service-a", "40", "nginx", "env-a", "stackId", "30"),
+		object("service", "service-b", "41", "nginx", "env-b", "stackId", "31"),
+		object("instance", "container-a", "50", "nginx-1", "env-a",
+			"stackId", "30", "serviceId", "40", "hostId", "10", "primaryIp", clientA),
+		object("instance", "container-b", "51", "nginx-1", "env-b",
+			"stackId", "31", "serviceId", "41", "primaryIp", clientB),
+	}
+}
+
+func add(t *testing.T, store content.Store, objects ...map[string]interface{}) {
+	for _, obj := range objects {
+		if err := store.Add(obj); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+}
+
+func remove(t *testing.T, store content.Store, obj map[string]interface{}) {
+	if err := store.Remove(obj); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+}
+
+func reload(t *testing.T, store content.Store, objects ...map[string]interface{}) {
+	vals := map[string]interface{}{}
+	for _, obj := range objects {
+		vals[obj["uuid"].(string)] = obj
+	}
+	if err := store.Reload(vals); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+}
+
+func names(objects []content.Object) string {
+	var result []string
+	for _, obj := range objects {
+		result = append(result, obj.Name())
+	}
+	sort.Strings(result)
+	return strings.Join(result, ",")
+}
+
+func uuids(objects []interface{}) string {
+	var result []string
+	for _, obj := range objects {
+		uuid, _ := content.GetValue(obj, "Uuid")
+		result = append(result, uuid.(string))
+	}
+	sort.Strings(result)
+	return strings.Join(result, ",")
+}
+
+func expect(t *testing.T, what, expected, actual string) {
+	if expected != actual {
+		t.Errorf("%s: expected %q, got %q", what, expected, actual)
+	}
+}
+
+func testAddAndLookup(t *testing.T, store content.Store) {
+	add(t, store, fixture()...)
+
+	if service := store.ServiceByID("40"); service == nil || service.Uuid != "service-a" {
+		t.Errorf("ServiceByID: expected service-a, got %v", service)
+	}
+	if stack := store.StackByID("31"); stack == nil || stack.Uuid != "stack-b" {
+		t.Errorf("StackByID: expected stack-b, got %v", stack)
+	}
+	if network := store.NetworkByID("20"); network == nil || network.Uuid != "network-a" {
+		t.Errorf("NetworkByID: expected network-a, got %v", network)
+	}
+	if host := store.HostByID("10"); host == nil || host.Uuid != "host-a" {
+		t.Errorf("HostByID: expected host-a, got %v", host)
+	}
+	if container := store.ContainerByID("51"); container == nil || container.Uuid != "container-b" {
+		t.Errorf("ContainerByID: expected container-b, got %v", container)
+	}
+	if env := store.EnvironmentByUUID("env-b"); env == nil || env.Name != "b" {
+		t.Errorf("EnvironmentByUUID: expected b, got %v", env)
+	}
+
+	if service := store.ServiceByID("41000"); service != nil {
+		t.Errorf("ServiceByID: expected nothing for an unknown ID, got %v", service)
+	}
+	if stack := store.StackByID("40"); stack != nil {
+		t.Errorf("StackByID: expected nothing for the ID of a service, got %v", stack)
+	}
+
+	expect(t, "All stacks", "stack-a,stack-b", uuids(store.All(content.StackType)))
+	expect(t, "All environments", "env-a,env-b,env-system", uuids(store.All(content.EnvironmentType)))
+	expect(t, "All containers", "container-a,container-b", uuids(store.All(content.ContainerType)))
+	expect(t, "All of an unknown type", "", uuids(store.All("foo")))
+}
+
+func testUpdate(t *testing.T, store content.Store) {
+	add(t, store, fixture()...)
+	add(t, store, object("stack", "stack-a", "30", "api", "env-a"))
+
+	if stack := store.StackByID("30"); stack == nil || stack.Name != "api" {
+		t.Errorf("StackByID: expected the updated stack, got %v", stack)
+	}
+	expect(t, "All stacks", "stack-a,stack-b", uuids(store.All(content.StackType)))
+	expect(t, "Stacks of a", "api", names(store.ByEnvironment(content.StackType, content.Client{IP: clientA}, "env-a")))
+}
+
+func testRemove(t *testing.T, store content.Store) {
+	add(t, store, fixture()...)
+	remove(t, store, object("service", "service-a", "40", "nginx", "env-a", "stackId", "30"))
+
+	if service := store.ServiceByID("40"); service != nil {
+		t.Errorf("ServiceByID: expected nothing after removing, got %v", service)
+	}
+	if uuid := store.IDtoUUID(content.ServiceType, "40"); uuid != "" {
+		t.Errorf("IDtoUUID: expected nothing after removing, got %s", uuid)
+	}
+	if obj := store.Object("service-a", content.Client{IP: clientA}); obj != nil {
+		t.Errorf("Object: expected nothing after removing, got %v", obj.Name())
+	}
+	expect(t, "All services", "service-b", uuids(store.All(content.ServiceType)))
+
+	// Removing what is not there is not an error
+	remove(t, store, object("service", "service-a", "40", "nginx", "env-a"))
+	remove(t, store, object("volume", "volume-a", "60", "data", "env-a"))
+	remove(t, store, map[string]interface{}{})
+	expect(t, "All services", "service-b", uuids(store.All(content.ServiceType)))
+}
+
+func testReload(t *testing.T, store content.Store) {
+	add(t, store, fixture()...)
+	reload(t, store,
+		environment("env-a", "1", "a", false),
+		object("stack", "stack-c", "32", "db", "env-a"),
+		object("instance", "container-a", "50", "db-1", "env-a", "stackId", "32", "primaryIp", clientA))
+
+	expect(t, "All stacks", "stack-c", uuids(store.All(content.StackType)))
+	expect(t, "All environments", "env-a", uuids(store.All(content.EnvironmentType)))
+	expect(t, "All services", "", uuids(store.All(content.ServiceType)))
+
+	if stack := store.StackByID("30"); stack != nil {
+		t.Errorf("StackByID: expected nothing after a reload without it, got %v", stack)
+	}
+	if uuid := store.IDtoUUID(content.StackType, "30"); uuid != "" {
+		t.Errorf("IDtoUUID: expected nothing after a reload without it, got %s", uuid)
+	}
+	if container := store.ContainerByID("50"); container == nil || container.Name != "db-1" {
+		t.Errorf("ContainerByID: expected the reloaded container, got %v", container)
+	}
+	if container := store.ContainerByName("env-a", "db", "db-1"); container == nil || container.Uuid != "container-a" {
+		t.Errorf("ContainerByName: expected the reloaded container, got %v", container)
+	}
+
+	reload(t, store)
+	expect(t, "All environments", "", uuids(store.All(content.EnvironmentType)))
+}
+
+func testUndecodable(t *testing.T, store content.Store) {
+	add(t, store, fixture()...)
+	version := store.Version()
+
+	// Objects that are not stored are ignored
+	add(t, store, object("volume", "volume-a", "60", "data", "env-a"))
+	add(t, store, object("stack", "stack-c", "", "db", "env-a"))
+	expect(t, "All stacks", "stack-a,stack-b", uuids(store.All(content.StackType)))
+
+	// Replacing a stored object by one that can't be decoded fails rather
+	// than serving the stored one
+	if err := store.Add(object("stack", "stack-a", "", "api", "env-a")); err == nil {
+		t.Errorf("Add: expected an error replacing a stack by one without an id")
+	}
+
+	vals := map[string]interface{}{}
+	for _, obj := range fixture() {
+		vals[obj["uuid"].(string)] = obj
+	}
+	vals["stack-a"] = object("stack", "stack-a", "0", "api", "env-a")
+	vals["stack-c"] = object("stack", "stack-c", "32", "db", "env-a")
+	if err := store.Reload(vals); err == nil {
+		t.Errorf("Reload: expected an error replacing a stack by one without an id")
+	}
+
+	expect(t, "All stacks", "stack-a,stack-b", uuids(store.All(content.StackType)))
+	if stack := store.StackByID("30"); stack == nil || stack.Name != "web" {
+		t.Errorf("StackByID: expected the stored stack, got %v", stack)
+	}
+	if store.Version() != version {
+		t.Errorf("Version: expected %s after the failed writes, got %s", version, store.Version())
+	}
+}
+
+func testIDtoUUID(t *testing.T, store content.Store) {
+	add(t, store, fixture()...)
+
+	for _, test := range []struct {
+		objectType content.ObjectType
+		id, uuid   string
+	}{
+		{content.EnvironmentType, "2", "env-b"},
+		{content.HostType, "10", "host-a"},
+		{content.NetworkType, "20", "network-a"},
+		{content.StackType, "30", "stack-a"},
+		{content.ServiceType, "41", "service-b"},
+		{content.ContainerType, "50", "container-a"},
+		// IDs are per type
+		{content.StackType, "40", ""},
+		{content.ContainerType, "999", ""},
+	} {
+		expect(t, "IDtoUUID "+string(test.objectType)+" "+test.id, test.uuid, store.IDtoUUID(test.objectType, test.id))
+	}
+}
+
+func testByName(t *testing.T, store content.Store) {
+	add(t, store, fixture()...)
+
+	if service := store.ServiceByName("env-b", "web", "nginx"); service == nil || service.Uuid != "service-b" {
+		t.Errorf("ServiceByName: expected service-b, got %v", service)
+	}
+	if service := store.ServiceByName("env-a", "WEB", "Nginx"); service == nil || service.Uuid != "service-a" {
+		t.Errorf("ServiceByName: expected a case insensitive match, got %v", service)
+	}
+	if service := store.ServiceByName("env-system", "web", "nginx"); service != nil {
+		t.Errorf("ServiceByName: expected nothing in another environment, got %v", service)
+	}
+	if service := store.ServiceByName("env-a", "db", "nginx"); service != nil {
+		t.Errorf("ServiceByName: expected nothing in another stack, got %v", service)
+	}
+
+	if container := store.ContainerByName("env-a", "web", "nginx-1"); container == nil || container.Uuid != "container-a" {
+		t.Errorf("ContainerByName: expected container-a, got %v", container)
+	}
+	if container := store.ContainerByName("env-b", "Web", "NGINX-1"); container == nil || container.Uuid != "container-b" {
+		t.Errorf("ContainerByName: expected a case insensitive match, got %v", container)
+	}
+	if container := store.ContainerByName("env-b", "web", "nginx-2"); container != nil {
+		t.Errorf("ContainerByName: expected nothing for an unknown name, got %v", container)
+	}
+	if container := store.ContainerByName("env-a", "db", "nginx-1"); container != nil {
+		t.Errorf("ContainerByName: expected nothing in another stack, got %v", container)
+	}
+
+	// Objects refer to their stack by its infoTypeId, a container that is in
+	// no stack is not found by any stack name
+	add(t, store, object("instance", "container-standalone", "52", "standalone", "env-a"))
+	if container := store.ContainerByName("env-a", "web", "standalone"); container != nil {
+		t.Errorf("ContainerByName: expected nothing for a container without a stack, got %v", container)
+	}
+}
+
+func testEnvironmentIsolation(t *testing.T, store content.Store) {
+	add(t, store, fixture()...)
+	a := content.Client{IP: clientA}
+	b := content.Client{IP: clientB}
+
+	if env := store.Environment(a); env == nil || env.Name() != "a" {
+		t.Errorf("Environment: expected a for a container of a, got %v", env)
+	}
+	if env := store.Environment(b); env == nil || env.Name() != "b" {
+		t.Errorf("Environment: expected b for a container of b, got %v", env)
+	}
+
+	expect(t, "Stacks of a", "web", names(store.ByEnvironment(content.StackType, a, "env-a")))
+	expect(t, "Containers of b", "nginx-1", names(store.ByEnvironment(content.ContainerType, b, "env-b")))
+	expect(t, "Hosts of b", "", names(store.ByEnvironment(content.HostType, b, "env-b")))
+	expect(t, "Networks of a", "managed", names(store.ByEnvironment(content.NetworkType, a, "env-a")))
+	expect(t, "Stacks of an unknown environment", "", names(store.ByEnvironment(content.StackType, a, "env-c")))
+	expect(t, "Unknown type of a", "", names(store.ByEnvironment("foo", a, "env-a")))
+
+	expect(t, "Services of stack a", "nginx", names(store.ByStack(content.ServiceType, a, "stack-a")))
+	expect(t, "Containers of stack b", "nginx-1", names(store.ByStack(content.ContainerType, b, "stack-b")))
+	expect(t, "Containers of an unknown stack", "", names(store.ByStack(content.ContainerType, b, "stack-c")))
+	expect(t, "Unknown type of stack b", "", names(store.ByStack("foo", b, "stack-b")))
+}
+
+// testOrder checks that lists come out in the order of the UUIDs, so the
+// same content is served the same way every time
+func testOrder(t *testing.T, store content.Store) {
+	add(t, store, fixture()...)
+	for _, i := range []int{7, 2, 9, 0, 5, 3, 8, 1, 6, 4} {
+		add(t, store, object("instance", fmt.Sprintf("container-a-%d", i), fmt.Sprint(60+i), fmt.Sprintf("web-%d", i), "env-a",
+			"stackId", "30"))
+	}
+	a := content.Client{IP: clientA}
+
+	inOrder := func(objects []content.Object) string {
+		var result []string
+		for _, obj := range objects {
+			result = append(result, obj.Name())
+		}
+		return strings.Join(result, ",")
+	}
+
+	expected := "nginx-1,web-0,web-1,web-2,web-3,web-4,web-5,web-6,web-7,web-8,web-9"
+	expect(t, "Containers of a", expected, inOrder(store.ByEnvironment(content.ContainerType, a, "env-a")))
+	expect(t, "Containers of stack a", expected, inOrder(store.ByStack(content.ContainerType, a, "stack-a")))
+}
+
+func testSystemEnvironment(t *testing.T, store content.Store) {
+	add(t, store, fixture()...)
+	c := content.Client{IP: unknown}
+
+	if env := store.Environment(c); env == nil || env.Name() != "system" {
+		t.Errorf("Environment: expected the system environment for an unknown client, got %v", env)
+	}
+
+	// The system environment sees everything
+	expect(t, "Stacks of system", "web,web", names(store.ByEnvironment(content.StackType, c, "env-system")))
+	expect(t, "Containers of system", "nginx-1,nginx-1", names(store.ByEnvironment(content.ContainerType, c, "env-system")))
+	expect(t, "Hosts of system", "host-a", names(store.ByEnvironment(content.HostType, c, "env-system")))
+
+	remove(t, store, environment("env-system", "3", "system", true))
+	if env := store.Environment(c); env != nil {
+		t.Errorf("Environment: expected nothing for an unknown client without a system environment, got %v", env.Name())
+	}
+}
+
+func testSelf(t *testing.T, store content.Store) {
+	add(t, store, fixture()...)
+
+	if container := store.SelfContainer(content.Client{IP: clientB}); container == nil || container.Uuid != "container-b" {
+		t.Errorf("SelfContainer: expected container-b, got %v", container)
+	}
+	if container := store.SelfContainer(content.Client{IP: unknown}); container != nil {
+		t.Errorf("SelfContainer: expected nothing for an unknown client, got %v", container)
+	}
+
+	remove(t, store, object("instance", "container-b", "51", "nginx-1", "env-b", "primaryIp", clientB))
+	if container := store.SelfContainer(content.Client{IP: clientB}); container != nil {
+		t.Errorf("SelfContainer: expected nothing after removing the container, got %v", container)
+	}
+}
+
+func testObject(t *testing.T, store content.Store) {
+	add(t, store, fixture()...)
+	c := content.Client{IP: clientA}
+
+	for _, test := range []struct {
+		uuid, name string
+	}{
+		{"env-a", "a"},
+		{"host-a", "host-a"},
+		{"network-a", "managed"},
+		{"stack-b", "web"},
+		{"service-a", "nginx"},
+		{"container-b", "nginx-1"},
+	} {
+		if obj := store.Object(test.uuid, c); obj == nil || obj.Name() != test.name {
+			t.Errorf("Object %s: expected %s, got %v", test.uuid, test.name, obj)
+		}
+	}
+
+	if obj := store.Object("missing", c); obj != nil {
+		t.Errorf("Object: expected nothing for an unknown UUID, got %v", obj.Name())
+	}
+}
+
+func testVersion(t *testing.T, store content.Store) {
+	versions := map[string]bool{
+		store.Version(): true,
+	}
+	check := func(what string) {
+		version := store.Version()
+		if versions[version] {
+			t.Errorf("Version: expected a new version after %s, got %s again", what, version)
+		}
+		versions[version] = true
+	}
+
+	add(t, store, fixture()...)
+	check("adding")
+	add(t, store, object("stack", "stack-a", "30", "api", "env-a"))
+	check("updating")
+	remove(t, store, object("stack", "stack-a", "30", "api", "env-a"))
+	check("removing")
+	reload(t, store, fixture()...)
+	check("reloading")
+}
+
+func actions(changes []content.Change) string {
+	var result []string
+	for _, change := range changes {
+		result = append(result, string(change.Action)+" "+change.UUID)
+	}
+	return strings.Join(result, ",")
+}
+
+func testChanges(t *testing.T, store content.Store) {
+	add(t, store, fixture()...)
+	a := content.Client{IP: clientA}
+	b := content.Client{IP: clientB}
+	system := content.Client{IP: unknown}
+	since := store.Version()
+
+	add(t, store, object("stack", "stack-a", "30", "api", "env-a"))
+	add(t, store, object("stack", "stack-d", "33", "db", "env-b"))
+	remove(t, store, object("service", "service-a", "40", "nginx", "env-a", "stackId", "30"))
+
+	for _, test := range []struct {
+		client   content.Client
+		expected string
+	}{
+		{a, "update stack-a,remove service-a"},
+		{b, "add stack-d"},
+		{system, "update stack-a,add stack-d,remove service-a"},
+	} {
+		changes, version, ok := store.Changes(test.client, atoi(t, since))
+		if !ok {
+			t.Fatalf("Changes: expected the changes since %s to be known", since)
+		}
+		expect(t, "Changes for "+test.client.IP, test.expected, actions(changes))
+		expect(t, "Version of the changes for "+test.client.IP, store.Version(), version)
+
+		for i := 1; i < len(changes); i++ {
+			if changes[i].Revision <= changes[i-1].Revision {
+				t.Errorf("Changes: expected increasing revisions, got %v", changes)
+			}
+		}
+	}
+
+	changes, _, ok := store.Changes(a, atoi(t, store.Version()))
+	if !ok || len(changes) != 0 {
+		t.Errorf("Changes: expected no changes since the current version, got %v %v", changes, ok)
+	}
+
+	if _, _, ok := store.Changes(a, atoi(t, store.Version())+1); ok {
+		t.Errorf("Changes: expected a version from the future to be unknown")
+	}
+}
+
+func testChangesUnknownClient(t *testing.T, store content.Store) {
+	// Like Subscribe, without a system environment a client that is not a
+	// container gets every change
+	since := store.Version()
+	add(t, store, environment("env-b", "2", "b", false))
+	add(t, store, object("stack", "stack-b", "31", "web", "env-b"))
+
+	changes, _, ok := store.Changes(content.Client{IP: clientA}, atoi(t, since))
+	if !ok {
+		t.Fatalf("Changes: expected the changes since %s to be known", since)
+	}
+	expect(t, "Changes for an unknown client", "add env-b,add stack-b", actions(changes))
+}
+
+func atoi(t *testing.T, version string) int {
+	result, err := strconv.Atoi(version)
+	if err != nil {
+		t.Fatalf("Version %q is not a number: %v", version, err)
+	}
+	return result
+}
+
+// listen subscribes for a client and returns the UUIDs of the changes it
+// receives
+func listen(store content.Store, c content.Client) (<-chan string, func()) {
+	received := make(chan string, 100)
+	cancel := store.Subscribe(c, func(change content.Change) {
+		received <- change.UUID
+	})
+	return received, cancel
+}
+
+// expectReceived checks that exactly the changes of the UUIDs are received
+// in any order
+func expectReceived(t *testing.T, who string, received <-chan string, uuids ...string) {
+	var actual []string
+	for range uuids {
+		select {
+		case uuid := <-received:
+			actual = append(actual, uuid)
+		case <-time.After(time.Second):
+		}
+	}
+	sort.Strings(actual)
+	sort.Strings(uuids)
+	expect(t, who+" received", strings.Join(uuids, ","), strings.Join(actual, ","))
+	expectNothing(t, who, received)
+}
+
+func expectNothing(t *testing.T, who string, received <-chan string) {
+	select {
+	case actual := <-received:
+		t.Errorf("%s: expected no change, got %s", who, actual)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func testSubscribe(t *testing.T, store content.Store) {
+	add(t, store, fixture()...)
+
+	a, cancelA := listen(store, content.Client{IP: clientA})
+	defer cancelA()
+	b, cancelB := listen(store, content.Client{IP: clientB})
+	defer cancelB()
+	system, cancelSystem := listen(store, content.Client{IP: unknown})
+	defer cancelSystem()
+
+	add(t, store, object("stack", "stack-a", "30", "api", "env-a"))
+	expectReceived(t, "a", a, "stack-a")
+	expectReceived(t, "system", system, "stack-a")
+	expectNothing(t, "b", b)
+
+	remove(t, store, object("stack", "stack-b", "31", "web", "env-b"))
+	expectReceived(t, "b", b, "stack-b")
+	expectReceived(t, "system", system, "stack-b")
+	expectNothing(t, "a", a)
+
+	// A reload delivers the differences only
+	reload(t, store, fixture()...)
+	expectReceived(t, "a", a, "stack-a")
+	expectReceived(t, "b", b, "stack-b")
+	expectReceived(t, "system", system, "stack-a", "stack-b")
+	reload(t, store, fixture()...)
+	expectNothing(t, "a", a)
+	expectNothing(t, "system", system)
+
+	cancelA()
+	add(t, store, object("stack", "stack-a", "30", "api", "env-a"))
+	expectNothing(t, "a after cancelling", a)
+	expectReceived(t, "system", system, "stack-a")
+}
+
+func testSubscribeUnknownClient(t *testing.T, store content.Store) {
+	// Without a system environment a client that is not a container sees
+	// every change until its environment is known
+	received, cancel := listen(store, content.Client{IP: clientA})
+	defer cancel()
+
+	add(t, store, environment("env-b", "2", "b", false))
+	expectReceived(t, "unknown", received, "env-b")
+	add(t, store, object("stack", "stack-b", "31", "web", "env-b"))
+	expectReceived(t, "unknown", received, "stack-b")
+}
+
+func testView(t *testing.T, store content.Store) {
+	add(t, store, fixture()...)
+
+	called := false
+	store.View(func() {
+		called = true
+		expect(t, "All stacks in a view", "stack-a,stack-b", uuids(store.All(content.StackType)))
+	})
+	if !called {
+		t.Errorf("View: expected the function to be called")
+	}
+
+	// Writes wait for the view to end
+	done := make(chan struct{})
+	store.View(func() {
+		go func() {
+			if err := store.Add(object("stack", "stack-c", "32", "db", "env-a")); err != nil {
+				t.Errorf("Add: %v", err)
+			}
+			close(done)
+		}()
+
+		select {
+		case <-done:
+			t.Errorf("View: expected Add to wait for the view")
+		case <-time.After(50 * time.Millisecond):
+		}
+		expect(t, "All stacks while adding", "stack-a,stack-b", uuids(store.All(content.StackType)))
+	})
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("View: Add still waiting after the view")
+	}
+	expect(t, "All stacks after the view", "stack-a,stack-b,stack-c", uuids(store.All(content.StackType)))
+}
@@ -0,0 +1,115 @@
+package content
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mitchellh/mapstructure"
+	"github.com/rancher/go-rancher/v3"
+)
+
+// ValidationError describes a sync object that does not have the shape of its
+// *Info type
+type ValidationError struct {
+	UUID   string `json:"uuid"`
+	Type   string `json:"infoType"`
+	ID     string `json:"infoTypeId"`
+	Reason string `json:"error"`
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s %s:%s: %s", e.UUID, e.Type, e.ID, e.Reason)
+}
+
+func newInfo(objectType ObjectType) interface{} {
+	switch objectType {
+	case ContainerType:
+		return &client.InstanceInfo{}
+	case ServiceType:
+		return &client.ServiceInfo{}
+	case StackType:
+		return &client.StackInfo{}
+	case NetworkType:
+		return &client.NetworkInfo{}
+	case HostType:
+		return &client.HostInfo{}
+	case EnvironmentType:
+		return &client.EnvironmentInfo{}
+	}
+	return nil
+}
+
+// Decode decodes a sync object into its *Info type.  No object is returned if
+// it lacks an id or uuid or has an unknown infoType.  If fields have the wrong
+// type the partially decoded object is returned along with the error.
+func Decode(val map[string]interface{}) (ObjectType, interface{}, error) {
+	infoType, _ := val["infoType"].(string)
+	id, _ := val["infoTypeId"].(string)
+	uuid, _ := val["uuid"].(string)
+
+	invalid := func(format string, args ...interface{}) *ValidationError {
+		return &ValidationError{
+			UUID:   uuid,
+			Type:   infoType,
+			ID:     id,
+			Reason: fmt.Sprintf(format, args...),
+		}
+	}
+
+	switch {
+	case uuid == "":
+		return "", nil, invalid("missing uuid")
+	case id == "" || id == "0":
+		return "", nil, invalid("missing infoTypeId")
+	}
+
+	objectType := ObjectType(infoType)
+	obj := newInfo(objectType)
+	if obj == nil {
+		return "", nil, invalid("unknown infoType")
+	}
+
+	// copy map since we are changing a value
+	copied := map[string]interface{}{}
+	for k, v := range val {
+		copied[k] = v
+	}
+	copied["id"] = id
+
+	if err := mapstructure.Decode(copied, obj); err != nil {
+		if decodeErr, ok := err.(*mapstructure.Error); ok {
+			return objectType, obj, invalid("%s", strings.Join(decodeErr.Errors, "; "))
+		}
+		return objectType, obj, invalid("%v", err)
+	}
+
+	return objectType, obj, nil
+}
+
+// DecodeUpdate decodes a sync object to be stored.  Objects that Decode
+// returns no object for are ignored and nil is returned for them, unless
+// stored reports that the store holds an object of the same uuid, which would
+// be served stale.  An error of Decode for a partially decoded object is only
+// logged.
+func DecodeUpdate(val map[string]interface{}, stored func(uuid string) bool) (ObjectType, interface{}, error) {
+	objectType, obj, err := Decode(val)
+	if obj == nil {
+		uuid, _ := val["uuid"].(string)
+		if uuid != "" && stored(uuid) {
+			return "", nil, fmt.Errorf("failed to replace %s: %v", uuid, err)
+		}
+		logrus.Debugf("Ignoring %v", err)
+		return "", nil, nil
+	} else if err != nil {
+		logrus.Errorf("Failed to unmarshal: %v %v", err, val)
+	}
+	return objectType, obj, nil
+}
+
+// Validate returns a *ValidationError if the sync object can not be fully
+// decoded
+func Validate(val map[string]interface{}) error {
+	_, _, err := Decode(val)
+	return err
+}
@@ -0,0 +1,34 @@
+package content
+
+import (
+	"github.com/rancher/go-rancher/v3"
+)
+
+// ClientEnvironment returns the environment a client is scoped to, the same
+// way Store.Environment resolves it.  Clients that are not a known container
+// are scoped to the system environment.
+func ClientEnvironment(store Store, c Client) *client.EnvironmentInfo {
+	container := store.SelfContainer(c)
+	if container != nil {
+		return store.EnvironmentByUUID(container.EnvironmentUuid)
+	}
+
+	for _, obj := range store.All(EnvironmentType) {
+		if env := obj.(*client.EnvironmentInfo); env.System {
+			return env
+		}
+	}
+
+	return nil
+}
+
+// EnvironmentUUID returns the environment an info object belongs to, an
+// environment belongs to itself
+func EnvironmentUUID(obj interface{}) string {
+	if env, ok := obj.(*client.EnvironmentInfo); ok {
+		return env.Uuid
+	}
+	val, _ := GetValue(obj, "EnvironmentUuid")
+	uuid, _ := val.(string)
+	return uuid
+}
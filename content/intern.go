@@ -0,0 +1,131 @@
+package content
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/rancher/go-rancher/v3"
+)
+
+const (
+	// internShards spreads the interned strings over tables with their own
+	// lock so that concurrent Adds rarely wait for each other
+	internShards = 32
+
+	// maxInterned bounds the strings kept for sharing per shard.  The least
+	// recently used one is dropped for a new one so that the strings of
+	// removed objects don't accumulate, objects keep the copies they share.
+	maxInterned = 1 << 10
+)
+
+// uniqueLabels are the labels Rancher sets to a value of the container's own,
+// which no other object shares
+var uniqueLabels = map[string]bool{
+	"io.rancher.container.uuid":        true,
+	"io.rancher.container.name":        true,
+	"io.rancher.container.ip":          true,
+	"io.rancher.container.mac_address": true,
+	"io.rancher.container.hostname":    true,
+}
+
+type internShard struct {
+	sync.Mutex
+	strings map[string]*list.Element
+	lru     *list.List
+}
+
+// interned holds one copy of the strings that repeat across objects
+var interned [internShards]internShard
+
+func init() {
+	for i := range interned {
+		interned[i].strings = map[string]*list.Element{}
+		interned[i].lru = list.New()
+	}
+}
+
+func intern(s string) string {
+	if s == "" {
+		return s
+	}
+
+	// FNV-1a, inline to not allocate for hashing
+	hash := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		hash ^= uint32(s[i])
+		hash *= 16777619
+	}
+
+	shard := &interned[hash%internShards]
+	shard.Lock()
+	defer shard.Unlock()
+
+	if e, ok := shard.strings[s]; ok {
+		shard.lru.MoveToFront(e)
+		return e.Value.(string)
+	}
+	if shard.lru.Len() >= maxInterned {
+		oldest := shard.lru.Back()
+		shard.lru.Remove(oldest)
+		delete(shard.strings, oldest.Value.(string))
+	}
+	shard.strings[s] = shard.lru.PushFront(s)
+	return s
+}
+
+func internFields(fields ...*string) {
+	for _, field := range fields {
+		*field = intern(*field)
+	}
+}
+
+func internSlice(values []string) {
+	for i := range values {
+		values[i] = intern(values[i])
+	}
+}
+
+func internLabels(labels map[string]string) map[string]string {
+	if len(labels) == 0 {
+		return labels
+	}
+
+	result := make(map[string]string, len(labels))
+	for key, value := range labels {
+		if !uniqueLabels[key] {
+			value = intern(value)
+		}
+		result[intern(key)] = value
+	}
+	return result
+}
+
+// Intern replaces the label keys and values, the enum-like fields and the
+// references to other objects of an info object by copies shared with the
+// other objects.  The object's own IDs, name and addresses and the values of
+// uniqueLabels are left alone as no other object shares them.  The stores
+// intern the objects they decode on Add.
+func Intern(obj interface{}) {
+	switch obj := obj.(type) {
+	case *client.InstanceInfo:
+		internFields(&obj.Type, &obj.InfoType, &obj.State, &obj.HealthState,
+			&obj.EnvironmentUuid, &obj.AccountId, &obj.StackId, &obj.ServiceId, &obj.HostId, &obj.NetworkId)
+		internSlice(obj.ServiceIds)
+		internSlice(obj.Dns)
+		internSlice(obj.DnsSearch)
+		obj.Labels = internLabels(obj.Labels)
+	case *client.ServiceInfo:
+		internFields(&obj.Type, &obj.InfoType, &obj.State, &obj.HealthState, &obj.Kind,
+			&obj.EnvironmentUuid, &obj.StackId)
+		obj.Labels = internLabels(obj.Labels)
+	case *client.StackInfo:
+		internFields(&obj.Type, &obj.InfoType, &obj.HealthState, &obj.EnvironmentUuid)
+	case *client.HostInfo:
+		internFields(&obj.Type, &obj.InfoType, &obj.State, &obj.AgentState, &obj.EnvironmentUuid)
+		obj.Labels = internLabels(obj.Labels)
+	case *client.NetworkInfo:
+		internFields(&obj.Type, &obj.InfoType, &obj.Kind, &obj.DefaultPolicyAction, &obj.EnvironmentUuid)
+	case *client.EnvironmentInfo:
+		internFields(&obj.Type, &obj.InfoType)
+	}
+}
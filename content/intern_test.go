@@ -0,0 +1,77 @@
+package content
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/rancher/go-rancher/v3"
+)
+
+// isInterned reports whether the table holds s
+func isInterned(s string) bool {
+	for i := range interned {
+		shard := &interned[i]
+		shard.Lock()
+		_, ok := shard.strings[s]
+		shard.Unlock()
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func TestInternLabels(t *testing.T) {
+	container := &client.InstanceInfo{
+		Uuid:      "container-intern-1",
+		StackId:   "stack-intern-1",
+		PrimaryIp: "10.42.99.1",
+		Labels: map[string]string{
+			"io.rancher.container.uuid":     "container-intern-1",
+			"io.rancher.container.ip":       "10.42.99.1/16",
+			"io.rancher.stack_service.name": "web/intern",
+		},
+	}
+	Intern(container)
+
+	for _, s := range []string{"io.rancher.container.uuid", "io.rancher.container.ip", "web/intern", "stack-intern-1"} {
+		if !isInterned(s) {
+			t.Errorf("Expected %q to be interned", s)
+		}
+	}
+	for _, s := range []string{"container-intern-1", "10.42.99.1/16", "10.42.99.1"} {
+		if isInterned(s) {
+			t.Errorf("Expected %q not to be interned, it is unique to the container", s)
+		}
+	}
+}
+
+func TestInternEviction(t *testing.T) {
+	intern("shared-intern-value")
+
+	// Far more strings than the table holds, using the shared one all along
+	for i := 0; i < 4*internShards*maxInterned; i++ {
+		intern(fmt.Sprintf("value-%d", i))
+		if i%100 == 0 {
+			intern("shared-intern-value")
+		}
+	}
+
+	total := 0
+	for i := range interned {
+		total += len(interned[i].strings)
+		if interned[i].lru.Len() != len(interned[i].strings) {
+			t.Errorf("Shard %d lists %d strings and maps %d", i, interned[i].lru.Len(), len(interned[i].strings))
+		}
+	}
+	if total > internShards*maxInterned {
+		t.Errorf("Expected at most %d interned strings, got %d", internShards*maxInterned, total)
+	}
+
+	if !isInterned("shared-intern-value") {
+		t.Errorf("Expected a string in use to stay interned")
+	}
+	if isInterned("value-0") {
+		t.Errorf("Expected the least recently used strings to be dropped")
+	}
+}
@@ -1,18 +1,16 @@
 package memory
 
 import (
-	"context"
 	"fmt"
-	"regexp"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"io/ioutil"
-
 	"github.com/Sirupsen/logrus"
-	"github.com/mitchellh/mapstructure"
 	"github.com/rancher/go-rancher/v3"
 	"github.com/rancher/metadata/content"
 	"golang.org/x/sync/syncmap"
@@ -31,34 +29,24 @@ type storeData struct {
 }
 
 type Store struct {
-	version int
+	// version is only written with the lock held, and read atomically by
+	// Version which may be called during View
+	version int64
 	d       *storeData
-	cond    *sync.Cond
+	lock    sync.RWMutex
+	log     *content.ChangeLog
 }
 
 type objectSliceWrapper struct {
 	slice []content.Object
 }
 
-func NewMemoryStore(ctx context.Context) *Store {
+func NewMemoryStore() *Store {
 	m := &Store{
 		d:       newStoreData(),
-		cond:    sync.NewCond(&sync.Mutex{}),
-		version: time.Now().Nanosecond(),
-	}
-
-	if ctx != nil {
-		go func() {
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case <-time.After(5 * time.Second):
-					m.Changed()
-				}
-			}
-		}()
+		version: int64(time.Now().Nanosecond()),
 	}
+	m.log = content.NewChangeLog(int(m.version))
 
 	return m
 }
@@ -73,10 +61,20 @@ func newStoreData() *storeData {
 
 func (m *Store) getObjectMap(objectType content.ObjectType) *syncmap.Map {
 	val, _ := m.d.objects.Load(objectType)
-	return val.(*syncmap.Map)
+	objects, _ := val.(*syncmap.Map)
+	return objects
 }
 
 func (m *Store) Environment(c content.Client) content.Object {
+	result := m.clientEnvironment(c)
+	if result == nil {
+		return nil
+	}
+
+	return content.ObjectFactories[content.EnvironmentType](result, c, m)
+}
+
+func (m *Store) clientEnvironment(c content.Client) *client.EnvironmentInfo {
 	var result *client.EnvironmentInfo
 
 	environments := m.getObjectMap(content.EnvironmentType)
@@ -99,11 +97,7 @@ func (m *Store) Environment(c content.Client) content.Object {
 		})
 	}
 
-	if result == nil {
-		return nil
-	}
-
-	return content.ObjectFactories[content.EnvironmentType](result, c, m)
+	return result
 }
 
 func (m *Store) ServiceByName(environmentUUID, stackName, name string) *client.ServiceInfo {
@@ -155,7 +149,7 @@ func (m *Store) ContainerByName(environmentUUID, stackName, name string) *client
 
 	m.getObjectMap(content.ContainerType).Range(func(key, value interface{}) bool {
 		obj := value.(*client.InstanceInfo)
-		if obj.EnvironmentUuid == environmentUUID && obj.StackId == stack.Id && strings.EqualFold(obj.Name, name) {
+		if obj.EnvironmentUuid == environmentUUID && obj.StackId == stack.InfoTypeId && strings.EqualFold(obj.Name, name) {
 			result = obj
 			return false
 		}
@@ -168,20 +162,40 @@ func (m *Store) ContainerByName(environmentUUID, stackName, name string) *client
 func (m *Store) ByStack(objectType content.ObjectType, c content.Client, stackUUID string) []content.Object {
 	result := objectSliceWrapper{}
 	objects := m.getObjectMap(objectType)
+	if objects == nil {
+		return result.slice
+	}
 
-	objects.Range(func(key, value interface{}) bool {
+	rangeByUUID(objects, func(value interface{}) {
 		stackID, ok := getString(value, "StackId")
 		if ok {
 			if m.IDtoUUID(content.StackType, stackID) == stackUUID {
 				result.slice = append(result.slice, m.newObject(objectType, value, c))
 			}
 		}
-		return true
 	})
 
 	return result.slice
 }
 
+// rangeByUUID calls f for the objects of a map in the order of their UUIDs,
+// as the bolt store lists them, so that a response listing them is the same
+// as long as the objects are
+func rangeByUUID(objects *syncmap.Map, f func(value interface{})) {
+	var uuids []string
+	objects.Range(func(key, value interface{}) bool {
+		uuids = append(uuids, key.(string))
+		return true
+	})
+
+	sort.Strings(uuids)
+	for _, uuid := range uuids {
+		if value, ok := objects.Load(uuid); ok {
+			f(value)
+		}
+	}
+}
+
 func getString(obj interface{}, key string) (string, bool) {
 	val, ok := content.GetValue(obj, key)
 	if !ok {
@@ -199,18 +213,18 @@ func (m *Store) ByEnvironment(objectType content.ObjectType, c content.Client, e
 	result := objectSliceWrapper{}
 
 	env, ok := m.getEnv(environmentUUID)
-	if !ok {
+	objects := m.getObjectMap(objectType)
+	if !ok || objects == nil {
 		return result.slice
 	}
 
-	m.getObjectMap(objectType).Range(func(key, value interface{}) bool {
+	rangeByUUID(objects, func(value interface{}) {
 		testUUID, ok := getString(value, "EnvironmentUuid")
 		if ok {
 			if env.System || testUUID == environmentUUID {
 				result.slice = append(result.slice, m.newObject(objectType, value, c))
 			}
 		}
-		return true
 	})
 
 	return result.slice
@@ -251,98 +265,99 @@ func (m *Store) IDtoUUID(objectType content.ObjectType, id string) string {
 	return s
 }
 
-func (m *Store) WaitChanged() {
-	m.cond.L.Lock()
-	m.cond.Wait()
-	m.cond.L.Unlock()
+func (m *Store) Subscribe(c content.Client, f content.ChangeListener) func() {
+	return m.log.Subscribe(m.clientEnvironment(c), f)
 }
 
-func (m *Store) Changed() {
-	m.cond.Broadcast()
+func (m *Store) View(f func()) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	f()
 }
 
-func (m *Store) Add(val map[string]interface{}) {
+func (m *Store) Add(val map[string]interface{}) error {
+	return m.add(val, m.stored)
+}
+
+// stored reports whether the store holds an object with the uuid
+func (m *Store) stored(uuid string) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	_, ok := m.d.all.Load(uuid)
+	return ok
+}
+
+// add stores an object, stored tells whether an object it can't decode would
+// replace a stored one
+func (m *Store) add(val map[string]interface{}, stored func(uuid string) bool) error {
 	infoType, _ := val["infoType"].(string)
 	id, _ := val["infoTypeId"].(string)
 	uuid, _ := val["uuid"].(string)
 
 	logrus.Infof("Adding %s %s:%s", uuid, infoType, id)
 
-	if id == "" || id == "0" || uuid == "" {
-		return
+	objectType, obj, err := content.DecodeUpdate(val, stored)
+	if obj == nil {
+		return err
 	}
+	content.Intern(obj)
 
-	// copy map since we are changing a value
-	val = copyMap(val)
-	val["id"] = id
-
-	var rawVal interface{}
-	objectType := content.ObjectType(infoType)
+	m.lock.Lock()
 
-	switch objectType {
-	case content.ContainerType:
-		rawVal = &client.InstanceInfo{}
-	case content.ServiceType:
-		rawVal = &client.ServiceInfo{}
-	case content.StackType:
-		rawVal = &client.StackInfo{}
-	case content.NetworkType:
-		rawVal = &client.NetworkInfo{}
-	case content.HostType:
-		rawVal = &client.HostInfo{}
-	case content.EnvironmentType:
-		rawVal = &client.EnvironmentInfo{}
+	action := content.ChangeAdd
+	if _, ok := m.d.all.Load(uuid); ok {
+		action = content.ChangeUpdate
 	}
 
-	if rawVal != nil {
-		obj := decodeAndLog(val, rawVal)
-		m.getObjectMap(objectType).Store(uuid, obj)
-		m.putIDtoUUID(objectType, id, uuid)
+	m.getObjectMap(objectType).Store(uuid, obj)
+	m.putIDtoUUID(objectType, id, uuid)
 
-		m.d.all.Store(uuid, obj)
-		m.version++
-		m.Changed()
-	}
-}
+	m.d.all.Store(uuid, obj)
+	atomic.AddInt64(&m.version, 1)
+	change := m.recordChange(action, objectType, uuid, obj)
+	m.lock.Unlock()
 
-func copyMap(val map[string]interface{}) map[string]interface{} {
-	result := map[string]interface{}{}
-	for k, v := range val {
-		result[k] = v
-	}
-	return result
+	m.log.Notify(change)
+	return nil
 }
 
-func decodeAndLog(m interface{}, rawVal interface{}) interface{} {
-	err := mapstructure.Decode(m, rawVal)
-	if err != nil {
-		logrus.Errorf("Failed to unmarshal: %v %v", err, m)
+func (m *Store) Remove(val map[string]interface{}) error {
+	// Removes carry the object as synced, not as decoded by Add
+	id, _ := val["infoTypeId"].(string)
+	if id == "" && val["id"] != nil {
+		id = fmt.Sprint(val["id"])
 	}
-	return rawVal
-}
-
-func (m *Store) Remove(val map[string]interface{}) {
-	id := fmt.Sprint(val["id"])
 	uuid, _ := val["uuid"].(string)
 	infoType, _ := val["infoType"].(string)
 
 	logrus.Infof("Removing %s %s:%s", uuid, infoType, id)
 	if uuid == "" || id == "" || infoType == "" {
-		return
+		return nil
 	}
 
 	objectType := content.ObjectType(infoType)
 
+	m.lock.Lock()
+
 	objectMap := m.getObjectMap(objectType)
 	if objectMap == nil {
-		return
+		m.lock.Unlock()
+		return nil
 	}
 
+	var changes []content.Change
+	old, exists := m.d.all.Load(uuid)
 	objectMap.Delete(uuid)
 	m.removeIDtoUUID(objectType, id)
 	m.d.all.Delete(uuid)
-	m.version++
-	m.Changed()
+	atomic.AddInt64(&m.version, 1)
+	if exists {
+		changes = append(changes, m.recordChange(content.ChangeRemove, objectType, uuid, old))
+	}
+	m.lock.Unlock()
+
+	m.log.Notify(changes...)
+	return nil
 }
 
 func (m *Store) SelfContainer(c content.Client) *client.InstanceInfo {
@@ -351,30 +366,9 @@ func (m *Store) SelfContainer(c content.Client) *client.InstanceInfo {
 
 func (m *Store) SelfHost(c content.Client) content.Object {
 	var result *client.InstanceInfo
-	selfContainerID := ""
 
 	if selfHostID == "" {
-		cgroupBytes, err := ioutil.ReadFile("/proc/1/cgroup")
-		if err != nil {
-			logrus.Errorf("Failed to read /proc/1/cgroup: %v", err)
-			return nil
-		}
-
-		cgroups := string(cgroupBytes)
-		for _, line := range strings.Split(cgroups, "\n") {
-			parts := strings.Split(line, ":")
-			if len(parts) > 1 && parts[1] == "devices" {
-				re := regexp.MustCompile("[A-Za-z0-9]{64}")
-				matchedIDs := re.FindAllString(line, -1)
-				if len(matchedIDs) > 1 {
-					selfContainerID = matchedIDs[len(matchedIDs)-1]
-				} else {
-					selfContainerID = matchedIDs[0]
-				}
-				break
-			}
-		}
-
+		selfContainerID := content.SelfContainerID()
 		if selfContainerID == "" {
 			return nil
 		}
@@ -416,19 +410,102 @@ func (m *Store) Object(uuid string, c content.Client) content.Object {
 	return result
 }
 
-func (m *Store) Reload(vals map[string]interface{}) {
-	o := NewMemoryStore(nil)
+func (m *Store) All(objectType content.ObjectType) []interface{} {
+	objects := m.getObjectMap(objectType)
+	if objects == nil {
+		return nil
+	}
+
+	var result []interface{}
+	objects.Range(func(key, value interface{}) bool {
+		result = append(result, value)
+		return true
+	})
+	return result
+}
+
+func (m *Store) Reload(vals map[string]interface{}) error {
+	o := NewMemoryStore()
 
 	for _, rawVal := range vals {
-		o.Add(rawVal.(map[string]interface{}))
+		if val, ok := rawVal.(map[string]interface{}); ok {
+			if err := o.add(val, m.stored); err != nil {
+				return err
+			}
+		}
 	}
 
+	m.lock.Lock()
+	// The version is kept monotonic across reloads so that the change log
+	// stays meaningful, the difference is recorded as individual changes
+	changes := m.recordDiff(o.d)
 	m.d = o.d
-	m.version = o.version
+	m.lock.Unlock()
+
+	m.log.Notify(changes...)
+	return nil
+}
+
+func (m *Store) recordDiff(newData *storeData) []content.Change {
+	var changes []content.Change
+
+	newData.all.Range(func(key, value interface{}) bool {
+		action := content.ChangeAdd
+		if old, ok := m.d.all.Load(key); ok {
+			if reflect.DeepEqual(old, value) {
+				return true
+			}
+			action = content.ChangeUpdate
+		}
+
+		atomic.AddInt64(&m.version, 1)
+		changes = append(changes, m.recordChange(action, objectTypeOf(value), key.(string), value))
+		return true
+	})
+
+	m.d.all.Range(func(key, value interface{}) bool {
+		if _, ok := newData.all.Load(key); !ok {
+			atomic.AddInt64(&m.version, 1)
+			changes = append(changes, m.recordChange(content.ChangeRemove, objectTypeOf(value), key.(string), value))
+		}
+		return true
+	})
+
+	return changes
+}
+
+func (m *Store) recordChange(action content.ChangeAction, objectType content.ObjectType, uuid string, obj interface{}) content.Change {
+	return m.log.Record(int(m.version), action, objectType, uuid, content.EnvironmentUUID(obj))
+}
+
+func (m *Store) Changes(c content.Client, since int) ([]content.Change, string, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	changes, ok := m.log.Since(m.clientEnvironment(c), since, int(m.version))
+	return changes, strconv.FormatInt(m.version, 10), ok
+}
+
+func objectTypeOf(obj interface{}) content.ObjectType {
+	switch obj.(type) {
+	case *client.InstanceInfo:
+		return content.ContainerType
+	case *client.ServiceInfo:
+		return content.ServiceType
+	case *client.StackInfo:
+		return content.StackType
+	case *client.NetworkInfo:
+		return content.NetworkType
+	case *client.HostInfo:
+		return content.HostType
+	case *client.EnvironmentInfo:
+		return content.EnvironmentType
+	}
+	return ""
 }
 
 func (m *Store) Version() string {
-	return strconv.Itoa(m.version)
+	return strconv.FormatInt(atomic.LoadInt64(&m.version), 10)
 }
 
 func (m *Store) ServiceByID(id string) *client.ServiceInfo {
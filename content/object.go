@@ -5,3 +5,21 @@ type Object interface {
 	Map() (map[string]interface{}, error)
 	Name() string
 }
+
+// MapObject is an Object backed by its decoded JSON form, it is used for
+// objects read back from the API
+type MapObject map[string]interface{}
+
+func (m MapObject) Get(key string) (interface{}, bool) {
+	val, ok := m[key]
+	return val, ok
+}
+
+func (m MapObject) Map() (map[string]interface{}, error) {
+	return m, nil
+}
+
+func (m MapObject) Name() string {
+	name, _ := m["name"].(string)
+	return name
+}
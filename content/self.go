@@ -0,0 +1,35 @@
+package content
+
+import (
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+var containerIDRegexp = regexp.MustCompile("[A-Za-z0-9]{64}")
+
+// SelfContainerID returns the external ID of the container the metadata
+// server runs in, from the devices cgroup of its init process.  It is empty
+// if that can't be determined.
+func SelfContainerID() string {
+	cgroupBytes, err := ioutil.ReadFile("/proc/1/cgroup")
+	if err != nil {
+		logrus.Errorf("Failed to read /proc/1/cgroup: %v", err)
+		return ""
+	}
+
+	for _, line := range strings.Split(string(cgroupBytes), "\n") {
+		parts := strings.Split(line, ":")
+		if len(parts) > 1 && parts[1] == "devices" {
+			matchedIDs := containerIDRegexp.FindAllString(line, -1)
+			if len(matchedIDs) == 0 {
+				return ""
+			}
+			return matchedIDs[len(matchedIDs)-1]
+		}
+	}
+
+	return ""
+}
@@ -45,6 +45,9 @@ type Store interface {
 
 	Object(uuid string, client Client) Object
 
+	// All returns the raw info objects of a type across every environment
+	All(objectType ObjectType) []interface{}
+
 	ServiceByID(id string) *client.ServiceInfo
 	StackByID(id string) *client.StackInfo
 	NetworkByID(id string) *client.NetworkInfo
@@ -59,12 +62,37 @@ type Store interface {
 	SelfContainer(client Client) *client.InstanceInfo
 	SelfHost(client Client) Object
 
-	Reload(all map[string]interface{})
+	// Reload replaces the content of the store.  If it fails the content is
+	// left unchanged.
+	Reload(all map[string]interface{}) error
 
-	Add(val map[string]interface{})
-	Remove(val map[string]interface{})
+	// Add stores an object as synced.  Objects that can't be decoded are
+	// ignored, unless they replace a stored object, which is an error.
+	Add(val map[string]interface{}) error
+	Remove(val map[string]interface{}) error
 
 	Version() string
 
-	WaitChanged()
+	// Changes returns the changes visible to the client with a revision newer
+	// than since, and the version of the store they bring the client to.  If
+	// the change log no longer covers since, false is returned and the client
+	// must read the full environment again.  Until the client's environment is
+	// known every change is returned.
+	Changes(client Client, since int) ([]Change, string, bool)
+
+	// Subscribe registers a listener for the changes visible to the client.
+	// Until the client's environment is known every change is delivered.  The
+	// returned function removes the listener.
+	Subscribe(client Client, listener ChangeListener) func()
+
+	// View runs f while updates to the store are held off so that every read
+	// made inside f observes the same state
+	View(f func())
+}
+
+// Batch is implemented by stores that apply the updates and removes of a sync
+// atomically instead of one object at a time.  If Apply fails none of the
+// sync is applied.
+type Batch interface {
+	Apply(updates, removes map[string]interface{}) error
 }
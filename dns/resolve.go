@@ -0,0 +1,430 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/rancher/go-rancher/v3"
+	"github.com/rancher/metadata/content"
+	"github.com/rancher/metadata/types/convert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// resolver answers queries from the store as seen by one client
+type resolver struct {
+	store        content.Store
+	domain       string
+	ttl          uint32
+	self         *client.InstanceInfo
+	selfStack    string
+	environments []string
+}
+
+type target struct {
+	service   *client.ServiceInfo
+	container *client.InstanceInfo
+}
+
+func newResolver(store content.Store, domain string, ttl uint32, clientIP string) *resolver {
+	c := content.Client{IP: clientIP}
+	env := content.ClientEnvironment(store, c)
+	if env == nil {
+		return nil
+	}
+
+	r := &resolver{
+		store:  store,
+		domain: domain,
+		ttl:    ttl,
+		self:   store.SelfContainer(c),
+	}
+
+	if r.self != nil {
+		if stack := store.StackByID(r.self.StackId); stack != nil {
+			r.selfStack = stack.Name
+		}
+	}
+
+	if env.System {
+		for _, obj := range store.All(content.EnvironmentType) {
+			r.environments = append(r.environments, obj.(*client.EnvironmentInfo).Uuid)
+		}
+	} else {
+		r.environments = []string{env.Uuid}
+	}
+
+	return r
+}
+
+// answer returns the records for the question and false if the name is not
+// known to the store
+func (r *resolver) answer(q dnsmessage.Question) ([]dnsmessage.Resource, bool) {
+	name := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+
+	switch q.Type {
+	case dnsmessage.TypePTR:
+		ip := parseReverse(name)
+		if ip == nil {
+			return nil, false
+		}
+		return r.reverse(q, ip)
+	case dnsmessage.TypeSRV:
+		labels := strings.Split(name, ".")
+		protocol := ""
+		for len(labels) > 0 && strings.HasPrefix(labels[0], "_") {
+			switch labels[0] {
+			case "_tcp", "_udp":
+				protocol = labels[0][1:]
+			}
+			labels = labels[1:]
+		}
+
+		t, ok := r.lookup(strings.Join(labels, "."))
+		if !ok {
+			return nil, false
+		}
+		return r.srv(q, t, protocol), true
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA, dnsmessage.TypeCNAME:
+		t, ok := r.lookup(name)
+		if !ok {
+			return nil, false
+		}
+		return r.addresses(q, t), true
+	}
+
+	if _, ok := r.lookup(name); ok {
+		// Known name but unsupported type, answer with no records
+		return nil, true
+	}
+	return nil, false
+}
+
+func (r *resolver) lookup(name string) (target, bool) {
+	if t, ok := r.lookupFQDN(name); ok {
+		return t, true
+	}
+
+	if r.domain != "" {
+		name = strings.TrimSuffix(name, "."+r.domain)
+	}
+
+	labels := strings.Split(name, ".")
+	switch len(labels) {
+	case 1:
+		if t, ok := r.lookupAlias(labels[0]); ok {
+			return t, true
+		}
+		if r.self != nil {
+			return r.lookupName(r.self.EnvironmentUuid, r.selfStack, labels[0])
+		}
+	case 2:
+		for _, environmentUUID := range r.environments {
+			if t, ok := r.lookupName(environmentUUID, labels[1], labels[0]); ok {
+				return t, true
+			}
+		}
+	}
+
+	return target{}, false
+}
+
+// lookupFQDN resolves the FQDN of a service, which starts with the names of
+// the service and of its stack
+func (r *resolver) lookupFQDN(name string) (target, bool) {
+	labels := strings.SplitN(name, ".", 3)
+	if len(labels) < 3 {
+		return target{}, false
+	}
+
+	for _, environmentUUID := range r.environments {
+		service := r.store.ServiceByName(environmentUUID, labels[1], labels[0])
+		if service != nil && service.Fqdn != "" && strings.EqualFold(strings.TrimSuffix(service.Fqdn, "."), name) {
+			return target{service: service}, true
+		}
+	}
+	return target{}, false
+}
+
+func (r *resolver) lookupName(environmentUUID, stackName, name string) (target, bool) {
+	if service := r.store.ServiceByName(environmentUUID, stackName, name); service != nil {
+		return target{service: service}, true
+	}
+	if container := r.store.ContainerByName(environmentUUID, stackName, name); container != nil {
+		return target{container: container}, true
+	}
+	return target{}, false
+}
+
+// lookupAlias resolves the link aliases of the client's container and of its
+// service
+func (r *resolver) lookupAlias(alias string) (target, bool) {
+	if r.self == nil {
+		return target{}, false
+	}
+
+	for _, link := range r.self.Links {
+		if strings.EqualFold(linkAlias(link), alias) {
+			stackName, name := convert.LinkTarget(r.selfStack, link.Name)
+			if container := r.store.ContainerByName(r.self.EnvironmentUuid, stackName, name); container != nil {
+				return target{container: container}, true
+			}
+		}
+	}
+
+	service := r.store.ServiceByID(r.self.ServiceId)
+	if service == nil {
+		return target{}, false
+	}
+
+	for _, link := range service.Links {
+		if strings.EqualFold(linkAlias(link), alias) {
+			stackName, name := convert.LinkTarget(r.selfStack, link.Name)
+			if target, ok := r.lookupName(r.self.EnvironmentUuid, stackName, name); ok {
+				return target, true
+			}
+		}
+	}
+
+	return target{}, false
+}
+
+func linkAlias(link client.Link) string {
+	if link.Alias == "" {
+		return link.Name
+	}
+	return link.Alias
+}
+
+func (r *resolver) visible(environmentUUID string) bool {
+	for _, uuid := range r.environments {
+		if uuid == environmentUUID {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *resolver) header(q dnsmessage.Question, t dnsmessage.Type) dnsmessage.ResourceHeader {
+	return dnsmessage.ResourceHeader{
+		Name:  q.Name,
+		Type:  t,
+		Class: dnsmessage.ClassINET,
+		TTL:   r.ttl,
+	}
+}
+
+func (r *resolver) addresses(q dnsmessage.Question, t target) []dnsmessage.Resource {
+	var result []dnsmessage.Resource
+
+	if t.service != nil && t.service.Kind == "externalService" && t.service.Hostname != "" {
+		name, err := dnsmessage.NewName(dnsName(t.service.Hostname))
+		if err != nil {
+			return nil
+		}
+		return append(result, dnsmessage.Resource{
+			Header: r.header(q, dnsmessage.TypeCNAME),
+			Body:   &dnsmessage.CNAMEResource{CNAME: name},
+		})
+	}
+
+	for _, ip := range r.ips(t) {
+		if ip4 := ip.To4(); ip4 != nil {
+			if q.Type == dnsmessage.TypeA {
+				body := &dnsmessage.AResource{}
+				copy(body.A[:], ip4)
+				result = append(result, dnsmessage.Resource{
+					Header: r.header(q, dnsmessage.TypeA),
+					Body:   body,
+				})
+			}
+		} else if q.Type == dnsmessage.TypeAAAA {
+			body := &dnsmessage.AAAAResource{}
+			copy(body.AAAA[:], ip.To16())
+			result = append(result, dnsmessage.Resource{
+				Header: r.header(q, dnsmessage.TypeAAAA),
+				Body:   body,
+			})
+		}
+	}
+
+	return result
+}
+
+func (r *resolver) ips(t target) []net.IP {
+	var result []net.IP
+	add := func(s string) {
+		if ip := net.ParseIP(s); ip != nil {
+			result = append(result, ip)
+		}
+	}
+
+	if t.container != nil {
+		add(convert.ContainerPrimaryIP(t.container, r.store))
+		return result
+	}
+
+	if t.service.Vip != "" {
+		add(t.service.Vip)
+		return result
+	}
+
+	for _, ip := range t.service.ExternalIps {
+		add(ip)
+	}
+
+	for _, container := range r.serviceContainers(t.service) {
+		add(convert.ContainerPrimaryIP(container, r.store))
+	}
+
+	return result
+}
+
+func (r *resolver) serviceContainers(service *client.ServiceInfo) []*client.InstanceInfo {
+	var result []*client.InstanceInfo
+	for _, id := range service.InstanceIds {
+		container := r.store.ContainerByID(id)
+		if container != nil && container.State == "running" {
+			result = append(result, container)
+		}
+	}
+	return result
+}
+
+func (r *resolver) srv(q dnsmessage.Question, t target, protocol string) []dnsmessage.Resource {
+	var result []dnsmessage.Resource
+	if t.service == nil {
+		return result
+	}
+
+	seen := map[string]bool{}
+	for _, port := range t.service.Ports {
+		if protocol != "" && !strings.EqualFold(port.Protocol, protocol) {
+			continue
+		}
+
+		container := r.store.ContainerByID(port.InstanceId)
+		if container == nil {
+			continue
+		}
+
+		name, err := dnsmessage.NewName(r.containerName(container))
+		if err != nil {
+			continue
+		}
+
+		key := fmt.Sprintf("%s:%d", name, port.PrivatePort)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		result = append(result, dnsmessage.Resource{
+			Header: r.header(q, dnsmessage.TypeSRV),
+			Body: &dnsmessage.SRVResource{
+				Target: name,
+				Port:   uint16(port.PrivatePort),
+			},
+		})
+	}
+
+	return result
+}
+
+func (r *resolver) reverse(q dnsmessage.Question, ip net.IP) ([]dnsmessage.Resource, bool) {
+	name := ""
+
+	for _, obj := range r.store.All(content.ContainerType) {
+		container := obj.(*client.InstanceInfo)
+		if r.visible(container.EnvironmentUuid) && ip.Equal(net.ParseIP(convert.ContainerPrimaryIP(container, r.store))) {
+			name = r.containerName(container)
+			break
+		}
+	}
+
+	if name == "" {
+		for _, obj := range r.store.All(content.ServiceType) {
+			service := obj.(*client.ServiceInfo)
+			if r.visible(service.EnvironmentUuid) && ip.Equal(net.ParseIP(service.Vip)) {
+				name = r.qualifiedName(service.Name, service.StackId)
+				break
+			}
+		}
+	}
+
+	if name == "" {
+		return nil, false
+	}
+
+	ptr, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, false
+	}
+
+	return []dnsmessage.Resource{
+		{
+			Header: r.header(q, dnsmessage.TypePTR),
+			Body:   &dnsmessage.PTRResource{PTR: ptr},
+		},
+	}, true
+}
+
+func (r *resolver) containerName(container *client.InstanceInfo) string {
+	return r.qualifiedName(container.Name, container.StackId)
+}
+
+func (r *resolver) qualifiedName(name, stackID string) string {
+	parts := []string{name}
+	if stack := r.store.StackByID(stackID); stack != nil {
+		parts = append(parts, stack.Name)
+	}
+	if r.domain != "" {
+		parts = append(parts, r.domain)
+	}
+	return dnsName(strings.ToLower(strings.Join(parts, ".")))
+}
+
+func dnsName(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// parseReverse parses the IP address out of an in-addr.arpa or ip6.arpa name
+func parseReverse(name string) net.IP {
+	if strings.HasSuffix(name, ".in-addr.arpa") {
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(labels) != 4 {
+			return nil
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+	}
+
+	if strings.HasSuffix(name, ".ip6.arpa") {
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(nibbles) != 32 {
+			return nil
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, nibble := range nibbles {
+			v, err := strconv.ParseUint(nibble, 16, 8)
+			if err != nil || len(nibble) != 1 {
+				return nil
+			}
+			pos := 31 - i
+			if pos%2 == 0 {
+				ip[pos/2] |= byte(v) << 4
+			} else {
+				ip[pos/2] |= byte(v)
+			}
+		}
+		return ip
+	}
+
+	return nil
+}
@@ -0,0 +1,342 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/metadata/content"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	maxUDPSize     = 512
+	forwardTimeout = 5 * time.Second
+	resolvConf     = "/etc/resolv.conf"
+
+	// tcpTimeout is how long a TCP connection may take to send a query and
+	// read its response, idle connections are closed after it
+	tcpTimeout = 10 * time.Second
+
+	// maxUDPHandlers bounds the UDP queries handled at once.  Reading stops
+	// while all of them wait, mostly on upstream servers, and further queries
+	// queue up in the socket buffer.
+	maxUDPHandlers = 256
+)
+
+// udpBuffers keeps the buffers UDP queries are read into for reuse
+var udpBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 65535)
+		return &buf
+	},
+}
+
+// Server answers DNS queries for the names in the metadata store and forwards
+// everything else to the upstream servers
+type Server struct {
+	listen   string
+	domain   string
+	ttl      uint32
+	upstream []string
+	store    content.Store
+}
+
+func New(store content.Store, listen, domain string, ttl uint32, upstream []string) (*Server, error) {
+	if len(upstream) == 0 {
+		var err error
+		upstream, err = resolvConfServers(listen)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i, server := range upstream {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			upstream[i] = net.JoinHostPort(server, "53")
+		}
+	}
+
+	return &Server{
+		listen:   listen,
+		domain:   strings.ToLower(strings.Trim(domain, ".")),
+		ttl:      ttl,
+		upstream: upstream,
+		store:    store,
+	}, nil
+}
+
+// resolvConfServers returns the nameservers of the system resolver, leaving
+// out the address we listen on so queries are not forwarded to ourselves
+func resolvConfServers(listen string) ([]string, error) {
+	listenHost, _, _ := net.SplitHostPort(listen)
+
+	bytes, err := ioutil.ReadFile(resolvConf)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, line := range strings.Split(string(bytes), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "nameserver" || fields[1] == listenHost {
+			continue
+		}
+		result = append(result, fields[1])
+	}
+
+	return result, nil
+}
+
+func (s *Server) ListenAndServe() error {
+	udp, err := net.ListenPacket("udp", s.listen)
+	if err != nil {
+		return err
+	}
+
+	tcp, err := net.Listen("tcp", s.listen)
+	if err != nil {
+		udp.Close()
+		return err
+	}
+
+	logrus.Infof("Listening on %s for DNS, forwarding to %v", s.listen, s.upstream)
+
+	group := errgroup.Group{}
+	group.Go(func() error {
+		return s.serveUDP(udp)
+	})
+	group.Go(func() error {
+		return s.serveTCP(tcp)
+	})
+
+	return group.Wait()
+}
+
+func (s *Server) serveUDP(conn net.PacketConn) error {
+	handlers := make(chan struct{}, maxUDPHandlers)
+	for {
+		buf := udpBuffers.Get().(*[]byte)
+		n, addr, err := conn.ReadFrom(*buf)
+		if err != nil {
+			udpBuffers.Put(buf)
+			return err
+		}
+
+		handlers <- struct{}{}
+		go func() {
+			defer func() {
+				udpBuffers.Put(buf)
+				<-handlers
+			}()
+
+			response := s.handle((*buf)[:n], addrIP(addr), true)
+			if response == nil {
+				return
+			}
+			if _, err := conn.WriteTo(response, addr); err != nil {
+				logrus.Errorf("Failed to write DNS response to %s: %v", addr, err)
+			}
+		}()
+	}
+}
+
+func (s *Server) serveTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			for {
+				conn.SetDeadline(time.Now().Add(tcpTimeout))
+				query, err := readTCPMessage(reader)
+				if err != nil {
+					return
+				}
+
+				response := s.handle(query, addrIP(conn.RemoteAddr()), false)
+				if response == nil {
+					return
+				}
+				if err := writeTCPMessage(conn, response); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func addrIP(addr net.Addr) string {
+	host, _, _ := net.SplitHostPort(addr.String())
+	return host
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, length)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	if err := binary.Write(w, binary.BigEndian, uint16(len(msg))); err != nil {
+		return err
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+func (s *Server) handle(query []byte, clientIP string, udp bool) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		logrus.Debugf("Dropping invalid DNS query from %s: %v", clientIP, err)
+		return nil
+	}
+
+	// Answering responses would let them be reflected off us, or two servers
+	// reply to each other forever
+	if header.Response {
+		logrus.Debugf("Dropping DNS response from %s", clientIP)
+		return nil
+	}
+
+	// Only standard queries are answered, NOTIFY and UPDATE are for zones we
+	// don't serve
+	if header.OpCode != 0 {
+		return s.reply(header, nil, nil, dnsmessage.RCodeNotImplemented, udp)
+	}
+
+	question, err := parser.Question()
+	if err != nil {
+		return s.reply(header, nil, nil, dnsmessage.RCodeFormatError, udp)
+	}
+
+	r := newResolver(s.store, s.domain, s.ttl, clientIP)
+	if r != nil {
+		var (
+			answers []dnsmessage.Resource
+			ok      bool
+		)
+		s.store.View(func() {
+			answers, ok = r.answer(question)
+		})
+
+		if ok {
+			logrus.WithFields(logrus.Fields{
+				"client":  clientIP,
+				"answers": len(answers),
+			}).Debugf("DNS type %d %s", question.Type, question.Name)
+			return s.reply(header, &question, answers, dnsmessage.RCodeSuccess, udp)
+		}
+
+		if s.domain != "" && strings.HasSuffix(strings.ToLower(strings.TrimSuffix(question.Name.String(), ".")), "."+s.domain) {
+			return s.reply(header, &question, nil, dnsmessage.RCodeNameError, udp)
+		}
+	}
+
+	response, err := s.forward(query, udp)
+	if err != nil {
+		logrus.Errorf("Failed to forward DNS query for %s: %v", question.Name, err)
+		return s.reply(header, &question, nil, dnsmessage.RCodeServerFailure, udp)
+	}
+	return response
+}
+
+func (s *Server) reply(query dnsmessage.Header, question *dnsmessage.Question, answers []dnsmessage.Resource, rcode dnsmessage.RCode, udp bool) []byte {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.ID,
+			OpCode:             query.OpCode,
+			Response:           true,
+			Authoritative:      rcode == dnsmessage.RCodeSuccess || rcode == dnsmessage.RCodeNameError,
+			RecursionDesired:   query.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Answers: answers,
+	}
+	if question != nil {
+		msg.Questions = []dnsmessage.Question{*question}
+	}
+
+	response, err := msg.Pack()
+	if err == nil && udp && len(response) > maxUDPSize {
+		msg.Header.Truncated = true
+		msg.Answers = nil
+		response, err = msg.Pack()
+	}
+
+	if err != nil {
+		logrus.Errorf("Failed to pack DNS response: %v", err)
+		return nil
+	}
+
+	return response
+}
+
+func (s *Server) forward(query []byte, udp bool) ([]byte, error) {
+	if len(s.upstream) == 0 {
+		return nil, fmt.Errorf("no upstream DNS servers")
+	}
+
+	network := "tcp"
+	if udp {
+		network = "udp"
+	}
+
+	var lastErr error
+	for _, upstream := range s.upstream {
+		response, err := exchange(network, upstream, query)
+		if err == nil {
+			return response, nil
+		}
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+func exchange(network, upstream string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, upstream, forwardTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(forwardTimeout))
+
+	if network == "tcp" {
+		if err := writeTCPMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return readTCPMessage(conn)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
@@ -0,0 +1,350 @@
+package dns
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/metadata/content/memory"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	domain     = "rancher.internal"
+	selfIP     = "10.42.0.1"
+	unknownIP  = "10.42.9.9"
+	upstreamIP = "192.0.2.1"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		logrus.SetOutput(ioutil.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+func object(infoType, id, name string, fields ...interface{}) map[string]interface{} {
+	obj := map[string]interface{}{
+		"infoType":        infoType,
+		"infoTypeId":      id,
+		"uuid":            infoType + "-" + id,
+		"name":            name,
+		"environmentUuid": "env-1",
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		obj[fields[i].(string)] = fields[i+1]
+	}
+	return obj
+}
+
+func container(id, name, stackID, serviceID, ip string, fields ...interface{}) map[string]interface{} {
+	return object("instance", id, name, append([]interface{}{
+		"stackId", stackID, "serviceId", serviceID, "primaryIp", ip, "state", "running",
+	}, fields...)...)
+}
+
+func port(instanceID string, privatePort int, protocol string) map[string]interface{} {
+	return map[string]interface{}{
+		"instanceId":  instanceID,
+		"privatePort": privatePort,
+		"protocol":    protocol,
+	}
+}
+
+// newTestServer serves a stack "web" with a service "nginx" of two running
+// containers and a stopped one, a service "big" of too many containers for a
+// UDP response and an external service, and a stack "db" with a service
+// "mysql" that has a VIP.  The client at selfIP is a container of "web" that
+// links to "db/mysql-1" as "database".
+func newTestServer(t *testing.T, upstream ...string) *Server {
+	store := memory.NewMemoryStore()
+	add := func(obj map[string]interface{}) {
+		if err := store.Add(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	add(map[string]interface{}{
+		"infoType":   "environment",
+		"infoTypeId": "1",
+		"uuid":       "env-1",
+		"name":       "Default",
+		"system":     true,
+	})
+	add(object("stack", "30", "web"))
+	add(object("stack", "31", "db"))
+	add(object("service", "40", "nginx",
+		"stackId", "30",
+		"instanceIds", []interface{}{"50", "51", "54"},
+		"fqdn", "nginx.web.example.com.",
+		"ports", []interface{}{port("50", 80, "tcp"), port("51", 80, "tcp"), port("50", 53, "udp")}))
+	add(object("service", "41", "mysql", "stackId", "31", "instanceIds", []interface{}{"53"}, "vip", "10.43.0.41"))
+	add(object("service", "42", "external", "stackId", "30", "kind", "externalService", "hostname", "example.com"))
+	add(container("50", "nginx-1", "30", "40", "10.42.0.50"))
+	add(container("51", "nginx-2", "30", "40", "10.42.0.51"))
+	add(container("54", "nginx-3", "30", "40", "10.42.0.54", "state", "stopped"))
+	add(container("53", "mysql-1", "31", "41", "10.42.0.53"))
+	add(container("52", "client", "30", "", selfIP,
+		"links", []interface{}{map[string]interface{}{"name": "db/mysql-1", "alias": "database"}}))
+
+	var big []interface{}
+	for i := 0; i < 40; i++ {
+		id := fmt.Sprint(100 + i)
+		add(container(id, "big-"+id, "30", "43", fmt.Sprintf("10.42.1.%d", i)))
+		big = append(big, id)
+	}
+	add(object("service", "43", "big", "stackId", "30", "instanceIds", big))
+
+	s, err := New(store, "127.0.0.1:0", domain, 60, upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// fakeUpstream answers every A query with upstreamIP
+func fakeUpstream(t *testing.T) (string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			var msg dnsmessage.Message
+			if err := msg.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			msg.Header.Response = true
+			msg.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{
+					Name:  msg.Questions[0].Name,
+					Type:  dnsmessage.TypeA,
+					Class: dnsmessage.ClassINET,
+				},
+				Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+			}}
+			response, err := msg.Pack()
+			if err == nil {
+				conn.WriteTo(response, addr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+func query(t *testing.T, header dnsmessage.Header, name string, qtype dnsmessage.Type) []byte {
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := dnsmessage.Message{
+		Header: header,
+		Questions: []dnsmessage.Question{
+			{Name: n, Type: qtype, Class: dnsmessage.ClassINET},
+		},
+	}
+	bytes, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes
+}
+
+func unpack(t *testing.T, response []byte) dnsmessage.Message {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	return msg
+}
+
+// records formats the answers of a response in a sorted, comparable form
+func records(msg dnsmessage.Message) string {
+	var result []string
+	for _, answer := range msg.Answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			result = append(result, net.IP(body.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			result = append(result, net.IP(body.AAAA[:]).String())
+		case *dnsmessage.CNAMEResource:
+			result = append(result, "CNAME "+body.CNAME.String())
+		case *dnsmessage.PTRResource:
+			result = append(result, "PTR "+body.PTR.String())
+		case *dnsmessage.SRVResource:
+			result = append(result, fmt.Sprintf("SRV %d %s", body.Port, body.Target))
+		default:
+			result = append(result, fmt.Sprintf("%T", body))
+		}
+	}
+	sort.Strings(result)
+	return strings.Join(result, ",")
+}
+
+func TestAnswers(t *testing.T) {
+	upstream, stop := fakeUpstream(t)
+	defer stop()
+	s := newTestServer(t, upstream)
+
+	tests := []struct {
+		client  string
+		name    string
+		qtype   dnsmessage.Type
+		rcode   dnsmessage.RCode
+		records string
+	}{
+		// Names relative to the client's stack, to the environment and FQDNs
+		{selfIP, "nginx.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, "10.42.0.50,10.42.0.51"},
+		{selfIP, "nginx.web.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, "10.42.0.50,10.42.0.51"},
+		{selfIP, "nginx.web.rancher.internal.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, "10.42.0.50,10.42.0.51"},
+		{selfIP, "NGINX.Web.Rancher.Internal.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, "10.42.0.50,10.42.0.51"},
+		{selfIP, "nginx.rancher.internal.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, "10.42.0.50,10.42.0.51"},
+		{selfIP, "nginx.web.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, "10.42.0.50,10.42.0.51"},
+		{selfIP, "nginx-1.web.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, "10.42.0.50"},
+		{selfIP, "mysql.db.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, "10.43.0.41"},
+		{selfIP, "database.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, "10.42.0.53"},
+		{selfIP, "external.web.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, "CNAME example.com."},
+
+		// Known names without records of the type
+		{selfIP, "nginx.web.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, ""},
+		{selfIP, "nginx.web.", dnsmessage.TypeTXT, dnsmessage.RCodeSuccess, ""},
+
+		{selfIP, "_http._tcp.nginx.web.", dnsmessage.TypeSRV, dnsmessage.RCodeSuccess,
+			"SRV 80 nginx-1.web.rancher.internal.,SRV 80 nginx-2.web.rancher.internal."},
+		{selfIP, "_dns._udp.nginx.web.", dnsmessage.TypeSRV, dnsmessage.RCodeSuccess, "SRV 53 nginx-1.web.rancher.internal."},
+		{selfIP, "nginx.web.", dnsmessage.TypeSRV, dnsmessage.RCodeSuccess,
+			"SRV 53 nginx-1.web.rancher.internal.,SRV 80 nginx-1.web.rancher.internal.,SRV 80 nginx-2.web.rancher.internal."},
+
+		{selfIP, "50.0.42.10.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, "PTR nginx-1.web.rancher.internal."},
+		{selfIP, "41.0.43.10.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, "PTR mysql.db.rancher.internal."},
+
+		// Unknown names in the domain don't exist, others are forwarded
+		{selfIP, "missing.web.rancher.internal.", dnsmessage.TypeA, dnsmessage.RCodeNameError, ""},
+		{selfIP, "missing.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, upstreamIP},
+		{selfIP, "example.org.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, upstreamIP},
+		{selfIP, "99.0.42.10.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, upstreamIP},
+
+		// Clients that are not containers have no stack to resolve short
+		// names in
+		{unknownIP, "nginx.web.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, "10.42.0.50,10.42.0.51"},
+		{unknownIP, "nginx.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, upstreamIP},
+		{unknownIP, "database.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, upstreamIP},
+	}
+
+	for _, test := range tests {
+		header := dnsmessage.Header{ID: 42, RecursionDesired: true}
+		response := s.handle(query(t, header, test.name, test.qtype), test.client, true)
+		if response == nil {
+			t.Errorf("%s %s: no response", test.client, test.name)
+			continue
+		}
+
+		msg := unpack(t, response)
+		if msg.Header.ID != 42 || !msg.Header.Response || msg.Header.RCode != test.rcode {
+			t.Errorf("%s %s: expected rcode %d, got %+v", test.client, test.name, test.rcode, msg.Header)
+		}
+		if actual := records(msg); actual != test.records {
+			t.Errorf("%s %s: expected %q, got %q", test.client, test.name, test.records, actual)
+		}
+	}
+}
+
+func TestQueryHeader(t *testing.T) {
+	s := newTestServer(t, "127.0.0.1:1")
+
+	response := s.handle(query(t, dnsmessage.Header{ID: 1, OpCode: 4}, "nginx.web.", dnsmessage.TypeA), selfIP, true)
+	if msg := unpack(t, response); msg.Header.RCode != dnsmessage.RCodeNotImplemented || msg.Header.OpCode != 4 {
+		t.Errorf("Expected NOTIMP for a NOTIFY, got %+v", msg.Header)
+	}
+
+	if response := s.handle(query(t, dnsmessage.Header{ID: 1, Response: true}, "nginx.web.", dnsmessage.TypeA), selfIP, true); response != nil {
+		t.Errorf("Expected responses to be dropped, got %v", response)
+	}
+
+	if response := s.handle([]byte{0, 1, 2}, selfIP, true); response != nil {
+		t.Errorf("Expected invalid queries to be dropped, got %v", response)
+	}
+}
+
+func TestUDPTruncation(t *testing.T) {
+	s := newTestServer(t, "127.0.0.1:1")
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go s.serveUDP(conn)
+
+	udp, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	udp.SetDeadline(time.Now().Add(5 * time.Second))
+
+	buf := make([]byte, 65535)
+	for _, test := range []struct {
+		name      string
+		truncated bool
+		answers   int
+	}{
+		{"nginx.web.", false, 2},
+		{"big.web.", true, 0},
+	} {
+		if _, err := udp.Write(query(t, dnsmessage.Header{ID: 7}, test.name, dnsmessage.TypeA)); err != nil {
+			t.Fatal(err)
+		}
+		n, err := udp.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > maxUDPSize {
+			t.Errorf("%s: expected at most %d bytes over UDP, got %d", test.name, maxUDPSize, n)
+		}
+
+		msg := unpack(t, buf[:n])
+		if msg.Header.Truncated != test.truncated || len(msg.Answers) != test.answers {
+			t.Errorf("%s: expected truncated %v with %d answers, got %v with %d", test.name, test.truncated, test.answers, msg.Header.Truncated, len(msg.Answers))
+		}
+	}
+
+	// The client retries over TCP and gets every record
+	msg := unpack(t, s.handle(query(t, dnsmessage.Header{ID: 7}, "big.web.", dnsmessage.TypeA), "127.0.0.1", false))
+	if msg.Header.Truncated || len(msg.Answers) != 40 {
+		t.Errorf("Expected 40 answers over TCP, got truncated %v with %d", msg.Header.Truncated, len(msg.Answers))
+	}
+}
+
+func TestParseReverse(t *testing.T) {
+	tests := map[string]string{
+		"4.3.2.1.in-addr.arpa": "1.2.3.4",
+		"3.2.1.in-addr.arpa":   "<nil>",
+		"x.3.2.1.in-addr.arpa": "<nil>",
+		"b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa": "4321:0:1:2:3:4:567:89ab",
+		"b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.ip6.arpa":   "<nil>",
+		"example.com": "<nil>",
+	}
+	for name, expected := range tests {
+		if actual := parseReverse(name).String(); actual != expected {
+			t.Errorf("%s: expected %s, got %s", name, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/rancher/metadata/client"
+	"gopkg.in/yaml.v2"
+)
+
+func getMain(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return cli.NewExitError("Exactly one metadata path is required", 2)
+	}
+	path := strings.Trim(ctx.Args()[0], "/")
+
+	if ctx.Bool("json") && ctx.Bool("yaml") {
+		return cli.NewExitError("Only one of --json and --yaml can be set", 2)
+	}
+
+	maxWait := time.Duration(ctx.Int("max-wait")) * time.Second
+	c := client.New(strings.TrimRight(ctx.String("server"), "/") + "/" + ctx.String("api-version"))
+	c.SetMaxWait(maxWait)
+
+	if ctx.Bool("wait") {
+		waitChanged(c, path, maxWait)
+	}
+
+	output, err := getOutput(c, path, ctx.Bool("json"), ctx.Bool("yaml"), ctx.Bool("recursive"))
+	if err == client.ErrNotFound {
+		return cli.NewExitError(fmt.Sprintf("Not found: %s", path), 1)
+	} else if err != nil {
+		return cli.NewExitError(err.Error(), 2)
+	}
+
+	if !strings.HasSuffix(output, "\n") {
+		output += "\n"
+	}
+	fmt.Fprint(os.Stdout, output)
+	return nil
+}
+
+// waitChanged blocks until the value of path changes, or appears if it does
+// not exist yet, or maxWait passes
+func waitChanged(c *client.Client, path string, maxWait time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), maxWait)
+	defer cancel()
+
+	values := c.Watch(ctx, path)
+	if _, ok := <-values; ok {
+		<-values
+	}
+}
+
+func getOutput(c *client.Client, path string, asJSON, asYAML, recursive bool) (string, error) {
+	if !asJSON && !asYAML && !recursive {
+		return c.GetValue(path)
+	}
+
+	var value interface{}
+	if err := c.GetJSON(path, &value); err != nil {
+		return "", err
+	}
+
+	switch {
+	case asJSON:
+		bytes, err := json.MarshalIndent(value, "", "  ")
+		return string(bytes), err
+	case asYAML:
+		bytes, err := yaml.Marshal(value)
+		return string(bytes), err
+	}
+
+	var lines []string
+	flatten("", value, &lines)
+	return strings.Join(lines, "\n"), nil
+}
+
+// flatten adds a key=value line for every scalar below value, keys are the
+// metadata paths relative to the requested one
+func flatten(prefix string, value interface{}, lines *[]string) {
+	join := func(key string) string {
+		if prefix == "" {
+			return key
+		}
+		return prefix + "/" + key
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			flatten(join(key), v[key], lines)
+		}
+	case []interface{}:
+		for i, item := range v {
+			flatten(join(fmt.Sprint(i)), item, lines)
+		}
+	default:
+		s := ""
+		switch v := v.(type) {
+		case nil:
+		case float64:
+			s = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			s = fmt.Sprint(v)
+		}
+
+		if prefix == "" {
+			*lines = append(*lines, s)
+		} else {
+			*lines = append(*lines, prefix+"="+s)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package graph
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/rancher/go-rancher/v3"
+	"github.com/rancher/metadata/content"
+	"github.com/rancher/metadata/types/convert"
+)
+
+const (
+	LinkEdge     = "link"
+	LBTargetEdge = "lb_target"
+)
+
+type Node struct {
+	UUID            string             `json:"uuid"`
+	Type            content.ObjectType `json:"type"`
+	Name            string             `json:"name"`
+	StackName       string             `json:"stack_name"`
+	EnvironmentUUID string             `json:"environment_uuid"`
+}
+
+type Edge struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Kind  string `json:"kind"`
+	Alias string `json:"alias,omitempty"`
+}
+
+type Graph struct {
+	Nodes []Node `json:"nodes"`
+	Edges []Edge `json:"edges"`
+}
+
+type builder struct {
+	store           content.Store
+	environmentUUID string
+	stackName       string
+	nodes           map[string]Node
+	edges           map[Edge]bool
+}
+
+// Build returns the dependency graph formed by links and load balancer rules.
+// If environmentUUID is not empty only that environment is included, and if
+// stackName is not empty only edges starting or ending in that stack are kept.
+// Links that do not resolve are left out.
+func Build(store content.Store, environmentUUID, stackName string) *Graph {
+	b := &builder{
+		store:           store,
+		environmentUUID: environmentUUID,
+		stackName:       stackName,
+		nodes:           map[string]Node{},
+		edges:           map[Edge]bool{},
+	}
+
+	store.View(func() {
+		for _, obj := range store.All(content.ServiceType) {
+			b.addService(obj.(*client.ServiceInfo))
+		}
+		for _, obj := range store.All(content.ContainerType) {
+			b.addContainer(obj.(*client.InstanceInfo))
+		}
+	})
+
+	return b.graph()
+}
+
+func (b *builder) stackOf(stackID string) string {
+	if stack := b.store.StackByID(stackID); stack != nil {
+		return stack.Name
+	}
+	return ""
+}
+
+func (b *builder) serviceNode(service *client.ServiceInfo) Node {
+	return Node{
+		UUID:            service.Uuid,
+		Type:            content.ServiceType,
+		Name:            service.Name,
+		StackName:       b.stackOf(service.StackId),
+		EnvironmentUUID: service.EnvironmentUuid,
+	}
+}
+
+func (b *builder) containerNode(container *client.InstanceInfo) Node {
+	return Node{
+		UUID:            container.Uuid,
+		Type:            content.ContainerType,
+		Name:            container.Name,
+		StackName:       b.stackOf(container.StackId),
+		EnvironmentUUID: container.EnvironmentUuid,
+	}
+}
+
+func (b *builder) inStack(node Node) bool {
+	return b.stackName == "" || strings.EqualFold(node.StackName, b.stackName)
+}
+
+func (b *builder) addEdge(from, to Node, kind, alias string) {
+	if !b.inStack(from) && !b.inStack(to) {
+		return
+	}
+
+	b.nodes[from.UUID] = from
+	b.nodes[to.UUID] = to
+	b.edges[Edge{
+		From:  from.UUID,
+		To:    to.UUID,
+		Kind:  kind,
+		Alias: alias,
+	}] = true
+}
+
+func (b *builder) addService(service *client.ServiceInfo) {
+	if b.environmentUUID != "" && service.EnvironmentUuid != b.environmentUUID {
+		return
+	}
+
+	from := b.serviceNode(service)
+	if b.inStack(from) {
+		b.nodes[from.UUID] = from
+	}
+
+	for _, link := range service.Links {
+		alias := link.Alias
+		if alias == "" {
+			alias = link.Name
+		}
+
+		stackName, serviceName := convert.LinkTarget(from.StackName, link.Name)
+		target := b.store.ServiceByName(service.EnvironmentUuid, stackName, serviceName)
+		if target != nil {
+			b.addEdge(from, b.serviceNode(target), LinkEdge, alias)
+		}
+	}
+
+	if service.LbConfig == nil {
+		return
+	}
+
+	for _, rule := range service.LbConfig.PortRules {
+		if rule.ServiceId != "" {
+			if target := b.store.ServiceByID(rule.ServiceId); target != nil {
+				b.addEdge(from, b.serviceNode(target), LBTargetEdge, "")
+			}
+		}
+		if rule.InstanceId != "" {
+			if target := b.store.ContainerByID(rule.InstanceId); target != nil {
+				b.addEdge(from, b.containerNode(target), LBTargetEdge, "")
+			}
+		}
+	}
+}
+
+func (b *builder) addContainer(container *client.InstanceInfo) {
+	if b.environmentUUID != "" && container.EnvironmentUuid != b.environmentUUID {
+		return
+	}
+
+	from := b.containerNode(container)
+	for _, link := range container.Links {
+		alias := link.Alias
+		if alias == "" {
+			alias = link.Name
+		}
+
+		stackName, containerName := convert.LinkTarget(from.StackName, link.Name)
+		target := b.store.ContainerByName(container.EnvironmentUuid, stackName, containerName)
+		if target != nil {
+			b.addEdge(from, b.containerNode(target), LinkEdge, alias)
+		}
+	}
+}
+
+func (b *builder) graph() *Graph {
+	g := &Graph{
+		Nodes: []Node{},
+		Edges: []Edge{},
+	}
+
+	for _, node := range b.nodes {
+		g.Nodes = append(g.Nodes, node)
+	}
+	for edge := range b.edges {
+		g.Edges = append(g.Edges, edge)
+	}
+
+	sort.Slice(g.Nodes, func(i, j int) bool {
+		left, right := g.Nodes[i], g.Nodes[j]
+		if left.StackName != right.StackName {
+			return left.StackName < right.StackName
+		}
+		if left.Name != right.Name {
+			return left.Name < right.Name
+		}
+		return left.UUID < right.UUID
+	})
+
+	sort.Slice(g.Edges, func(i, j int) bool {
+		left, right := g.Edges[i], g.Edges[j]
+		if left.From != right.From {
+			return left.From < right.From
+		}
+		if left.To != right.To {
+			return left.To < right.To
+		}
+		if left.Kind != right.Kind {
+			return left.Kind < right.Kind
+		}
+		return left.Alias < right.Alias
+	})
+
+	return g
+}
+
+// WriteDOT writes the graph in Graphviz DOT format, grouping nodes by stack
+func (g *Graph) WriteDOT(w io.Writer) error {
+	var lines []string
+	add := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+
+	add("digraph metadata {")
+
+	stacks := map[string][]Node{}
+	var stackNames []string
+	for _, node := range g.Nodes {
+		if _, ok := stacks[node.StackName]; !ok {
+			stackNames = append(stackNames, node.StackName)
+		}
+		stacks[node.StackName] = append(stacks[node.StackName], node)
+	}
+
+	for i, stackName := range stackNames {
+		indent := "\t"
+		if stackName != "" {
+			add("\tsubgraph cluster_%d {", i)
+			add("\t\tlabel=%q;", stackName)
+			indent = "\t\t"
+		}
+
+		for _, node := range stacks[stackName] {
+			shape := "box"
+			if node.Type == content.ContainerType {
+				shape = "ellipse"
+			}
+			add("%s%q [label=%q, shape=%s];", indent, node.UUID, node.Name, shape)
+		}
+
+		if stackName != "" {
+			add("\t}")
+		}
+	}
+
+	for _, edge := range g.Edges {
+		label := edge.Alias
+		style := "solid"
+		if edge.Kind == LBTargetEdge {
+			label = "lb"
+			style = "dashed"
+		}
+		add("\t%q -> %q [label=%q, style=%s];", edge.From, edge.To, label, style)
+	}
+
+	add("}")
+
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
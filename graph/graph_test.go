@@ -0,0 +1,229 @@
+package graph
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/rancher/metadata/content"
+	"github.com/rancher/metadata/content/memory"
+)
+
+func object(infoType, id, name string, fields map[string]interface{}) map[string]interface{} {
+	obj := map[string]interface{}{
+		"infoType":        infoType,
+		"infoTypeId":      id,
+		"uuid":            infoType + "-" + id,
+		"name":            name,
+		"environmentUuid": "env-1",
+	}
+	for key, value := range fields {
+		obj[key] = value
+	}
+	return obj
+}
+
+func link(name, alias string) map[string]interface{} {
+	return map[string]interface{}{
+		"name":  name,
+		"alias": alias,
+	}
+}
+
+func newStore(t *testing.T) content.Store {
+	store := memory.NewMemoryStore()
+	for _, obj := range []map[string]interface{}{
+		object("stack", "1", "web", nil),
+		object("stack", "2", "db", nil),
+		object("service", "1", "nginx", map[string]interface{}{
+			"stackId": "1",
+			"links":   []interface{}{link("db/mysql", "database"), link("missing", "")},
+		}),
+		object("service", "2", "mysql", map[string]interface{}{
+			"stackId": "2",
+		}),
+		object("service", "3", "cache", map[string]interface{}{
+			"stackId": "2",
+		}),
+		object("service", "4", "lb", map[string]interface{}{
+			"lbConfig": map[string]interface{}{
+				"portRules": []interface{}{
+					map[string]interface{}{"serviceId": "1"},
+					map[string]interface{}{"instanceId": "1"},
+					map[string]interface{}{"serviceId": "99"},
+				},
+			},
+		}),
+		object("instance", "1", "nginx-1", map[string]interface{}{
+			"stackId": "1",
+			"links":   []interface{}{link("db/mysql-1", "")},
+		}),
+		object("instance", "2", "mysql-1", map[string]interface{}{
+			"stackId": "2",
+		}),
+		object("service", "5", "other", map[string]interface{}{
+			"environmentUuid": "env-2",
+			"links":           []interface{}{link("lb", "")},
+		}),
+	} {
+		if err := store.Add(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestBuildJSON(t *testing.T) {
+	g := Build(newStore(t), "env-1", "")
+
+	actual, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{
+  "nodes": [
+    {
+      "uuid": "service-4",
+      "type": "service",
+      "name": "lb",
+      "stack_name": "",
+      "environment_uuid": "env-1"
+    },
+    {
+      "uuid": "service-3",
+      "type": "service",
+      "name": "cache",
+      "stack_name": "db",
+      "environment_uuid": "env-1"
+    },
+    {
+      "uuid": "service-2",
+      "type": "service",
+      "name": "mysql",
+      "stack_name": "db",
+      "environment_uuid": "env-1"
+    },
+    {
+      "uuid": "instance-2",
+      "type": "instance",
+      "name": "mysql-1",
+      "stack_name": "db",
+      "environment_uuid": "env-1"
+    },
+    {
+      "uuid": "service-1",
+      "type": "service",
+      "name": "nginx",
+      "stack_name": "web",
+      "environment_uuid": "env-1"
+    },
+    {
+      "uuid": "instance-1",
+      "type": "instance",
+      "name": "nginx-1",
+      "stack_name": "web",
+      "environment_uuid": "env-1"
+    }
+  ],
+  "edges": [
+    {
+      "from": "instance-1",
+      "to": "instance-2",
+      "kind": "link",
+      "alias": "db/mysql-1"
+    },
+    {
+      "from": "service-1",
+      "to": "service-2",
+      "kind": "link",
+      "alias": "database"
+    },
+    {
+      "from": "service-4",
+      "to": "instance-1",
+      "kind": "lb_target"
+    },
+    {
+      "from": "service-4",
+      "to": "service-1",
+      "kind": "lb_target"
+    }
+  ]
+}`
+	if string(actual) != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, actual)
+	}
+}
+
+func TestWriteDOT(t *testing.T) {
+	g := Build(newStore(t), "env-1", "db")
+
+	buf := &bytes.Buffer{}
+	if err := g.WriteDOT(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the links into the db stack are kept, and cache which is in it
+	expected := strings.Join([]string{
+		`digraph metadata {`,
+		`	subgraph cluster_0 {`,
+		`		label="db";`,
+		`		"service-3" [label="cache", shape=box];`,
+		`		"service-2" [label="mysql", shape=box];`,
+		`		"instance-2" [label="mysql-1", shape=ellipse];`,
+		`	}`,
+		`	subgraph cluster_1 {`,
+		`		label="web";`,
+		`		"service-1" [label="nginx", shape=box];`,
+		`		"instance-1" [label="nginx-1", shape=ellipse];`,
+		`	}`,
+		`	"instance-1" -> "instance-2" [label="db/mysql-1", style=solid];`,
+		`	"service-1" -> "service-2" [label="database", style=solid];`,
+		`}`,
+	}, "\n") + "\n"
+	if buf.String() != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, buf.String())
+	}
+}
+
+func TestWriteDOTWithoutStack(t *testing.T) {
+	g := &Graph{
+		Nodes: []Node{
+			{UUID: "service-4", Type: content.ServiceType, Name: `lb "public"`},
+			{UUID: "service-1", Type: content.ServiceType, Name: "nginx", StackName: "web"},
+		},
+		Edges: []Edge{
+			{From: "service-4", To: "service-1", Kind: LBTargetEdge},
+		},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := g.WriteDOT(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := strings.Join([]string{
+		`digraph metadata {`,
+		`	"service-4" [label="lb \"public\"", shape=box];`,
+		`	subgraph cluster_1 {`,
+		`		label="web";`,
+		`		"service-1" [label="nginx", shape=box];`,
+		`	}`,
+		`	"service-4" -> "service-1" [label="lb", style=dashed];`,
+		`}`,
+	}, "\n") + "\n"
+	if buf.String() != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, buf.String())
+	}
+}
+
+func TestBuildEnvironment(t *testing.T) {
+	g := Build(newStore(t), "env-2", "")
+
+	// The link of other does not resolve in its environment
+	if len(g.Nodes) != 1 || g.Nodes[0].UUID != "service-5" || len(g.Edges) != 0 {
+		t.Errorf("Expected only the service of env-2, got %+v", g)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/codegangsta/cli"
+	"github.com/rancher/metadata/subscriber"
+)
+
+var dataKeyFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "data-key",
+		EnvVar: "METADATA_DATA_KEY",
+		Usage:  "Base64 encoded AES key to encrypt the persisted content with",
+	},
+	cli.StringFlag{
+		Name:  "data-key-file",
+		Usage: "File holding the base64 encoded AES key to encrypt the persisted content with",
+	},
+	cli.StringSliceFlag{
+		Name:  "data-previous-key-file",
+		Usage: "File holding an earlier base64 encoded AES key, content encrypted with it is encrypted again with the current key, may be repeated",
+	},
+}
+
+// dataFlags returns the flags of commands reading the persisted content
+func dataFlags(flags ...cli.Flag) []cli.Flag {
+	return append(append([]cli.Flag{dataDirFlag}, dataKeyFlags...), flags...)
+}
+
+// dataKeys returns the keys of the persisted content, or nil if it is not
+// encrypted
+func dataKeys(key, keyFile string, previousKeyFiles []string) (*subscriber.Keys, error) {
+	if key != "" && keyFile != "" {
+		return nil, fmt.Errorf("Only one of --data-key and --data-key-file can be set")
+	}
+
+	current := []byte(key)
+	if keyFile != "" {
+		var err error
+		if current, err = ioutil.ReadFile(keyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(current) == 0 {
+		if len(previousKeyFiles) > 0 {
+			return nil, fmt.Errorf("--data-previous-key-file requires a current key")
+		}
+		return nil, nil
+	}
+
+	current, err := subscriber.ParseKey(current)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid data key: %v", err)
+	}
+
+	var previous [][]byte
+	for _, file := range previousKeyFiles {
+		bytes, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := subscriber.ParseKey(bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid data key in %s: %v", file, err)
+		}
+		previous = append(previous, key)
+	}
+
+	return subscriber.NewKeys(current, previous...)
+}
+
+func commandDataKeys(ctx *cli.Context) (*subscriber.Keys, error) {
+	keys, err := dataKeys(ctx.String("data-key"), ctx.String("data-key-file"), ctx.StringSlice("data-previous-key-file"))
+	if err != nil {
+		return nil, cli.NewExitError(err.Error(), 2)
+	}
+	return keys, nil
+}
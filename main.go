@@ -1,7 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"path"
+	"strconv"
 
 	"context"
 
@@ -10,8 +13,12 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/rancher/go-rancher/v3"
 	"github.com/rancher/metadata/content"
+	"github.com/rancher/metadata/content/bolt"
+	"github.com/rancher/metadata/content/memory"
+	"github.com/rancher/metadata/dns"
 	"github.com/rancher/metadata/k8sproxy"
 	"github.com/rancher/metadata/server"
+	"github.com/rancher/metadata/subscriber"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -30,12 +37,18 @@ type ServerConfig struct {
 	reloadChan chan os.Signal
 }
 
+var dataDirFlag = cli.StringFlag{
+	Name:  "data-dir",
+	Value: "./metadata-content",
+	Usage: "Directory of the persisted metadata content",
+}
+
 func main() {
 
 	app := cli.NewApp()
 	app.Action = appMain
 	app.Version = VERSION
-	app.Flags = []cli.Flag{
+	app.Flags = append([]cli.Flag{
 		cli.BoolFlag{
 			Name:  "debug",
 			Usage: "Debug",
@@ -73,6 +86,53 @@ func main() {
 			Value: "/etc/kubernetes/ssl/key.pem",
 			Usage: "Private key for k8s proxy",
 		},
+		cli.BoolFlag{
+			Name:  "dns",
+			Usage: "Answer DNS queries for names in the metadata",
+		},
+		cli.StringFlag{
+			Name:  "dns-listen",
+			Value: "169.254.169.250:53",
+			Usage: "Address to listen to for DNS (UDP and TCP)",
+		},
+		cli.StringFlag{
+			Name:  "dns-domain",
+			Value: "rancher.internal",
+			Usage: "Domain suffix of the names answered from the metadata",
+		},
+		cli.StringSliceFlag{
+			Name:  "dns-upstream",
+			Usage: "DNS server to forward other names to, defaults to the servers in /etc/resolv.conf",
+		},
+		cli.IntFlag{
+			Name:  "dns-ttl",
+			Value: 1,
+			Usage: "TTL in seconds of the DNS answers from the metadata",
+		},
+		cli.BoolFlag{
+			Name:  "strict-sync",
+			Usage: "Reject syncs containing objects that fail validation instead of serving them partially decoded",
+		},
+		dataDirFlag,
+		cli.StringFlag{
+			Name:  "store",
+			Value: "memory",
+			Usage: "Where to keep the metadata content: memory, or bolt for a database in the data directory that also persists it",
+		},
+		cli.StringFlag{
+			Name:  "persistence",
+			Value: "snapshot",
+			Usage: "How to persist the metadata content: none, files or snapshot",
+		},
+		cli.StringFlag{
+			Name:  "data-file-mode",
+			Value: "0600",
+			Usage: "Permissions of the persisted files in octal, directories also get execute permission where they are readable",
+		},
+		cli.StringFlag{
+			Name:  "record",
+			Usage: "Append every sync event received to this file, for the replay command, encrypted with the data key if one is set",
+		},
 		cli.StringFlag{
 			Name:   "access-key",
 			EnvVar: "CATTLE_ACCESS_KEY",
@@ -93,6 +153,175 @@ func main() {
 			Value: "",
 			Usage: "Log file",
 		},
+	}, dataKeyFlags...)
+
+	app.Commands = []cli.Command{
+		{
+			Name:      "check",
+			Usage:     "Report dangling references in the persisted metadata content",
+			ArgsUsage: "[environment uuid]",
+			Action:    checkMain,
+			Flags: dataFlags(
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the report as JSON",
+				},
+			),
+		},
+		{
+			Name:   "render",
+			Usage:  "Render local templates from metadata and reload on changes",
+			Action: renderMain,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "server",
+					Value: "http://169.254.169.250:9346",
+					Usage: "URL of the metadata server",
+				},
+				cli.StringFlag{
+					Name:  "api-version",
+					Value: "latest",
+					Usage: "Metadata API version",
+				},
+				cli.StringSliceFlag{
+					Name:  "template",
+					Usage: "Template to render as src:dest, may be repeated",
+				},
+				cli.StringSliceFlag{
+					Name:  "watch",
+					Usage: "Metadata path to watch for changes, may be repeated, defaults to version",
+				},
+				cli.IntFlag{
+					Name:  "max-wait",
+					Value: 60,
+					Usage: "Seconds to wait for a change before polling again",
+				},
+				cli.StringFlag{
+					Name:  "check-cmd",
+					Usage: "Command to validate a rendered file before it is installed, {{.src}} is replaced by its path",
+				},
+				cli.StringFlag{
+					Name:  "reload-cmd",
+					Usage: "Command to run after files have been updated",
+				},
+				cli.BoolFlag{
+					Name:  "onetime",
+					Usage: "Render once and exit",
+				},
+			},
+		},
+		{
+			Name:  "content",
+			Usage: "Inspect the persisted metadata content offline",
+			Subcommands: []cli.Command{
+				{
+					Name:   "ls",
+					Usage:  "List the persisted objects by type",
+					Action: contentLsMain,
+					Flags: dataFlags(
+						cli.StringFlag{
+							Name:  "type",
+							Usage: "Only list objects of this type",
+						},
+					),
+				},
+				{
+					Name:      "show",
+					Usage:     "Print a metadata path as JSON as seen by a client",
+					ArgsUsage: "[path]",
+					Action:    contentShowMain,
+					Flags: dataFlags(
+						cli.StringFlag{
+							Name:  "ip",
+							Usage: "IP address of the client",
+						},
+						cli.StringFlag{
+							Name:  "api-version",
+							Value: "latest",
+							Usage: "Metadata API version",
+						},
+					),
+				},
+				{
+					Name:   "verify",
+					Usage:  "Check that the persisted content decodes and its checksums match, exits with 1 if not",
+					Action: contentVerifyMain,
+					Flags:  dataFlags(),
+				},
+				{
+					Name:   "export",
+					Usage:  "Write the persisted objects to a single snapshot file",
+					Action: contentExportMain,
+					Flags: dataFlags(
+						cli.StringFlag{
+							Name:  "output",
+							Usage: "File to write, defaults to stdout",
+						},
+					),
+				},
+			},
+		},
+		{
+			Name:      "get",
+			Usage:     "Print a value from a running metadata server, exits with 1 if it does not exist",
+			ArgsUsage: "<path>",
+			Action:    getMain,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "server",
+					Value: "http://169.254.169.250:9346",
+					Usage: "URL of the metadata server",
+				},
+				cli.StringFlag{
+					Name:  "api-version",
+					Value: "latest",
+					Usage: "Metadata API version",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the value as JSON",
+				},
+				cli.BoolFlag{
+					Name:  "yaml",
+					Usage: "Print the value as YAML",
+				},
+				cli.BoolFlag{
+					Name:  "recursive",
+					Usage: "Print every value below the path as path=value lines",
+				},
+				cli.BoolFlag{
+					Name:  "wait",
+					Usage: "Wait for the value to change, or to appear, before printing it",
+				},
+				cli.IntFlag{
+					Name:  "max-wait",
+					Value: 60,
+					Usage: "Seconds to wait with --wait before printing the current value",
+				},
+			},
+		},
+		{
+			Name:      "replay",
+			Usage:     "Serve the metadata of a recording of sync events as it changed over time",
+			ArgsUsage: "<file>",
+			Action:    replayMain,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "listen",
+					Value: "127.0.0.1:9346",
+					Usage: "Address to listen to (TCP)",
+				},
+				cli.BoolFlag{
+					Name:  "xff",
+					Usage: "X-Forwarded-For header support",
+				},
+				cli.Float64Flag{
+					Name:  "speed",
+					Value: 1,
+					Usage: "Replay this many times faster than recorded, 0 to apply every event at once",
+				},
+			},
+		},
 	}
 
 	app.Run(os.Args)
@@ -118,17 +347,59 @@ func appMain(ctx *cli.Context) error {
 		SecretKey: ctx.GlobalString("secret-key"),
 	}
 
+	mode, err := strconv.ParseUint(ctx.GlobalString("data-file-mode"), 8, 32)
+	if err != nil {
+		return fmt.Errorf("Invalid data file mode %s: %v", ctx.GlobalString("data-file-mode"), err)
+	}
+
+	keys, err := dataKeys(ctx.GlobalString("data-key"),
+		ctx.GlobalString("data-key-file"),
+		ctx.GlobalStringSlice("data-previous-key-file"))
+	if err != nil {
+		return err
+	}
+
+	store, persistence, err := newStore(ctx, os.FileMode(mode), keys)
+	if err != nil {
+		return err
+	}
+
 	s, err := server.New(opts,
 		ctx.GlobalString("listen"),
-		ctx.GlobalBool("xff"))
+		ctx.GlobalBool("xff"),
+		store,
+		persistence,
+		ctx.GlobalBool("strict-sync"))
 
 	if err != nil {
 		return err
 	}
 
+	if file := ctx.GlobalString("record"); file != "" {
+		recorder, err := subscriber.NewRecorder(file, keys)
+		if err != nil {
+			return fmt.Errorf("Failed to record to %s: %v", file, err)
+		}
+		defer recorder.Close()
+		s.SetRecorder(recorder)
+	}
+
 	group, _ := errgroup.WithContext(context.Background())
 	group.Go(s.Start)
 
+	if ctx.GlobalBool("dns") {
+		dnsServer, err := dns.New(s.Store(),
+			ctx.GlobalString("dns-listen"),
+			ctx.GlobalString("dns-domain"),
+			uint32(ctx.GlobalInt("dns-ttl")),
+			ctx.GlobalStringSlice("dns-upstream"))
+		if err != nil {
+			return err
+		}
+
+		group.Go(dnsServer.ListenAndServe)
+	}
+
 	if ctx.GlobalBool("k8s-proxy") {
 		c, err := client.NewRancherClient(opts)
 		if err != nil {
@@ -150,3 +421,33 @@ func appMain(ctx *cli.Context) error {
 	// Start the server
 	return group.Wait()
 }
+
+// newStore returns the store selected with --store and the persistence of its
+// content
+func newStore(ctx *cli.Context, mode os.FileMode, keys *subscriber.Keys) (content.Store, subscriber.Persistence, error) {
+	switch ctx.GlobalString("store") {
+	case "memory":
+		persistence, err := subscriber.NewPersistence(ctx.GlobalString("persistence"),
+			ctx.GlobalString("data-dir"),
+			mode,
+			keys)
+		if err != nil {
+			return nil, nil, err
+		}
+		return memory.NewMemoryStore(), persistence, nil
+	case "bolt":
+		if ctx.GlobalIsSet("persistence") {
+			return nil, nil, fmt.Errorf("The bolt store persists its content itself, --persistence does not apply")
+		}
+		if keys != nil {
+			return nil, nil, fmt.Errorf("The bolt store can not be encrypted with a data key")
+		}
+
+		store, err := bolt.NewBoltStore(path.Join(ctx.GlobalString("data-dir"), "metadata.db"), mode)
+		if err != nil {
+			return nil, nil, err
+		}
+		return store, store, nil
+	}
+	return nil, nil, fmt.Errorf("Unknown store %s, expected memory or bolt", ctx.GlobalString("store"))
+}
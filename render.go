@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"github.com/rancher/metadata/client"
+	"github.com/rancher/metadata/render"
+)
+
+const srcPlaceholder = "{{.src}}"
+
+type templateFile struct {
+	src      string
+	dest     string
+	template *template.Template
+}
+
+type renderer struct {
+	client    *client.Client
+	checkCmd  string
+	reloadCmd string
+	templates []templateFile
+}
+
+func renderMain(ctx *cli.Context) error {
+	r := &renderer{
+		client:    client.New(strings.TrimRight(ctx.String("server"), "/") + "/" + ctx.String("api-version")),
+		checkCmd:  ctx.String("check-cmd"),
+		reloadCmd: ctx.String("reload-cmd"),
+	}
+	r.client.SetMaxWait(time.Duration(ctx.Int("max-wait")) * time.Second)
+
+	if len(ctx.StringSlice("template")) == 0 {
+		return cli.NewExitError("At least one --template src:dest is required", 2)
+	}
+
+	for _, spec := range ctx.StringSlice("template") {
+		parts := strings.SplitN(spec, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return cli.NewExitError(fmt.Sprintf("Invalid template %s, expected src:dest", spec), 2)
+		}
+
+		text, err := ioutil.ReadFile(parts[0])
+		if err != nil {
+			return cli.NewExitError(err.Error(), 2)
+		}
+
+		t, err := render.Parse(filepath.Base(parts[0]), string(text))
+		if err != nil {
+			return cli.NewExitError(err.Error(), 2)
+		}
+
+		r.templates = append(r.templates, templateFile{
+			src:      parts[0],
+			dest:     parts[1],
+			template: t,
+		})
+	}
+
+	if ctx.Bool("onetime") {
+		if err := r.renderAll(); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		return nil
+	}
+
+	watchPaths := ctx.StringSlice("watch")
+	if len(watchPaths) == 0 {
+		watchPaths = []string{"version"}
+	}
+
+	changed := make(chan struct{}, 1)
+	for _, path := range watchPaths {
+		go r.watch(path, changed)
+	}
+
+	for {
+		if err := r.renderAll(); err != nil {
+			logrus.Errorf("Failed to render templates: %v", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		<-changed
+	}
+}
+
+// watch signals changed whenever the value of a metadata path changes.  The
+// first value is signalled too, the path may have changed since the first
+// render and rendering again is harmless when it didn't.
+func (r *renderer) watch(path string, changed chan<- struct{}) {
+	for range r.client.Watch(context.Background(), path) {
+		logrus.Debugf("Change detected in %s", path)
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (r *renderer) renderAll() error {
+	ctx := render.Context{}
+
+	// Read in one batch so that the environment and self are of the same
+	// version of the metadata
+	err := r.client.GetBatch(map[string]interface{}{
+		"":     &ctx.Environment,
+		"self": &ctx.Self,
+	})
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for _, t := range r.templates {
+		updated, err := r.renderFile(t, ctx)
+		if err != nil {
+			return fmt.Errorf("%s: %v", t.src, err)
+		}
+		changed = changed || updated
+	}
+
+	if changed && r.reloadCmd != "" {
+		logrus.Infof("Running %s", r.reloadCmd)
+		if err := runCommand(r.reloadCmd); err != nil {
+			return fmt.Errorf("reload command failed: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// renderFile renders the template and atomically replaces the destination if
+// the content changed and the check command accepts it
+func (r *renderer) renderFile(t templateFile, ctx render.Context) (bool, error) {
+	output, err := render.Execute(t.template, ctx)
+	if err != nil {
+		return false, err
+	}
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(t.dest); err == nil {
+		mode = info.Mode()
+		existing, err := ioutil.ReadFile(t.dest)
+		if err == nil && bytes.Equal(existing, output) {
+			return false, nil
+		}
+	}
+
+	temp, err := ioutil.TempFile(filepath.Dir(t.dest), "."+filepath.Base(t.dest))
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(temp.Name())
+
+	_, err = temp.Write(output)
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(temp.Name(), mode)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if r.checkCmd != "" {
+		cmd := strings.Replace(r.checkCmd, srcPlaceholder, temp.Name(), -1)
+		if err := runCommand(cmd); err != nil {
+			return false, fmt.Errorf("check command failed: %v", err)
+		}
+	}
+
+	if err := os.Rename(temp.Name(), t.dest); err != nil {
+		return false, err
+	}
+
+	logrus.Infof("Updated %s", t.dest)
+	return true, nil
+}
+
+func runCommand(command string) error {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
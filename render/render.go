@@ -0,0 +1,193 @@
+package render
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var (
+	ErrTooLarge = errors.New("output too large")
+	ErrTimeout  = errors.New("took too long")
+)
+
+// Context is the data templates are executed against, the objects are in the
+// same form as the JSON responses of the metadata API
+type Context struct {
+	Self        map[string]interface{}
+	Environment map[string]interface{}
+}
+
+func Parse(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(Funcs()).Parse(text)
+}
+
+func Execute(t *template.Template, ctx Context) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := t.Execute(buf, ctx); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ExecuteLimited is Execute with the output limited to maxSize bytes and the
+// execution to deadline.  Both are checked on every write, so a template that
+// loops without output is only stopped when it writes.
+func ExecuteLimited(t *template.Template, ctx Context, maxSize int, deadline time.Time) ([]byte, error) {
+	w := &limitedWriter{
+		max:      maxSize,
+		deadline: deadline,
+	}
+	if err := t.Execute(w, ctx); err != nil {
+		return nil, err
+	}
+	return w.buf.Bytes(), nil
+}
+
+type limitedWriter struct {
+	buf      bytes.Buffer
+	max      int
+	deadline time.Time
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if w.buf.Len()+len(p) > w.max {
+		return 0, ErrTooLarge
+	}
+	if time.Now().After(w.deadline) {
+		return 0, ErrTimeout
+	}
+	return w.buf.Write(p)
+}
+
+func Checksum(output []byte) string {
+	sum := sha256.Sum256(output)
+	return hex.EncodeToString(sum[:])
+}
+
+func Funcs() template.FuncMap {
+	return template.FuncMap{
+		"withLabel": withLabel,
+		"hasLabel":  hasLabel,
+		"label":     label,
+		"sortBy":    sortBy,
+		"byName":    byName,
+		"join":      join,
+		"split":     strings.Split,
+		"toLower":   strings.ToLower,
+		"toUpper":   strings.ToUpper,
+		"contains":  strings.Contains,
+		"hasPrefix": strings.HasPrefix,
+		"hasSuffix": strings.HasSuffix,
+	}
+}
+
+func objects(items interface{}) []map[string]interface{} {
+	var result []map[string]interface{}
+
+	v := reflect.ValueOf(items)
+	if v.Kind() != reflect.Slice {
+		return result
+	}
+
+	for i := 0; i < v.Len(); i++ {
+		if obj, ok := v.Index(i).Interface().(map[string]interface{}); ok {
+			result = append(result, obj)
+		}
+	}
+
+	return result
+}
+
+func labels(obj interface{}) map[string]interface{} {
+	m, _ := obj.(map[string]interface{})
+	result, _ := m["labels"].(map[string]interface{})
+	return result
+}
+
+// withLabel returns the objects that have the label set to value
+func withLabel(key, value string, items interface{}) []map[string]interface{} {
+	result := []map[string]interface{}{}
+	for _, obj := range objects(items) {
+		if v, ok := labels(obj)[key]; ok && fmt.Sprint(v) == value {
+			result = append(result, obj)
+		}
+	}
+	return result
+}
+
+// hasLabel returns the objects that have the label set to any value
+func hasLabel(key string, items interface{}) []map[string]interface{} {
+	result := []map[string]interface{}{}
+	for _, obj := range objects(items) {
+		if _, ok := labels(obj)[key]; ok {
+			result = append(result, obj)
+		}
+	}
+	return result
+}
+
+func label(key string, obj interface{}) string {
+	v, ok := labels(obj)[key]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// sortBy returns the objects sorted by the value of a field, numbers are
+// compared as numbers and everything else as strings
+func sortBy(field string, items interface{}) []map[string]interface{} {
+	result := objects(items)
+	sort.SliceStable(result, func(i, j int) bool {
+		left, right := result[i][field], result[j][field]
+		leftNum, leftOK := left.(float64)
+		rightNum, rightOK := right.(float64)
+		if leftOK && rightOK {
+			return leftNum < rightNum
+		}
+		return fmt.Sprint(left) < fmt.Sprint(right)
+	})
+	return result
+}
+
+// byName returns the first object with the given name, names of the form
+// stack/name also match the object's stack
+func byName(name string, items interface{}) map[string]interface{} {
+	stackName := ""
+	if parts := strings.SplitN(name, "/", 2); len(parts) == 2 {
+		stackName, name = parts[0], parts[1]
+	}
+
+	for _, obj := range objects(items) {
+		if !strings.EqualFold(fmt.Sprint(obj["name"]), name) {
+			continue
+		}
+		if stackName != "" && !strings.EqualFold(fmt.Sprint(obj["stack_name"]), stackName) {
+			continue
+		}
+		return obj
+	}
+	return nil
+}
+
+func join(sep string, items interface{}) string {
+	var parts []string
+
+	v := reflect.ValueOf(items)
+	if v.Kind() != reflect.Slice {
+		return fmt.Sprint(items)
+	}
+
+	for i := 0; i < v.Len(); i++ {
+		parts = append(parts, fmt.Sprint(v.Index(i).Interface()))
+	}
+	return strings.Join(parts, sep)
+}
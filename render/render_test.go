@@ -0,0 +1,70 @@
+package render
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func testContext() Context {
+	return Context{
+		Self: map[string]interface{}{
+			"name": "client",
+		},
+		Environment: map[string]interface{}{
+			"services": []interface{}{
+				map[string]interface{}{"name": "web", "stack_name": "app", "scale": 3.0,
+					"labels": map[string]interface{}{"lb": "true"}},
+				map[string]interface{}{"name": "db", "stack_name": "app", "scale": 10.0},
+				map[string]interface{}{"name": "web", "stack_name": "other", "scale": 1.0,
+					"labels": map[string]interface{}{"lb": "false"}},
+			},
+		},
+	}
+}
+
+func TestExecute(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{`{{.Self.name}}`, "client"},
+		{`{{range sortBy "scale" .Environment.services}}{{.name}} {{end}}`, "web web db "},
+		{`{{range withLabel "lb" "true" .Environment.services}}{{.stack_name}}{{end}}`, "app"},
+		{`{{len (hasLabel "lb" .Environment.services)}}`, "2"},
+		{`{{(byName "other/WEB" .Environment.services).scale}}`, "1"},
+		{`{{join "," (split "a b" " ")}}`, "a,b"},
+	}
+
+	for _, test := range tests {
+		tmpl, err := Parse("test", test.text)
+		if err != nil {
+			t.Fatalf("%s: %v", test.text, err)
+		}
+		output, err := ExecuteLimited(tmpl, testContext(), 1024, time.Now().Add(time.Minute))
+		if err != nil || string(output) != test.expected {
+			t.Errorf("%s: expected %q, got %q %v", test.text, test.expected, output, err)
+		}
+	}
+}
+
+func TestExecuteLimited(t *testing.T) {
+	tmpl, err := Parse("test", `{{range .Environment.services}}{{.name}}{{end}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if output, err := ExecuteLimited(tmpl, testContext(), len("webdbweb"), time.Now().Add(time.Minute)); err != nil || string(output) != "webdbweb" {
+		t.Errorf("Expected output of the limit to be rendered, got %q %v", output, err)
+	}
+
+	_, err = ExecuteLimited(tmpl, testContext(), len("webdb"), time.Now().Add(time.Minute))
+	if err == nil || !strings.Contains(err.Error(), ErrTooLarge.Error()) {
+		t.Errorf("Expected the output to be too large, got %v", err)
+	}
+
+	_, err = ExecuteLimited(tmpl, testContext(), 1024, time.Now().Add(-time.Second))
+	if err == nil || !strings.Contains(err.Error(), ErrTimeout.Error()) {
+		t.Errorf("Expected the deadline to stop the template, got %v", err)
+	}
+}
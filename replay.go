@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"github.com/rancher/go-rancher/v3"
+	"github.com/rancher/metadata/content/memory"
+	"github.com/rancher/metadata/server"
+	"github.com/rancher/metadata/subscriber"
+)
+
+func replayMain(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return cli.NewExitError("Exactly one recording is required", 2)
+	}
+
+	if ctx.GlobalBool("debug") {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	if ctx.Float64("speed") < 0 {
+		return cli.NewExitError("The speed can not be negative", 2)
+	}
+
+	keys, err := dataKeys(ctx.GlobalString("data-key"),
+		ctx.GlobalString("data-key-file"),
+		ctx.GlobalStringSlice("data-previous-key-file"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 2)
+	}
+
+	f, err := os.Open(ctx.Args()[0])
+	if err != nil {
+		return cli.NewExitError(err.Error(), 2)
+	}
+	defer f.Close()
+
+	persistence, err := subscriber.NewPersistence(subscriber.NoPersistence, "", 0, nil)
+	if err != nil {
+		return err
+	}
+
+	s, err := server.New(&client.ClientOpts{},
+		ctx.String("listen"),
+		ctx.Bool("xff"),
+		memory.NewMemoryStore(),
+		persistence,
+		ctx.GlobalBool("strict-sync"))
+	if err != nil {
+		return err
+	}
+
+	return s.Replay(f, keys, ctx.Float64("speed"))
+}
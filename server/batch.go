@@ -0,0 +1,93 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+const maxBatchSize = 256
+
+type batchResult struct {
+	Value interface{} `json:"value"`
+	Error string      `json:"error,omitempty"`
+}
+
+func (s *Server) batch(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	version := mux.Vars(req)["version"]
+	clientIP := s.requestIP(req)
+
+	var paths []string
+	if err := json.NewDecoder(req.Body).Decode(&paths); err != nil {
+		respondError(w, req, "Invalid batch request, expected a JSON list of paths: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(paths) > maxBatchSize {
+		respondError(w, req, "Too many paths in batch request", http.StatusBadRequest)
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"version": version,
+		"client":  clientIP,
+	}).Debugf("Batch lookup of %d paths", len(paths))
+
+	var (
+		bytes []byte
+		err   error
+	)
+
+	// Objects are rendered lazily when marshalled so the encoding must also
+	// happen inside the view to see the same state as the lookups
+	s.store.View(func() {
+		result := map[string]batchResult{}
+		for _, path := range paths {
+			result[path] = s.batchLookup(version, clientIP, path)
+		}
+		bytes, err = json.Marshal(result)
+	})
+
+	if err != nil {
+		respondError(w, req, "Error serializing to JSON: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+func (s *Server) batchLookup(version, clientIP, path string) batchResult {
+	segments, err := splitPath(path)
+	if err != nil {
+		return batchResult{Error: err.Error()}
+	}
+
+	val, ok := s.getValue(version, clientIP, segments)
+	if !ok {
+		return batchResult{Error: "Not found"}
+	}
+
+	return batchResult{Value: val}
+}
+
+func splitPath(path string) ([]string, error) {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil, nil
+	}
+
+	var err error
+	segments := strings.Split(path, "/")
+	for i := 0; err == nil && i < len(segments); i++ {
+		segments[i], err = url.QueryUnescape(segments[i])
+	}
+
+	return segments, err
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/rancher/metadata/content"
+)
+
+type changesResponse struct {
+	Version string           `json:"version"`
+	Reset   bool             `json:"reset"`
+	Changes []content.Change `json:"changes"`
+}
+
+func (s *Server) changes(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	version := mux.Vars(req)["version"]
+	clientIP := s.requestIP(req)
+	query := req.URL.Query()
+
+	since := 0
+	if sinceParam := query.Get("since"); sinceParam != "" {
+		var err error
+		since, err = strconv.Atoi(sinceParam)
+		if err != nil {
+			respondError(w, req, "Invalid since parameter: "+sinceParam, http.StatusBadRequest)
+			return
+		}
+	}
+
+	wait := query.Get("wait") == "true"
+	maxWait, _ := strconv.Atoi(query.Get("maxWait"))
+
+	if _, ok := content.GetEnvironment(s.store, version, clientIP); !ok {
+		respondError(w, req, "Not found", http.StatusNotFound)
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"version": version,
+		"client":  clientIP,
+		"wait":    wait,
+		"maxWait": maxWait,
+	}).Debugf("Changes since: %d", since)
+
+	respondJSON(w, req, s.lookupChanges(wait, version, clientIP, since, time.Duration(maxWait)*time.Second))
+}
+
+func (s *Server) lookupChanges(wait bool, version, ip string, since int, maxWait time.Duration) changesResponse {
+	c := content.Client{
+		Version: version,
+		IP:      ip,
+	}
+
+	var (
+		changed <-chan struct{}
+		timeout <-chan time.Time
+	)
+	if wait {
+		var cancel func()
+		changed, cancel = s.subscribe(version, ip)
+		defer cancel()
+		timeout = time.After(waitTimeout(maxWait))
+	}
+
+	for {
+		changes, storeVersion, ok := s.store.Changes(c, since)
+		if !ok {
+			return changesResponse{
+				Version: storeVersion,
+				Reset:   true,
+				Changes: []content.Change{},
+			}
+		}
+
+		response := changesResponse{
+			Version: storeVersion,
+			Changes: changes,
+		}
+		if !wait || len(changes) > 0 {
+			return response
+		}
+
+		select {
+		case <-changed:
+		case <-timeout:
+			return response
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/metadata/consistency"
+	"github.com/rancher/metadata/content"
+)
+
+func (s *Server) consistency(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	clientIP := s.requestIP(req)
+	environmentUUID, ok := s.visibleEnvironment(clientIP)
+	if !ok {
+		respondError(w, req, "Not found", http.StatusNotFound)
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"client":      clientIP,
+		"environment": environmentUUID,
+	}).Debug("Checking consistency")
+
+	respondJSON(w, req, consistency.Check(s.store, environmentUUID))
+}
+
+// visibleEnvironment returns the UUID of the only environment the client may
+// see, or an empty string if the client sees all environments.  It is false
+// if the client may see none.
+func (s *Server) visibleEnvironment(clientIP string) (string, bool) {
+	env := content.ClientEnvironment(s.store, content.Client{IP: clientIP})
+	switch {
+	case env == nil:
+		return "", false
+	case env.System:
+		return "", true
+	}
+	return env.Uuid, true
+}
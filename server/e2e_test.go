@@ -0,0 +1,570 @@
+package server_test
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher/v3"
+	"github.com/rancher/metadata/cattletest"
+	metadata "github.com/rancher/metadata/client"
+	"github.com/rancher/metadata/content/memory"
+	"github.com/rancher/metadata/server"
+	"github.com/rancher/metadata/subscriber"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		logrus.SetOutput(ioutil.Discard)
+	}
+	// The formatter sets its default timestamp format on first use, which
+	// races between the goroutines of the server
+	logrus.SetFormatter(&logrus.TextFormatter{
+		TimestampFormat: time.RFC3339,
+	})
+	os.Exit(m.Run())
+}
+
+type e2e struct {
+	t      *testing.T
+	cattle *cattletest.Server
+	url    string
+}
+
+// start runs a metadata server subscribed to a fake Cattle and waits until it
+// answers HTTP requests
+func start(t *testing.T, strict bool) *e2e {
+	cattle := cattletest.NewServer()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen := l.Addr().String()
+	l.Close()
+
+	persistence, err := subscriber.NewPersistence(subscriber.NoPersistence, "", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := server.New(cattle.Opts(), listen, false, memory.NewMemoryStore(), persistence, strict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+
+	if err := cattle.WaitForSubscriber(); err != nil {
+		t.Fatal(err)
+	}
+
+	e := &e2e{
+		t:      t,
+		cattle: cattle,
+		url:    "http://" + listen,
+	}
+
+	deadline := time.Now().Add(cattletest.Timeout)
+	for {
+		resp, err := http.Get(e.url + "/ready")
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Server not listening: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return e
+}
+
+func (e *e2e) close() {
+	e.cattle.Close()
+}
+
+func (e *e2e) sync(request interface{}) map[string]interface{} {
+	reply, err := e.cattle.Sync(request)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return reply
+}
+
+func (e *e2e) get(path string) (int, string) {
+	resp, err := http.Get(e.url + path)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	bytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return resp.StatusCode, strings.TrimSpace(string(bytes))
+}
+
+func (e *e2e) expect(path, expected string) {
+	if code, body := e.get(path); code != http.StatusOK || body != expected {
+		e.t.Errorf("GET %s: expected 200 %q, got %d %q", path, expected, code, body)
+	}
+}
+
+// expectStacks checks the names of the stacks in any order
+func (e *e2e) expectStacks(names ...string) {
+	code, body := e.get("/latest/stacks")
+
+	var actual []string
+	for _, line := range strings.Split(body, "\n") {
+		if i := strings.Index(line, "="); i >= 0 {
+			actual = append(actual, line[i+1:])
+		}
+	}
+	sort.Strings(actual)
+	sort.Strings(names)
+
+	if code != http.StatusOK || strings.Join(actual, ",") != strings.Join(names, ",") {
+		e.t.Errorf("Expected stacks %v, got %d %q", names, code, body)
+	}
+}
+
+func (e *e2e) expectReady(ready bool) {
+	code, body := e.get("/ready")
+	if ready != (code == http.StatusOK) {
+		e.t.Errorf("Expected ready %v, got %d %s", ready, code, body)
+	}
+}
+
+func (e *e2e) expectMetric(name, value string) {
+	_, body := e.get("/metrics")
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, name+" ") {
+			if line != name+" "+value {
+				e.t.Errorf("Expected %s %s, got %s", name, value, line)
+			}
+			return
+		}
+	}
+	e.t.Errorf("Metric %s not found", name)
+}
+
+func expectReload(t *testing.T, reply map[string]interface{}, reload bool) {
+	if reply["reload"] != reload {
+		t.Errorf("Expected reload %v in the reply, got %v", reload, reply)
+	}
+}
+
+func stack(id, name string) map[string]interface{} {
+	return map[string]interface{}{
+		"infoType":        "stack",
+		"infoTypeId":      id,
+		"uuid":            "stack-" + id,
+		"name":            name,
+		"environmentUuid": "env",
+	}
+}
+
+// objects returns an environment with the test client as its only container
+// and the stacks
+func objects(stacks ...map[string]interface{}) map[string]interface{} {
+	objects := map[string]interface{}{
+		"env": map[string]interface{}{
+			"infoType":   "environment",
+			"infoTypeId": "1",
+			"uuid":       "env",
+			"name":       "Default",
+		},
+		"self": map[string]interface{}{
+			"infoType":        "instance",
+			"infoTypeId":      "9",
+			"uuid":            "self",
+			"name":            "client",
+			"primaryIp":       "127.0.0.1",
+			"stackId":         "3",
+			"environmentUuid": "env",
+			"state":           "running",
+		},
+	}
+	for _, stack := range stacks {
+		objects[stack["uuid"].(string)] = stack
+	}
+	return objects
+}
+
+func TestSync(t *testing.T) {
+	e := start(t, false)
+	defer e.close()
+
+	e.expectReady(false)
+
+	reply := e.sync(&client.MetadataSyncRequest{
+		Generation: "g1",
+		Full:       true,
+		Updates:    objects(stack("3", "app")),
+	})
+	expectReload(t, reply, false)
+	if reply["digest"] == nil || reply["digest"] == "" {
+		t.Errorf("Expected a digest in the reply, got %v", reply)
+	}
+
+	e.expectReady(true)
+	e.expect("/latest/self/container/name", "client")
+	e.expect("/latest/self/stack/name", "app")
+	e.expectStacks("app")
+
+	var environment, self map[string]interface{}
+	err := metadata.New(e.url + "/latest").GetBatch(map[string]interface{}{
+		"":     &environment,
+		"self": &self,
+	})
+	if err != nil {
+		t.Fatalf("Batch read failed: %v", err)
+	}
+	if environment["stacks"] == nil || self["container"] == nil {
+		t.Errorf("Expected the environment and self, got %v and %v", environment, self)
+	}
+
+	reply = e.sync(&client.MetadataSyncRequest{
+		Generation: "g1",
+		Updates: map[string]interface{}{
+			"stack-4": stack("4", "db"),
+		},
+	})
+	expectReload(t, reply, false)
+	e.expectStacks("app", "db")
+
+	reply = e.sync(&client.MetadataSyncRequest{
+		Generation: "g1",
+		Removes: map[string]interface{}{
+			"stack-4": stack("4", "db"),
+		},
+	})
+	expectReload(t, reply, false)
+	e.expectStacks("app")
+}
+
+func TestGenerationChange(t *testing.T) {
+	e := start(t, false)
+	defer e.close()
+
+	expectReload(t, e.sync(&client.MetadataSyncRequest{
+		Generation: "g1",
+		Full:       true,
+		Updates:    objects(stack("3", "app")),
+	}), false)
+
+	// An update of a generation the server has not seen is buffered and a
+	// full sync requested
+	reply := e.sync(&client.MetadataSyncRequest{
+		Generation: "g2",
+		Updates: map[string]interface{}{
+			"stack-4": stack("4", "db"),
+		},
+	})
+	expectReload(t, reply, true)
+	e.expectReady(false)
+	e.expectStacks("app")
+	e.expectMetric("metadata_buffered_syncs", "1")
+
+	// Updates of another generation received meanwhile are dropped
+	reply = e.sync(&client.MetadataSyncRequest{
+		Generation: "g3",
+		Updates: map[string]interface{}{
+			"stack-5": stack("5", "other"),
+		},
+	})
+	expectReload(t, reply, true)
+	e.expectMetric("metadata_buffered_syncs", "2")
+
+	// The buffered update of the generation of the full sync is applied
+	// after it
+	reply = e.sync(&client.MetadataSyncRequest{
+		Generation: "g2",
+		Full:       true,
+		Updates:    objects(stack("3", "web")),
+	})
+	expectReload(t, reply, false)
+	e.expectReady(true)
+	e.expectStacks("web", "db")
+	e.expectMetric("metadata_buffered_syncs", "0")
+
+	// Updates of an older generation are not applied
+	reply = e.sync(&client.MetadataSyncRequest{
+		Generation: "g1",
+		Updates: map[string]interface{}{
+			"stack-6": stack("6", "old"),
+		},
+	})
+	expectReload(t, reply, true)
+	e.expectStacks("web", "db")
+	e.expectMetric("metadata_resync_requests_total", "3")
+}
+
+func TestDigest(t *testing.T) {
+	e := start(t, false)
+	defer e.close()
+
+	reply := e.sync(&client.MetadataSyncRequest{
+		Generation: "g1",
+		Full:       true,
+		Updates:    objects(),
+	})
+	expectReload(t, reply, false)
+	digest := reply["digest"]
+
+	reply = e.sync(map[string]interface{}{
+		"generation": "g1",
+		"full":       true,
+		"updates":    objects(),
+		"digest":     digest,
+	})
+	expectReload(t, reply, false)
+	e.expectReady(true)
+
+	reply = e.sync(map[string]interface{}{
+		"generation": "g1",
+		"updates": map[string]interface{}{
+			"stack-3": stack("3", "app"),
+		},
+		"digest": digest,
+	})
+	expectReload(t, reply, true)
+	e.expectReady(false)
+	e.expectMetric("metadata_digest_mismatches_total", "1")
+}
+
+func TestStrictSync(t *testing.T) {
+	e := start(t, true)
+	defer e.close()
+
+	invalid := objects()
+	invalid["stack-3"] = map[string]interface{}{
+		"infoType":   "stack",
+		"infoTypeId": "3",
+		"uuid":       "stack-3",
+		"name":       []interface{}{"not", "a", "name"},
+	}
+
+	reply := e.sync(&client.MetadataSyncRequest{
+		Generation: "g1",
+		Full:       true,
+		Updates:    invalid,
+	})
+	expectReload(t, reply, true)
+	if invalid, _ := reply["invalid"].([]interface{}); len(invalid) != 1 {
+		t.Errorf("Expected one invalid object in the reply, got %v", reply)
+	}
+	e.expectReady(false)
+}
+
+// TestWatch watches object paths, whose text form is not their value, and
+// checks that the client waits on the server for them to change
+func TestWatch(t *testing.T) {
+	e := start(t, false)
+	defer e.close()
+
+	e.sync(&client.MetadataSyncRequest{
+		Generation: "g1",
+		Full:       true,
+		Updates:    objects(stack("3", "app"), stack("4", "db")),
+	})
+
+	// Count the requests of the client on their way to the server
+	target, err := url.Parse(e.url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests int32
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		proxy.ServeHTTP(w, req)
+	}))
+	defer front.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := metadata.New(front.URL + "/latest")
+	c.SetRetries(0, 100*time.Millisecond)
+	stacks := c.Watch(ctx, "stacks")
+	selfStack := c.Watch(ctx, "self/stack")
+
+	receive := func(values <-chan string, contains string) {
+		select {
+		case value := <-values:
+			if !strings.Contains(value, contains) {
+				t.Errorf("Expected a value with %s, got %s", contains, value)
+			}
+		case <-time.After(cattletest.Timeout):
+			t.Fatalf("Timed out waiting for a value with %s", contains)
+		}
+	}
+
+	receive(stacks, `"name":"db"`)
+	receive(selfStack, `"name":"app"`)
+
+	// A first request and one waiting for each path.  If the server
+	// answered the waits at once, the client would be asking again with
+	// pauses of 100 and 200ms.
+	time.Sleep(500 * time.Millisecond)
+	if n := atomic.LoadInt32(&requests); n != 4 {
+		t.Errorf("Expected the watches to wait on the server, got %d requests", n)
+	}
+
+	e.sync(&client.MetadataSyncRequest{
+		Generation: "g1",
+		Updates: map[string]interface{}{
+			"stack-3": stack("3", "web"),
+		},
+	})
+	receive(stacks, `"name":"web"`)
+	receive(selfStack, `"name":"web"`)
+}
+
+func TestConsistencyEnvironment(t *testing.T) {
+	e := start(t, false)
+	defer e.close()
+
+	updates := objects(stack("3", "app"))
+	updates["other"] = map[string]interface{}{
+		"infoType":        "instance",
+		"infoTypeId":      "10",
+		"uuid":            "other",
+		"name":            "other",
+		"environmentUuid": "env-2",
+		"hostId":          "99",
+	}
+	e.sync(&client.MetadataSyncRequest{
+		Generation: "g1",
+		Full:       true,
+		Updates:    updates,
+	})
+
+	// The client only sees the problems of its own environment
+	if code, body := e.get("/debug/consistency"); code != http.StatusOK || strings.Contains(body, "other") {
+		t.Errorf("Expected no problems of env-2, got %d %s", code, body)
+	}
+
+	// Without the client's container nothing is visible
+	e.sync(&client.MetadataSyncRequest{
+		Generation: "g2",
+		Full:       true,
+		Updates: map[string]interface{}{
+			"other": updates["other"],
+		},
+	})
+	if code, body := e.get("/debug/consistency"); code != http.StatusNotFound {
+		t.Errorf("Expected an unknown client to see nothing, got %d %s", code, body)
+	}
+	if code, body := e.get("/latest/graph"); code != http.StatusNotFound {
+		t.Errorf("Expected an unknown client to see no graph, got %d %s", code, body)
+	}
+}
+
+// render posts a template and returns the status, the output and its ETag
+func (e *e2e) render(query, template string) (int, string, string) {
+	resp, err := http.Post(e.url+"/latest/render?"+query, "text/plain", strings.NewReader(template))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	bytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return resp.StatusCode, string(bytes), strings.Trim(resp.Header.Get("ETag"), `"`)
+}
+
+func TestRender(t *testing.T) {
+	e := start(t, false)
+	defer e.close()
+
+	e.sync(&client.MetadataSyncRequest{
+		Generation: "g1",
+		Full:       true,
+		Updates:    objects(stack("3", "app"), stack("4", "db")),
+	})
+
+	const template = `{{.Self.container.name}}:{{range .Environment.stacks}} {{.name}}{{end}}`
+	code, output, etag := e.render("", template)
+	if code != http.StatusOK || output != "client: app db" || etag == "" {
+		t.Fatalf("Expected the rendered template, got %d %q %q", code, output, etag)
+	}
+
+	// A change the output does not show does not end the wait
+	start := time.Now()
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		_, err := e.cattle.Sync(&client.MetadataSyncRequest{
+			Generation: "g1",
+			Updates: map[string]interface{}{
+				"other": map[string]interface{}{
+					"infoType":        "host",
+					"infoTypeId":      "1",
+					"uuid":            "other",
+					"name":            "host-1",
+					"environmentUuid": "env",
+				},
+			},
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	code, output, newETag := e.render("wait=true&maxWait=1&value="+etag, template)
+	if code != http.StatusOK || output != "client: app db" || newETag != etag || time.Since(start) < time.Second {
+		t.Errorf("Expected the same output after maxWait, got %d %q %q after %v", code, output, newETag, time.Since(start))
+	}
+
+	type rendered struct {
+		output, etag string
+	}
+	done := make(chan rendered)
+	go func() {
+		_, output, etag := e.render("wait=true&maxWait=10&value="+etag, template)
+		done <- rendered{output, etag}
+	}()
+
+	select {
+	case r := <-done:
+		t.Fatalf("Expected the render to wait for a change, got %q", r.output)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	e.sync(&client.MetadataSyncRequest{
+		Generation: "g1",
+		Updates: map[string]interface{}{
+			"stack-4": stack("4", "cache"),
+		},
+	})
+
+	select {
+	case r := <-done:
+		if r.output != "client: app cache" || r.etag == etag {
+			t.Errorf("Expected the new output with a new ETag, got %q %q", r.output, r.etag)
+		}
+	case <-time.After(cattletest.Timeout):
+		t.Fatal("Timed out waiting for the render")
+	}
+
+	if code, output, _ := e.render("", `{{printf "%4194305s" .Self.container.name}}`); code != http.StatusBadRequest || !strings.Contains(output, "output too large") {
+		t.Errorf("Expected the output to be limited, got %d %.100q", code, output)
+	}
+}
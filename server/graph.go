@@ -0,0 +1,51 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/rancher/metadata/content"
+	"github.com/rancher/metadata/graph"
+)
+
+func (s *Server) graph(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	version := mux.Vars(req)["version"]
+	clientIP := s.requestIP(req)
+	query := req.URL.Query()
+
+	if _, ok := content.VersionMap[version]; !ok {
+		respondError(w, req, "Not found", http.StatusNotFound)
+		return
+	}
+
+	environmentUUID, ok := s.visibleEnvironment(clientIP)
+	if !ok {
+		respondError(w, req, "Not found", http.StatusNotFound)
+		return
+	}
+	stackName := query.Get("stack")
+
+	logrus.WithFields(logrus.Fields{
+		"version":     version,
+		"client":      clientIP,
+		"environment": environmentUUID,
+		"stack":       stackName,
+	}).Debug("Building dependency graph")
+
+	g := graph.Build(s.store, environmentUUID, stackName)
+
+	switch query.Get("format") {
+	case "", "json":
+		respondJSON(w, req, g)
+	case "dot":
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		if err := g.WriteDOT(w); err != nil {
+			logrus.Errorf("Failed to write graph: %v", err)
+		}
+	default:
+		respondError(w, req, "Unknown format: "+query.Get("format"), http.StatusBadRequest)
+	}
+}
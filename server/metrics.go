@@ -0,0 +1,53 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type metric struct {
+	name  string
+	kind  string
+	help  string
+	value float64
+}
+
+// metrics serves the sync status in the Prometheus text format
+func (s *Server) metrics(w http.ResponseWriter, req *http.Request) {
+	status := s.subscriber.Status()
+
+	inSync := 0.0
+	if status.InSync {
+		inSync = 1
+	}
+
+	var lines []string
+	for _, m := range []metric{
+		{"metadata_in_sync", "gauge", "Whether the content is at the generation of the last full sync", inSync},
+		{"metadata_out_of_sync_seconds", "gauge", "Seconds since the content went out of sync, 0 while in sync", status.OutOfSyncSeconds},
+		{"metadata_buffered_syncs", "gauge", "Incremental syncs buffered until the next full sync", float64(status.Buffered)},
+		{"metadata_resync_requests_total", "counter", "Full syncs requested from Cattle", float64(status.ResyncRequests)},
+		{"metadata_invalid_objects_total", "counter", "Synced objects that failed validation", float64(status.InvalidObjects)},
+		{"metadata_rejected_syncs_total", "counter", "Syncs rejected for containing invalid objects with --strict-sync", float64(status.RejectedSyncs)},
+		{"metadata_digest_mismatches_total", "counter", "Syncs after which the digest of the content did not match the expected one", float64(status.DigestMismatches)},
+	} {
+		lines = append(lines,
+			fmt.Sprintf("# HELP %s %s", m.name, m.help),
+			fmt.Sprintf("# TYPE %s %s", m.name, m.kind),
+			fmt.Sprintf("%s %v", m.name, m.value))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, strings.Join(lines, "\n")+"\n")
+}
+
+// ready succeeds only while the content is in sync with Cattle
+func (s *Server) ready(w http.ResponseWriter, req *http.Request) {
+	status := s.subscriber.Status()
+	w.Header().Set("Content-Type", "application/json")
+	if !status.InSync {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	respondJSON(w, req, status)
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/rancher/metadata/content"
+	"github.com/rancher/metadata/render"
+	"github.com/rancher/metadata/types/convert"
+)
+
+const (
+	maxTemplateSize = 1 << 20
+	maxRenderSize   = 4 << 20
+	renderTimeout   = 5 * time.Second
+
+	// maxRenders bounds the templates executing at once.  A template that
+	// runs on without output is abandoned after renderTimeout, but keeps its
+	// slot until it ends.
+	maxRenders = 16
+)
+
+var errBusy = errors.New("too many templates rendering, try again later")
+
+func (s *Server) render(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	version := mux.Vars(req)["version"]
+	clientIP := s.requestIP(req)
+	query := req.URL.Query()
+	wait := query.Get("wait") == "true"
+	oldChecksum := strings.Trim(query.Get("value"), `"`)
+	maxWait, _ := strconv.Atoi(query.Get("maxWait"))
+
+	text, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxTemplateSize))
+	if err != nil {
+		respondError(w, req, "Failed to read template: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t, err := render.Parse("render", string(text))
+	if err != nil {
+		respondError(w, req, "Invalid template: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"version":  version,
+		"client":   clientIP,
+		"wait":     wait,
+		"oldValue": oldChecksum,
+		"maxWait":  maxWait,
+	}).Debug("Rendering template")
+
+	var changed <-chan struct{}
+	var timeout <-chan time.Time
+	if wait {
+		var cancel func()
+		changed, cancel = s.subscribe(version, clientIP)
+		defer cancel()
+		timeout = time.After(waitTimeout(time.Duration(maxWait) * time.Second))
+	}
+
+	for {
+		ctx, ok, err := s.renderContext(version, clientIP)
+		if err != nil {
+			respondError(w, req, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			respondError(w, req, "Not found", http.StatusNotFound)
+			return
+		}
+
+		output, err := s.execute(t, ctx)
+		if err == errBusy {
+			respondError(w, req, err.Error(), http.StatusServiceUnavailable)
+			return
+		} else if err != nil {
+			respondError(w, req, "Failed to render template: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		checksum := render.Checksum(output)
+		done := !wait || checksum != oldChecksum
+		if !done {
+			select {
+			case <-changed:
+			case <-timeout:
+				done = true
+			}
+		}
+
+		if done {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("ETag", strconv.Quote(checksum))
+			w.Write(output)
+			return
+		}
+	}
+}
+
+// execute renders a template with its output and time bounded, in one of the
+// maxRenders slots
+func (s *Server) execute(t *template.Template, ctx render.Context) ([]byte, error) {
+	select {
+	case s.renders <- struct{}{}:
+	default:
+		return nil, errBusy
+	}
+
+	type result struct {
+		output []byte
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			<-s.renders
+		}()
+		output, err := render.ExecuteLimited(t, ctx, maxRenderSize, time.Now().Add(renderTimeout))
+		done <- result{output, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.output, r.err
+	case <-time.After(renderTimeout):
+		logrus.Warnf("Abandoned a template rendering for more than %v", renderTimeout)
+		return nil, render.ErrTimeout
+	}
+}
+
+func (s *Server) renderContext(version, ip string) (render.Context, bool, error) {
+	var (
+		ctx = render.Context{}
+		ok  bool
+		err error
+	)
+
+	s.store.View(func() {
+		var env interface{}
+		env, ok = content.GetEnvironment(s.store, version, ip)
+		if !ok {
+			return
+		}
+
+		ctx.Environment, err = env.(content.Object).Map()
+		if err != nil {
+			return
+		}
+
+		ctx.Self, err = convert.NewSelfObject(version, ip, s.store).Map()
+	})
+
+	return ctx, ok, err
+}
@@ -1,15 +1,19 @@
 package server
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/rancher/metadata/content"
+	"github.com/rancher/metadata/render"
 )
 
 func respondError(w http.ResponseWriter, req *http.Request, msg string, statusCode int) {
@@ -32,26 +36,51 @@ func respondError(w http.ResponseWriter, req *http.Request, msg string, statusCo
 	}
 }
 
+// respondSuccess writes a value in the content type of the request, with the
+// checksum of the body as ETag so clients can wait for it to change
 func respondSuccess(w http.ResponseWriter, req *http.Request, val interface{}) {
+	body, err := renderSuccess(req, val)
+	if err != nil {
+		respondError(w, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", strconv.Quote(render.Checksum(body)))
+	w.Write(body)
+}
+
+// renderSuccess returns the body of a response with a value in the content
+// type of the request
+func renderSuccess(req *http.Request, val interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
 	switch contentType(req) {
 	case ContentText:
-		respondText(w, req, val)
+		if err := writeText(buf, val); err != nil {
+			return nil, err
+		}
 	case ContentJSON:
-		respondJSON(w, req, val)
+		if err := json.NewEncoder(buf).Encode(val); err != nil {
+			return nil, fmt.Errorf("Error serializing to JSON: %v", err)
+		}
 	}
+	return buf.Bytes(), nil
 }
 
-func respondText(w http.ResponseWriter, req *http.Request, val interface{}) {
+func writeText(w io.Writer, val interface{}) error {
 	if val == nil {
-		fmt.Fprint(w, "")
-		return
+		return nil
 	}
 
 	if obj, ok := val.(content.Object); ok {
 		mapObj, err := obj.Map()
 		if err != nil {
-			respondError(w, req, err.Error(), 500)
-			return
+			return err
+		}
+		val = mapObj
+	} else if isStruct(val) {
+		mapObj, err := structToMap(val)
+		if err != nil {
+			return err
 		}
 		val = mapObj
 	}
@@ -102,6 +131,29 @@ func respondText(w http.ResponseWriter, req *http.Request, val interface{}) {
 			fmt.Fprint(w, v)
 		}
 	}
+
+	return nil
+}
+
+// isStruct returns true for structs and non nil pointers to structs
+func isStruct(val interface{}) bool {
+	v := reflect.ValueOf(val)
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return false
+		}
+		v = v.Elem()
+	}
+	return v.Kind() == reflect.Struct
+}
+
+func structToMap(val interface{}) (map[string]interface{}, error) {
+	bytes, err := json.Marshal(val)
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]interface{}{}
+	return result, json.Unmarshal(bytes, &result)
 }
 
 func getName(obj interface{}) string {
@@ -1,8 +1,8 @@
 package server
 
 import (
-	"context"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
@@ -19,7 +19,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/rancher/go-rancher/v3"
 	"github.com/rancher/metadata/content"
-	"github.com/rancher/metadata/content/memory"
+	"github.com/rancher/metadata/render"
 	"github.com/rancher/metadata/subscriber"
 	"github.com/rancher/metadata/types/convert"
 )
@@ -27,6 +27,8 @@ import (
 const (
 	ContentText = 1
 	ContentJSON = 2
+
+	hostsFileKey = "hosts-file"
 )
 
 // Server specifies the configuration for the metadata server
@@ -35,16 +37,18 @@ type Server struct {
 	enableXff  bool
 	subscriber *subscriber.Subscriber
 	store      content.Store
+	renders    chan struct{}
 }
 
-func New(opts *client.ClientOpts, listen string, enableXff bool) (*Server, error) {
+func New(opts *client.ClientOpts, listen string, enableXff bool, store content.Store, persistence subscriber.Persistence, strictSync bool) (*Server, error) {
 	s := &Server{
 		listen:    listen,
 		enableXff: enableXff,
-		store:     memory.NewMemoryStore(context.Background()),
+		store:     store,
+		renders:   make(chan struct{}, maxRenders),
 	}
 
-	subscriber, err := subscriber.NewSubscriber(opts, s.store)
+	subscriber, err := subscriber.NewSubscriber(opts, s.store, persistence, strictSync)
 	if err != nil {
 		return nil, err
 	}
@@ -53,12 +57,33 @@ func New(opts *client.ClientOpts, listen string, enableXff bool) (*Server, error
 	return s, nil
 }
 
+func (s *Server) Store() content.Store {
+	return s.store
+}
+
+// SetRecorder records the sync events received from Cattle
+func (s *Server) SetRecorder(recorder *subscriber.Recorder) {
+	s.subscriber.SetRecorder(recorder)
+}
+
 func (s *Server) Start() error {
 	go s.runServer()
 	s.subscriber.Start()
 	return fmt.Errorf("Server died")
 }
 
+// Replay serves the content of a recording of sync events instead of the
+// content from Cattle, and keeps serving the last state once it is done
+func (s *Server) Replay(reader io.Reader, keys *subscriber.Keys, speed float64) error {
+	go s.runServer()
+	if err := s.subscriber.Replay(reader, keys, speed); err != nil {
+		return err
+	}
+
+	logrus.Info("Replay done, serving the last state")
+	select {}
+}
+
 func (s *Server) runServer() {
 	s.watchSignals()
 
@@ -68,10 +93,38 @@ func (s *Server) runServer() {
 		Methods("GET", "HEAD").
 		Name("Root")
 
+	router.HandleFunc("/debug/consistency", s.consistency).
+		Methods("GET", "HEAD").
+		Name("Consistency")
+
+	router.HandleFunc("/metrics", s.metrics).
+		Methods("GET", "HEAD").
+		Name("Metrics")
+
+	router.HandleFunc("/ready", s.ready).
+		Methods("GET", "HEAD").
+		Name("Ready")
+
 	router.HandleFunc("/{version}", s.metadata).
 		Methods("GET", "HEAD").
 		Name("Version")
 
+	router.HandleFunc("/{version}/batch", s.batch).
+		Methods("POST").
+		Name("Batch")
+
+	router.HandleFunc("/{version}/render", s.render).
+		Methods("POST").
+		Name("Render")
+
+	router.HandleFunc("/{version}/changes", s.changes).
+		Methods("GET", "HEAD").
+		Name("Changes")
+
+	router.HandleFunc("/{version}/graph", s.graph).
+		Methods("GET", "HEAD").
+		Name("Graph")
+
 	router.HandleFunc("/{version}/{key:.*}", s.metadata).
 		Queries("wait", "true", "value", "{oldValue}").
 		Methods("GET", "HEAD").
@@ -85,7 +138,7 @@ func (s *Server) runServer() {
 	logrus.Fatal(http.ListenAndServe(s.listen, router))
 }
 
-func (s *Server) lookupAnswer(wait bool, oldValue, version string, ip string, path []string, maxWait time.Duration) (interface{}, bool) {
+func waitTimeout(maxWait time.Duration) time.Duration {
 	if maxWait == time.Duration(0) {
 		maxWait = 10 * time.Second
 	}
@@ -94,32 +147,76 @@ func (s *Server) lookupAnswer(wait bool, oldValue, version string, ip string, pa
 		maxWait = 2 * time.Minute
 	}
 
-	start := time.Now()
+	return maxWait
+}
+
+// lookupAnswer returns the value at a path, when waiting once it differs from
+// oldValue.  oldValue is either the value itself, as scalars are compared, or
+// the ETag of its previous response in the content type of req.
+func (s *Server) lookupAnswer(req *http.Request, wait bool, oldValue, version string, ip string, path []string, maxWait time.Duration) (interface{}, bool) {
+	if !wait {
+		return s.getValue(version, ip, path)
+	}
+
+	changed, cancel := s.subscribe(version, ip)
+	defer cancel()
+	timeout := time.After(waitTimeout(maxWait))
+
+	unchanged := func(val interface{}) bool {
+		if fmt.Sprint(val) == oldValue {
+			return true
+		}
+		body, err := renderSuccess(req, val)
+		return err == nil && render.Checksum(body) == strings.Trim(oldValue, `"`)
+	}
 
 	for {
 		val, ok := s.getValue(version, ip, path)
-		if !wait {
+		if ok && !unchanged(val) {
 			return val, ok
 		}
-		if time.Now().Sub(start) > maxWait {
+
+		select {
+		case <-changed:
+		case <-timeout:
 			return val, ok
 		}
-		if ok && fmt.Sprint(val) != oldValue {
-			return val, ok
+	}
+}
+
+// subscribe returns a channel that is signalled when a change visible to the
+// client is applied to the store
+func (s *Server) subscribe(version, ip string) (<-chan struct{}, func()) {
+	changed := make(chan struct{}, 1)
+	cancel := s.store.Subscribe(content.Client{
+		Version: version,
+		IP:      ip,
+	}, func(content.Change) {
+		select {
+		case changed <- struct{}{}:
+		default:
 		}
+	})
 
-		s.store.WaitChanged()
-	}
+	return changed, cancel
 }
 
 func (s *Server) getValue(version, ip string, path []string) (interface{}, bool) {
+	return Lookup(s.store, version, ip, path)
+}
+
+// Lookup returns the value at a metadata path as seen by the client with the
+// given IP
+func Lookup(store content.Store, version, ip string, path []string) (interface{}, bool) {
 	var root interface{}
 
-	if len(path) > 0 && path[0] == "self" {
-		root = convert.NewSelfObject(version, ip, s.store)
+	if len(path) == 2 && path[0] == "self" && path[1] == hostsFileKey {
+		return convert.HostsFile(version, ip, store)
+	} else if len(path) > 0 && path[0] == "self" {
+		root = convert.NewSelfObject(version, ip, store)
 		path = path[1:]
 	} else {
-		env, ok := content.GetEnvironment(s.store, version, ip)
+		env, ok := content.GetEnvironment(store, version, ip)
 		if !ok {
 			return nil, false
 		}
@@ -175,10 +272,15 @@ func traverse(in interface{}, path []string) (interface{}, bool) {
 				out, valid = v[strings.ToLower(key)]
 			}
 		default:
+			if v == nil {
+				break
+			}
 			if reflect.TypeOf(v).Kind() == reflect.Slice {
 				out, valid = getIndexed(reflect.ValueOf(v), key)
+			} else if isStruct(v) {
+				out, valid = content.GetValue(v, key)
 			} else {
-				logrus.Debug("Unknown type %T at /%s", v, path)
+				logrus.Debugf("Unknown type %T at /%s", v, path)
 			}
 		}
 
@@ -257,7 +359,7 @@ func (s *Server) metadata(w http.ResponseWriter, req *http.Request) {
 		"wait":     wait,
 		"oldValue": oldValue,
 		"maxWait":  maxWait}).Debugf("Searching for: %s", displayKey)
-	val, ok := s.lookupAnswer(wait, oldValue, version, clientIP, pathSegments, time.Duration(maxWait)*time.Second)
+	val, ok := s.lookupAnswer(req, wait, oldValue, version, clientIP, pathSegments, time.Duration(maxWait)*time.Second)
 
 	if ok {
 		logrus.WithFields(logrus.Fields{
@@ -0,0 +1,200 @@
+package subscriber
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rancher/go-rancher/v3"
+)
+
+// digest is a deterministic digest of the objects synced from Cattle, in the
+// form Cattle sent them, so that Cattle can compute it from what it sent:
+//
+// The objects are those of the Updates of the last full sync, then for every
+// incremental sync applied after it the Updates are added or replace the
+// object with the same key, and the keys of the Removes are removed.  Each
+// object is hashed as the SHA-256 of its canonical JSON, which is
+//
+//   - objects with their keys sorted by their bytes, arrays in order
+//   - no whitespace between tokens
+//   - strings with \" and \\, \n, \r and \t, the other control characters as
+//     \u00xx in lowercase hex, U+2028 and U+2029 as \u2028 and \u2029, bytes
+//     that are not valid UTF-8 as \ufffd and the other characters as UTF-8
+//   - numbers as ECMAScript formats them: the shortest decimal that reads
+//     back as the same 64-bit float, in exponent form such as 1e+21 or 1e-7
+//     below 1e-6 and from 1e21 on
+//   - true, false and null
+//
+// The digest is the SHA-256 of the lines "<key> <object hash>\n" of all
+// objects sorted by key, where the key is the UUID the object has in Updates.
+// Hashes are in lowercase hex.
+type digest struct {
+	sums map[string]string
+}
+
+func newDigest() *digest {
+	return &digest{
+		sums: map[string]string{},
+	}
+}
+
+// restore starts over from the objects of a generation keyed by UUID
+func (d *digest) restore(vals map[string]interface{}) {
+	d.sums = map[string]string{}
+	for uuid, obj := range vals {
+		d.sums[uuid] = objectSum(obj)
+	}
+}
+
+// apply adds a sync that has been written to the store
+func (d *digest) apply(request *client.MetadataSyncRequest) {
+	if request.Full {
+		d.restore(request.Updates)
+		return
+	}
+
+	for uuid, obj := range request.Updates {
+		d.sums[uuid] = objectSum(obj)
+	}
+	for uuid := range request.Removes {
+		delete(d.sums, uuid)
+	}
+}
+
+func (d *digest) value() string {
+	uuids := make([]string, 0, len(d.sums))
+	for uuid := range d.sums {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+
+	hash := sha256.New()
+	for _, uuid := range uuids {
+		fmt.Fprintf(hash, "%s %s\n", uuid, d.sums[uuid])
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func objectSum(obj interface{}) string {
+	sum := sha256.Sum256(canonicalJSON(obj))
+	return hex.EncodeToString(sum[:])
+}
+
+// canonicalJSON encodes a decoded JSON value in the canonical form of the
+// digest.  It does not depend on encoding/json, whose escaping changed
+// between Go versions.
+func canonicalJSON(obj interface{}) []byte {
+	buf := &bytes.Buffer{}
+	writeCanonical(buf, obj)
+	return buf.Bytes()
+}
+
+func writeCanonical(buf *bytes.Buffer, val interface{}) {
+	switch v := val.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case float64:
+		buf.WriteString(formatNumber(v))
+	case string:
+		writeString(buf, v)
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeCanonical(buf, item)
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buf.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeString(buf, key)
+			buf.WriteByte(':')
+			writeCanonical(buf, v[key])
+		}
+		buf.WriteByte('}')
+	default:
+		// Not decoded from JSON, such as the objects of tests, encode it
+		// as it would have been sent
+		var decoded interface{}
+		data, err := json.Marshal(v)
+		if err == nil {
+			err = json.Unmarshal(data, &decoded)
+		}
+		if err != nil {
+			// Keep the digest from matching
+			buf.WriteString(err.Error())
+			return
+		}
+		writeCanonical(buf, decoded)
+	}
+}
+
+func formatNumber(f float64) string {
+	abs := math.Abs(f)
+	if abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		// Go writes at least two digits of exponent, ECMAScript as few as
+		// needed
+		s := strconv.FormatFloat(f, 'e', -1, 64)
+		if i := strings.LastIndexAny(s, "+-"); i >= 0 && i+2 < len(s) && s[i+1] == '0' {
+			s = s[:i+1] + s[i+2:]
+		}
+		return s
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	const digits = "0123456789abcdef"
+
+	buf.WriteByte('"')
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+
+		switch {
+		case r == '"' || r == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(byte(r))
+		case r == '\n':
+			buf.WriteString(`\n`)
+		case r == '\r':
+			buf.WriteString(`\r`)
+		case r == '\t':
+			buf.WriteString(`\t`)
+		case r < 0x20:
+			buf.WriteString(`\u00`)
+			buf.WriteByte(digits[r>>4])
+			buf.WriteByte(digits[r&0xf])
+		case r == '\u2028':
+			buf.WriteString(`\u2028`)
+		case r == '\u2029':
+			buf.WriteString(`\u2029`)
+		case r == utf8.RuneError && size == 1:
+			buf.WriteString(`\ufffd`)
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	buf.WriteByte('"')
+}
@@ -0,0 +1,128 @@
+package subscriber
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/rancher/go-rancher/v3"
+)
+
+// sha256Hex is how Cattle hashes, by the documented algorithm
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// expectedDigest computes the digest from objects written out in canonical
+// JSON by hand, keyed by UUID in sorted order
+func expectedDigest(canonical ...[2]string) string {
+	lines := ""
+	for _, obj := range canonical {
+		lines += obj[0] + " " + sha256Hex(obj[1]) + "\n"
+	}
+	return sha256Hex(lines)
+}
+
+// decode parses an object as it arrives from Cattle
+func decode(t *testing.T, s string) map[string]interface{} {
+	obj := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(s), &obj); err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+func TestDigest(t *testing.T) {
+	stack := decode(t, `{
+		"uuid": "s1",
+		"name": "a<b>&c",
+		"infoType": "stack",
+		"infoTypeId": "1"
+	}`)
+	service := decode(t, `{
+		"uuid": "s2",
+		"name": "web",
+		"infoType": "service",
+		"scale": 3,
+		"labels": {"io.rancher.scheduler.global": "true", "app": "web"},
+		"ports": ["80:80/tcp"],
+		"vip": null,
+		"system": false
+	}`)
+
+	stackJSON := `{"infoType":"stack","infoTypeId":"1","name":"a<b>&c","uuid":"s1"}`
+	serviceJSON := `{"infoType":"service","labels":{"app":"web","io.rancher.scheduler.global":"true"},"name":"web","ports":["80:80/tcp"],"scale":3,"system":false,"uuid":"s2","vip":null}`
+
+	d := newDigest()
+	d.apply(&client.MetadataSyncRequest{
+		Full:       true,
+		Generation: "g1",
+		Updates:    map[string]interface{}{"s2": service, "s1": stack},
+	})
+	if expected, actual := expectedDigest([2]string{"s1", stackJSON}, [2]string{"s2", serviceJSON}), d.value(); actual != expected {
+		t.Errorf("Expected digest %s, got %s", expected, actual)
+	}
+
+	// An update replaces the object with the same key, a remove drops it
+	d.apply(&client.MetadataSyncRequest{
+		Generation: "g1",
+		Updates:    map[string]interface{}{"s1": decode(t, `{"uuid":"s1","name":"b"}`)},
+		Removes:    map[string]interface{}{"s2": service},
+	})
+	if expected, actual := expectedDigest([2]string{"s1", `{"name":"b","uuid":"s1"}`}), d.value(); actual != expected {
+		t.Errorf("Expected digest %s after an incremental sync, got %s", expected, actual)
+	}
+
+	// A restored generation has the digest of the same objects synced
+	restored := newDigest()
+	restored.restore(map[string]interface{}{"s1": decode(t, `{"name":"b","uuid":"s1"}`)})
+	if restored.value() != d.value() {
+		t.Errorf("Expected the restored digest %s, got %s", d.value(), restored.value())
+	}
+
+	// A full sync starts over
+	d.apply(&client.MetadataSyncRequest{
+		Full:       true,
+		Generation: "g2",
+	})
+	if expected, actual := sha256Hex(""), d.value(); actual != expected {
+		t.Errorf("Expected the digest of no objects %s, got %s", expected, actual)
+	}
+}
+
+func TestCanonicalJSON(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		expected string
+	}{
+		{"a<b>&c", `"a<b>&c"`},
+		{"q\"b\\n\nr\rt\tb\bf\f\x00\x1f", `"q\"b\\n\nr\rt\tb\u0008f\u000c\u0000\u001f"`},
+		{"\u00e9\u2603\u2028\u2029", `"é☃\u2028\u2029"`},
+		{"a\xffb", `"a\ufffdb"`},
+		{float64(100), `100`},
+		{0.5, `0.5`},
+		{-1.25, `-1.25`},
+		{float64(0), `0`},
+		{1e20, `100000000000000000000`},
+		{1e21, `1e+21`},
+		{1.5e300, `1.5e+300`},
+		{1e-6, `0.000001`},
+		{1e-7, `1e-7`},
+		{-math.MaxFloat64, `-1.7976931348623157e+308`},
+		{nil, `null`},
+		{true, `true`},
+		{[]interface{}{1.0, "a", nil}, `[1,"a",null]`},
+		{map[string]interface{}{"b": 1.0, "a": map[string]interface{}{"d": false, "c": []interface{}{}}, "B": "x"}, `{"B":"x","a":{"c":[],"d":false},"b":1}`},
+		{map[string]int{"b": 2, "a": 1}, `{"a":1,"b":2}`},
+	}
+
+	for _, test := range tests {
+		if actual := string(canonicalJSON(test.value)); actual != test.expected {
+			t.Errorf("%s: expected %s, got %s", fmt.Sprint(test.value), test.expected, actual)
+		}
+	}
+}
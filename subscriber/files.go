@@ -0,0 +1,160 @@
+package subscriber
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher/v3"
+)
+
+const generationFile = "generation"
+
+// files persists every object in its own file under a directory per
+// generation
+type files struct {
+	dir  string
+	mode os.FileMode
+	keys *Keys
+}
+
+func NewFiles(dir string, mode os.FileMode, keys *Keys) Persistence {
+	return &files{
+		dir:  dir,
+		mode: mode,
+		keys: keys,
+	}
+}
+
+func (f *files) Save(request *client.MetadataSyncRequest) error {
+	base := path.Join(f.dir, request.Generation)
+	if request.Full {
+		if err := os.RemoveAll(base); !os.IsNotExist(err) && err != nil {
+			return err
+		}
+	}
+
+	var lastError error
+	for uuid, obj := range request.Updates {
+		if err := writeAtomic(base, uuid, obj, f.mode, f.keys); err != nil {
+			lastError = err
+			continue
+		}
+	}
+
+	for uuid := range request.Removes {
+		if err := os.Remove(path.Join(base, uuid)); !os.IsNotExist(err) && err != nil {
+			lastError = err
+			continue
+		}
+	}
+
+	if request.Full {
+		if err := writeAtomic(f.dir, generationFile, request.Generation, f.mode, f.keys); err != nil {
+			return err
+		}
+
+		logrus.Infof("New generation %s", request.Generation)
+
+		if err := removeExcept(f.dir, generationFile, request.Generation); err != nil {
+			return err
+		}
+	}
+
+	return lastError
+}
+
+// Restore writes the generation again if any of it is not sealed with the
+// current key
+func (f *files) Restore() (string, map[string]interface{}, error) {
+	generation, vals, stale, err := readFiles(f.dir, f.keys)
+	if err != nil || !stale {
+		return generation, vals, err
+	}
+
+	logrus.Infof("Encrypting generation %s with the current key", generation)
+	return generation, vals, f.Save(&client.MetadataSyncRequest{
+		Full:       true,
+		Generation: generation,
+		Updates:    vals,
+	})
+}
+
+func (f *files) Clear() error {
+	return removeFiles(f.dir, generationFile)
+}
+
+// readFiles reads the objects of the current generation persisted under dir
+// as one file per object, and whether any of them has to be sealed again
+func readFiles(dir string, keys *Keys) (string, map[string]interface{}, bool, error) {
+	generation, files, err := Files(dir, keys)
+	if err != nil || generation == "" {
+		return "", nil, false, err
+	}
+
+	logrus.Debugf("Restoring generation %s", generation)
+
+	vals := map[string]interface{}{}
+	stale := false
+
+	for _, filename := range files {
+		logrus.Debugf("Loading %s", filename)
+		obj, objStale, err := readObject(filename, keys)
+		if err != nil {
+			return "", nil, false, err
+		}
+		stale = stale || objStale
+
+		uuid, _ := obj["uuid"].(string)
+		if uuid != "" {
+			vals[uuid] = obj
+		}
+	}
+
+	return generation, vals, stale, nil
+}
+
+// Files returns the current generation persisted under dir as one file per
+// object and the paths of its object files
+func Files(dir string, keys *Keys) (string, []string, error) {
+	generation, _, err := readSealed(path.Join(dir, generationFile), keys)
+	if os.IsNotExist(err) {
+		return "", nil, nil
+	} else if err != nil {
+		return "", nil, err
+	}
+
+	base := path.Join(dir, string(generation))
+	files, err := ioutil.ReadDir(base)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var result []string
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".tmp") {
+			continue
+		}
+		result = append(result, path.Join(base, file.Name()))
+	}
+
+	return string(generation), result, nil
+}
+
+func ReadObject(filename string, keys *Keys) (map[string]interface{}, error) {
+	obj, _, err := readObject(filename, keys)
+	return obj, err
+}
+
+func readObject(filename string, keys *Keys) (map[string]interface{}, bool, error) {
+	bytes, stale, err := readSealed(filename, keys)
+	if err != nil {
+		return nil, false, err
+	}
+
+	obj := map[string]interface{}{}
+	return obj, stale, json.Unmarshal(bytes, &obj)
+}
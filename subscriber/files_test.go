@@ -0,0 +1,116 @@
+package subscriber
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/rancher/go-rancher/v3"
+)
+
+func TestFiles(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	f := NewFiles(dir, 0600, nil)
+	expectRestore(t, f, "", "")
+
+	save(t, f, &client.MetadataSyncRequest{
+		Generation: "g1",
+		Full:       true,
+		Updates:    objects(object("1", "a"), object("2", "b")),
+	})
+	save(t, f, &client.MetadataSyncRequest{
+		Generation: "g1",
+		Updates:    objects(object("3", "c")),
+		Removes:    objects(object("1", "a")),
+	})
+	expectRestore(t, NewFiles(dir, 0600, nil), "g1", "b,c")
+
+	save(t, f, &client.MetadataSyncRequest{
+		Generation: "g2",
+		Full:       true,
+		Updates:    objects(object("4", "d")),
+	})
+	expectRestore(t, NewFiles(dir, 0600, nil), "g2", "d")
+	if _, err := os.Stat(path.Join(dir, "g1")); !os.IsNotExist(err) {
+		t.Errorf("Expected the previous generation to be deleted, got %v", err)
+	}
+
+	info, err := os.Stat(path.Join(dir, "g2", "4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600, got %v", info.Mode().Perm())
+	}
+
+	if err := f.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	expectRestore(t, NewFiles(dir, 0600, nil), "", "")
+}
+
+func TestFilesIgnoresTemporaryFiles(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	f := NewFiles(dir, 0600, nil)
+	save(t, f, &client.MetadataSyncRequest{
+		Generation: "g1",
+		Full:       true,
+		Updates:    objects(object("1", "a")),
+	})
+
+	// A write interrupted before its rename
+	if err := ioutil.WriteFile(path.Join(dir, "g1", "2.tmp"), []byte(`{"uuid": "2", "na`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	expectRestore(t, NewFiles(dir, 0600, nil), "g1", "a")
+}
+
+func TestFilesMissingGeneration(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	f := NewFiles(dir, 0600, nil)
+	save(t, f, &client.MetadataSyncRequest{
+		Generation: "g1",
+		Full:       true,
+		Updates:    objects(object("1", "a")),
+	})
+	if err := os.RemoveAll(path.Join(dir, "g1")); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewFiles(dir, 0600, nil)
+	if generation, _, err := restored.Restore(); err == nil {
+		t.Fatalf("Expected an error restoring a generation without its objects, got generation %q", generation)
+	}
+
+	// The subscriber clears what it can't restore and waits for a full sync
+	if err := restored.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	expectRestore(t, restored, "", "")
+}
+
+func TestFilesCorruptObject(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	f := NewFiles(dir, 0600, nil)
+	save(t, f, &client.MetadataSyncRequest{
+		Generation: "g1",
+		Full:       true,
+		Updates:    objects(object("1", "a")),
+	})
+	if err := ioutil.WriteFile(path.Join(dir, "g1", "1"), []byte(`{"uuid": "1", "na`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if generation, _, err := NewFiles(dir, 0600, nil).Restore(); err == nil {
+		t.Errorf("Expected an error restoring a truncated object, got generation %q", generation)
+	}
+}
@@ -0,0 +1,115 @@
+package subscriber
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// sealedMagic starts every sealed file and record, followed by the ID of the
+// key, the nonce and the AES-GCM ciphertext
+const sealedMagic = "MDE1"
+
+type key struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+// Keys encrypts the persisted content.  Content is sealed with the first key
+// and can be opened with any of them, so earlier keys can be kept around until
+// everything has been sealed again with the current one.
+type Keys struct {
+	keys []key
+}
+
+// NewKeys returns the keys for AES-128, AES-192 or AES-256 depending on their
+// length
+func NewKeys(current []byte, previous ...[]byte) (*Keys, error) {
+	k := &Keys{}
+	for _, secret := range append([][]byte{current}, previous...) {
+		block, err := aes.NewCipher(secret)
+		if err != nil {
+			return nil, err
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		sum := sha256.Sum256(secret)
+		k.keys = append(k.keys, key{
+			id:   sum[:4],
+			aead: aead,
+		})
+	}
+	return k, nil
+}
+
+// ParseKey decodes a base64 encoded key, surrounding whitespace such as the
+// trailing newline of a key file is ignored
+func ParseKey(data []byte) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("key is not base64 encoded: %v", err)
+	}
+
+	switch len(decoded) {
+	case 16, 24, 32:
+		return decoded, nil
+	}
+	return nil, fmt.Errorf("key is %d bytes, expected 16, 24 or 32", len(decoded))
+}
+
+func (k *Keys) seal(plain []byte) ([]byte, error) {
+	if k == nil {
+		return plain, nil
+	}
+
+	current := k.keys[0]
+	nonce := make([]byte, current.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	result := append([]byte(sealedMagic), current.id...)
+	result = append(result, nonce...)
+	return current.aead.Seal(result, nonce, plain, nil), nil
+}
+
+// open returns the plaintext of sealed content, and whether it has to be
+// sealed again because it is plaintext or was sealed with an earlier key
+func (k *Keys) open(data []byte) ([]byte, bool, error) {
+	if !bytes.HasPrefix(data, []byte(sealedMagic)) {
+		return data, k != nil, nil
+	}
+	if k == nil {
+		return nil, false, fmt.Errorf("content is encrypted but no key is configured")
+	}
+
+	data = data[len(sealedMagic):]
+	for i, key := range k.keys {
+		if !bytes.HasPrefix(data, key.id) {
+			continue
+		}
+
+		data = data[len(key.id):]
+		if len(data) < key.aead.NonceSize() {
+			return nil, false, fmt.Errorf("truncated encrypted content")
+		}
+
+		nonce, ciphertext := data[:key.aead.NonceSize()], data[key.aead.NonceSize():]
+		plain, err := key.aead.Open(nil, nonce, ciphertext, nil)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to decrypt: %v", err)
+		}
+		return plain, i > 0, nil
+	}
+
+	return nil, false, fmt.Errorf("content is encrypted with an unknown key")
+}
@@ -0,0 +1,173 @@
+package subscriber
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rancher/go-rancher/v3"
+)
+
+func newKeys(t *testing.T, secrets ...string) *Keys {
+	var parsed [][]byte
+	for _, secret := range secrets {
+		key, err := ParseKey([]byte(base64.StdEncoding.EncodeToString([]byte(secret))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed = append(parsed, key)
+	}
+
+	keys, err := NewKeys(parsed[0], parsed[1:]...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestParseKey(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	encoded := base64.StdEncoding.EncodeToString(key)
+
+	// The same key is read from the environment and from a file
+	for _, data := range []string{encoded, encoded + "\n", " " + encoded + " \n"} {
+		parsed, err := ParseKey([]byte(data))
+		if err != nil {
+			t.Errorf("%q: %v", data, err)
+		} else if !bytes.Equal(parsed, key) {
+			t.Errorf("%q: expected %q, got %q", data, key, parsed)
+		}
+	}
+
+	invalid := []string{
+		// Keys are not taken as raw bytes
+		string(key),
+		base64.StdEncoding.EncodeToString([]byte("0123456789")),
+		"",
+	}
+	for _, data := range invalid {
+		if parsed, err := ParseKey([]byte(data)); err == nil {
+			t.Errorf("%q: expected an error, got %q", data, parsed)
+		}
+	}
+}
+
+func TestSeal(t *testing.T) {
+	keys := newKeys(t, "0123456789abcdef0123456789abcdef")
+	plain := []byte(`{"uuid": "1"}`)
+
+	sealed, err := keys.seal(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, plain) || !bytes.HasPrefix(sealed, []byte(sealedMagic)) {
+		t.Errorf("Expected sealed content, got %q", sealed)
+	}
+
+	again, err := keys.seal(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(sealed, again) {
+		t.Errorf("Expected a new nonce every time")
+	}
+
+	opened, stale, err := keys.open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, plain) || stale {
+		t.Errorf("Expected %q, got %q stale %v", plain, opened, stale)
+	}
+
+	// Plaintext is read and sealed again
+	opened, stale, err = keys.open(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, plain) || !stale {
+		t.Errorf("Expected stale %q, got %q stale %v", plain, opened, stale)
+	}
+
+	var none *Keys
+	if unsealed, err := none.seal(plain); err != nil || !bytes.Equal(unsealed, plain) {
+		t.Errorf("Expected plaintext without keys, got %q %v", unsealed, err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	plain := []byte(`{"uuid": "1"}`)
+
+	sealed, err := newKeys(t, "previous-key-16b").seal(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := newKeys(t, "current current!", "previous-key-16b")
+	opened, stale, err := keys.open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, plain) || !stale {
+		t.Errorf("Expected stale %q, got %q stale %v", plain, opened, stale)
+	}
+
+	resealed, err := keys.seal(opened)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := newKeys(t, "current current!").open(resealed); err != nil {
+		t.Errorf("Expected content sealed again to open with the current key: %v", err)
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	sealed, err := newKeys(t, "0123456789abcdef").seal([]byte(`{"uuid": "1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := newKeys(t, "fedcba9876543210").open(sealed); err == nil || !strings.Contains(err.Error(), "unknown key") {
+		t.Errorf("Expected an unknown key error, got %v", err)
+	}
+
+	var none *Keys
+	if _, _, err := none.open(sealed); err == nil {
+		t.Errorf("Expected an error opening sealed content without a key")
+	}
+
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1]++
+	if _, _, err := newKeys(t, "0123456789abcdef").open(tampered); err == nil {
+		t.Errorf("Expected an error opening tampered content")
+	}
+
+	if _, _, err := newKeys(t, "0123456789abcdef").open(sealed[:len(sealedMagic)+6]); err == nil {
+		t.Errorf("Expected an error opening truncated content")
+	}
+}
+
+func TestSnapshotKeyRotation(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	save(t, NewSnapshot(dir, 0600, newKeys(t, "previous-key-16b")), &client.MetadataSyncRequest{
+		Generation: "g1",
+		Full:       true,
+		Updates:    objects(object("1", "a")),
+	})
+	save(t, NewSnapshot(dir, 0600, newKeys(t, "previous-key-16b")), &client.MetadataSyncRequest{
+		Generation: "g1",
+		Updates:    objects(object("2", "b")),
+	})
+
+	if _, _, err := NewSnapshot(dir, 0600, newKeys(t, "current current!")).Restore(); err == nil {
+		t.Errorf("Expected an error restoring without the previous key")
+	}
+
+	// Restoring with both keys seals everything with the current one
+	expectRestore(t, NewSnapshot(dir, 0600, newKeys(t, "current current!", "previous-key-16b")), "g1", "a,b")
+	expectRestore(t, NewSnapshot(dir, 0600, newKeys(t, "current current!")), "g1", "a,b")
+}
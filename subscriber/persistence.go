@@ -0,0 +1,197 @@
+package subscriber
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher/v3"
+)
+
+const (
+	NoPersistence       = "none"
+	FilesPersistence    = "files"
+	SnapshotPersistence = "snapshot"
+)
+
+// Persistence keeps the synced content on disk so it can be served right
+// after a restart
+type Persistence interface {
+	// Save persists a sync request that has been applied to the store
+	Save(request *client.MetadataSyncRequest) error
+	// Restore returns the persisted generation and its objects.  The
+	// generation is empty if the content is incomplete, in which case the
+	// objects are only served until the next full sync.
+	Restore() (string, map[string]interface{}, error)
+	// Clear removes the persisted generation so it is not restored
+	Clear() error
+}
+
+// NewPersistence returns the persistence of the given kind, keys may be nil to
+// persist plaintext
+func NewPersistence(kind, dir string, mode os.FileMode, keys *Keys) (Persistence, error) {
+	switch kind {
+	case NoPersistence:
+		return none{}, nil
+	case FilesPersistence:
+		return NewFiles(dir, mode, keys), nil
+	case SnapshotPersistence:
+		return NewSnapshot(dir, mode, keys), nil
+	}
+	return nil, fmt.Errorf("unknown persistence %s, expected %s, %s or %s", kind, NoPersistence, FilesPersistence, SnapshotPersistence)
+}
+
+type none struct{}
+
+func (none) Save(request *client.MetadataSyncRequest) error {
+	return nil
+}
+
+func (none) Restore() (string, map[string]interface{}, error) {
+	return "", nil, nil
+}
+
+func (none) Clear() error {
+	return nil
+}
+
+// dirMode is the mode of the directories holding files of the given mode, it
+// can be listed by whoever can read the files
+func dirMode(mode os.FileMode) os.FileMode {
+	return mode | (mode&0444)>>2
+}
+
+func writeAtomic(base, name string, obj interface{}, mode os.FileMode, keys *Keys) error {
+	file := path.Join(base, name)
+	temp := file + ".tmp"
+
+	logrus.Debugf("Writing %s", file)
+
+	var (
+		bytes []byte
+		err   error
+	)
+	if s, ok := obj.(string); ok {
+		bytes = []byte(s)
+	} else if bytes, err = json.Marshal(obj); err != nil {
+		return err
+	}
+
+	if bytes, err = keys.seal(bytes); err != nil {
+		return err
+	}
+
+	os.MkdirAll(path.Dir(temp), dirMode(mode))
+	f, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(bytes); err != nil {
+		f.Close()
+		os.Remove(temp)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(temp)
+		return err
+	}
+
+	return os.Rename(temp, file)
+}
+
+// readSealed reads a file written by writeAtomic, and whether it has to be
+// written again to seal it with the current key
+func readSealed(file string, keys *Keys) ([]byte, bool, error) {
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, false, err
+	}
+
+	plain, stale, err := keys.open(bytes)
+	if err != nil {
+		return nil, false, fmt.Errorf("%s: %v", file, err)
+	}
+	return plain, stale, nil
+}
+
+// removeExcept deletes everything in dir other than the named entries
+func removeExcept(dir string, keep ...string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+outer:
+	for _, file := range files {
+		for _, name := range keep {
+			if file.Name() == name {
+				continue outer
+			}
+		}
+
+		fullName := path.Join(dir, file.Name())
+		logrus.Infof("Deleting %s", fullName)
+		os.RemoveAll(fullName)
+	}
+
+	return nil
+}
+
+// removeOwned deletes the entries of dir whose names start with prefix, other
+// than the named ones, so that files of others in dir are left alone
+func removeOwned(dir, prefix string, keep ...string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+outer:
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), prefix) {
+			continue
+		}
+		for _, name := range keep {
+			if file.Name() == name {
+				continue outer
+			}
+		}
+
+		fullName := path.Join(dir, file.Name())
+		logrus.Infof("Deleting %s", fullName)
+		os.RemoveAll(fullName)
+	}
+
+	return nil
+}
+
+// removeGeneration deletes a generation persisted as one file per object
+func removeGeneration(dir, generation string) error {
+	if err := removeFiles(dir, generationFile); err != nil {
+		return err
+	}
+
+	if generation == "" || generation == "." || generation == ".." || path.Base(generation) != generation {
+		return nil
+	}
+
+	fullName := path.Join(dir, generation)
+	logrus.Infof("Deleting %s", fullName)
+	return os.RemoveAll(fullName)
+}
+
+// removeFiles deletes the named files in dir, ignoring those that do not exist
+func removeFiles(dir string, names ...string) error {
+	var lastError error
+	for _, name := range names {
+		if err := os.Remove(path.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			lastError = err
+		}
+	}
+	return lastError
+}
@@ -0,0 +1,129 @@
+package subscriber
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/rancher/go-rancher/v3"
+)
+
+func TestRecord(t *testing.T) {
+	r := record{
+		Generation: "g1",
+		Updates:    objects(object("1", "a")),
+	}
+	line, err := encodeRecord(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, stale, err := decodeRecord(line, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale || decoded.Generation != "g1" || decoded.Updates["1"] == nil {
+		t.Errorf("Expected the record back, got %+v stale %v", decoded, stale)
+	}
+
+	corrupt := append([]byte{}, line...)
+	corrupt[len(corrupt)-3]++
+	badSum := append([]byte("zzzzzzzz"), line[8:]...)
+
+	tests := []struct {
+		name string
+		line []byte
+	}{
+		{"truncated", line[:len(line)-4]},
+		{"without newline", line[:len(line)-1]},
+		{"empty", []byte("\n")},
+		{"corrupt payload", corrupt},
+		{"invalid checksum", badSum},
+	}
+	for _, test := range tests {
+		if _, _, err := decodeRecord(test.line, nil); err == nil {
+			t.Errorf("%s: expected an error decoding %q", test.name, test.line)
+		}
+	}
+}
+
+func TestSnapshotMigration(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	save(t, NewFiles(dir, 0600, nil), &client.MetadataSyncRequest{
+		Generation: "g1",
+		Full:       true,
+		Updates:    objects(object("1", "a"), object("2", "b")),
+	})
+	if err := ioutil.WriteFile(path.Join(dir, "notes"), []byte("notes"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The content persisted as one file per object is converted
+	expectRestore(t, NewSnapshot(dir, 0600, nil), "g1", "a,b")
+
+	for _, name := range []string{generationFile, "g1"} {
+		if _, err := os.Stat(path.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be deleted after the conversion, got %v", name, err)
+		}
+	}
+	if _, err := os.Stat(path.Join(dir, "notes")); err != nil {
+		t.Errorf("Expected other files to be kept: %v", err)
+	}
+
+	snapshot, err := ReadSnapshot(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot == nil || snapshot.Generation != "g1" || len(snapshot.Objects) != 2 {
+		t.Errorf("Expected a snapshot of g1 with 2 objects, got %+v", snapshot)
+	}
+	expectRestore(t, NewSnapshot(dir, 0600, nil), "g1", "a,b")
+}
+
+func TestWriteAtomic(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	base := path.Join(dir, "g1")
+	if err := writeAtomic(base, "1", object("1", "a"), 0640, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "1" || files[0].Mode().Perm() != 0640 {
+		t.Errorf("Expected only 1 with mode 0640, got %v", files)
+	}
+
+	info, err := os.Stat(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0750 {
+		t.Errorf("Expected the directory to be created with mode 0750, got %v", info.Mode().Perm())
+	}
+
+	obj, err := ReadObject(path.Join(base, "1"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj["name"] != "a" {
+		t.Errorf("Expected the object back, got %v", obj)
+	}
+}
+
+func TestNewPersistence(t *testing.T) {
+	for _, kind := range []string{NoPersistence, FilesPersistence, SnapshotPersistence} {
+		if _, err := NewPersistence(kind, "", 0600, nil); err != nil {
+			t.Errorf("%s: %v", kind, err)
+		}
+	}
+	if _, err := NewPersistence("bolt", "", 0600, nil); err == nil {
+		t.Errorf("Expected an error for an unknown persistence")
+	}
+}
@@ -0,0 +1,122 @@
+package subscriber
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/event-subscriber/events"
+)
+
+// RecordedEvent is one line of a recording
+type RecordedEvent struct {
+	Received time.Time     `json:"received"`
+	Event    *events.Event `json:"event"`
+}
+
+// Recorder appends the received sync events to a file as one JSON object per
+// line so they can be replayed later.  With keys every line is sealed like the
+// persisted content and base64 encoded instead.
+type Recorder struct {
+	sync.Mutex
+
+	file *os.File
+	keys *Keys
+}
+
+func NewRecorder(file string, keys *Keys) (*Recorder, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Recorder{
+		file: f,
+		keys: keys,
+	}, nil
+}
+
+func (r *Recorder) Record(event *events.Event) error {
+	line, err := json.Marshal(RecordedEvent{
+		Received: time.Now(),
+		Event:    event,
+	})
+	if err != nil {
+		return err
+	}
+
+	if r.keys != nil {
+		sealed, err := r.keys.seal(line)
+		if err != nil {
+			return err
+		}
+		line = []byte(base64.StdEncoding.EncodeToString(sealed))
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	_, err = r.file.Write(append(line, '\n'))
+	return err
+}
+
+func (r *Recorder) Close() error {
+	return r.file.Close()
+}
+
+// ReadRecording calls f with every event of a recording in order, opening
+// sealed lines with keys.  A last line without a newline that does not decode,
+// as left behind by a crash, ends the recording.
+func ReadRecording(reader io.Reader, keys *Keys, f func(*RecordedEvent) error) error {
+	buffered := bufio.NewReader(reader)
+	for i := 1; ; i++ {
+		line, err := buffered.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+
+		recorded, err := decodeEvent(line, keys)
+		if err != nil {
+			if line[len(line)-1] != '\n' {
+				logrus.Warnf("Recording ends with a truncated event on line %d", i)
+				return nil
+			}
+			return fmt.Errorf("line %d: %v", i, err)
+		}
+
+		if recorded.Event == nil {
+			continue
+		}
+
+		if err := f(recorded); err != nil {
+			return err
+		}
+	}
+}
+
+// decodeEvent decodes a line of a recording, JSON as recorded without keys or
+// sealed and base64 encoded
+func decodeEvent(line []byte, keys *Keys) (*RecordedEvent, error) {
+	line = bytes.TrimSpace(line)
+	if !bytes.HasPrefix(line, []byte("{")) {
+		sealed, err := base64.StdEncoding.DecodeString(string(line))
+		if err != nil {
+			return nil, err
+		}
+		if line, _, err = keys.open(sealed); err != nil {
+			return nil, err
+		}
+	}
+
+	recorded := &RecordedEvent{}
+	return recorded, json.Unmarshal(line, recorded)
+}
@@ -0,0 +1,94 @@
+package subscriber
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/rancher/event-subscriber/events"
+)
+
+// recordEvents records events named by ids and returns the recording
+func recordEvents(t *testing.T, keys *Keys, ids ...string) []byte {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "recording")
+	r, err := NewRecorder(file, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		err := r.Record(&events.Event{
+			ID:   id,
+			Name: syncEvent,
+			Data: map[string]interface{}{"secret": "s3cr3t"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	recording, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return recording
+}
+
+// readEvents returns the IDs of the events of a recording
+func readEvents(recording []byte, keys *Keys) (string, error) {
+	var ids []byte
+	err := ReadRecording(bytes.NewReader(recording), keys, func(recorded *RecordedEvent) error {
+		ids = append(ids, recorded.Event.ID...)
+		return nil
+	})
+	return string(ids), err
+}
+
+func TestRecording(t *testing.T) {
+	recording := recordEvents(t, nil, "a", "b")
+	if !bytes.Contains(recording, []byte("s3cr3t")) {
+		t.Errorf("Expected a plain JSON recording without keys, got %s", recording)
+	}
+	if ids, err := readEvents(recording, nil); err != nil || ids != "ab" {
+		t.Errorf("Expected events a and b, got %q %v", ids, err)
+	}
+
+	// A crash leaves the last line truncated
+	if ids, err := readEvents(recording[:len(recording)-5], nil); err != nil || ids != "a" {
+		t.Errorf("Expected the truncated event to end the recording, got %q %v", ids, err)
+	}
+}
+
+func TestSealedRecording(t *testing.T) {
+	keys := newKeys(t, "0123456789abcdef")
+
+	recording := recordEvents(t, keys, "a", "b")
+	if bytes.Contains(recording, []byte("s3cr3t")) {
+		t.Errorf("Expected the events to be sealed, got %s", recording)
+	}
+	if lines := bytes.Count(recording, []byte("\n")); lines != 2 {
+		t.Errorf("Expected one line per event, got %d", lines)
+	}
+
+	if ids, err := readEvents(recording, keys); err != nil || ids != "ab" {
+		t.Errorf("Expected events a and b, got %q %v", ids, err)
+	}
+	if _, err := readEvents(recording, nil); err == nil {
+		t.Errorf("Expected a sealed recording not to be read without keys")
+	}
+	if _, err := readEvents(recording, newKeys(t, "fedcba9876543210")); err == nil {
+		t.Errorf("Expected a sealed recording not to be read with another key")
+	}
+
+	// Recordings made before the key was set are still read
+	if ids, err := readEvents(recordEvents(t, nil, "c"), keys); err != nil || ids != "c" {
+		t.Errorf("Expected event c of a plain recording, got %q %v", ids, err)
+	}
+}
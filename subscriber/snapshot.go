@@ -0,0 +1,323 @@
+package subscriber
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher/v3"
+)
+
+const (
+	snapshotFile = "snapshot"
+	logFile      = "snapshot.log"
+
+	// compactRecords is the number of log records after which the log is
+	// folded into a new snapshot
+	compactRecords = 1000
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// record is one line of the snapshot or the log, written as the CRC-32C of
+// the payload in hex, a space and the payload.  The payload is the JSON
+// encoding, or its sealed form in base64 if the content is encrypted.
+type record struct {
+	Generation string                 `json:"generation"`
+	Full       bool                   `json:"full,omitempty"`
+	Updates    map[string]interface{} `json:"updates,omitempty"`
+	Removes    map[string]interface{} `json:"removes,omitempty"`
+}
+
+// Snapshot is the content restored from a snapshot and its log
+type Snapshot struct {
+	Generation string
+	Objects    map[string]interface{}
+	// Records is the number of log records applied on top of the snapshot
+	Records int
+	// Corrupt is set if a log record could not be read, that record and
+	// everything after it is left out
+	Corrupt error
+	// Stale is set if any record is not sealed with the current key
+	Stale bool
+}
+
+func encodeRecord(r record, keys *Keys) ([]byte, error) {
+	bytes, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if keys != nil {
+		sealed, err := keys.seal(bytes)
+		if err != nil {
+			return nil, err
+		}
+		bytes = []byte(base64.StdEncoding.EncodeToString(sealed))
+	}
+
+	line := fmt.Sprintf("%08x ", crc32.Checksum(bytes, crcTable))
+	return append(append([]byte(line), bytes...), '\n'), nil
+}
+
+// decodeRecord returns the record of a line, and whether it has to be sealed
+// again with the current key
+func decodeRecord(line []byte, keys *Keys) (record, bool, error) {
+	r := record{}
+
+	if len(line) < 10 || line[len(line)-1] != '\n' || line[8] != ' ' {
+		return r, false, fmt.Errorf("truncated record")
+	}
+
+	sum, err := strconv.ParseUint(string(line[:8]), 16, 32)
+	if err != nil {
+		return r, false, fmt.Errorf("invalid checksum: %v", err)
+	}
+
+	bytes := line[9 : len(line)-1]
+	if crc32.Checksum(bytes, crcTable) != uint32(sum) {
+		return r, false, fmt.Errorf("checksum mismatch")
+	}
+
+	if len(bytes) > 0 && bytes[0] != '{' {
+		if bytes, err = base64.StdEncoding.DecodeString(string(bytes)); err != nil {
+			return r, false, err
+		}
+	}
+
+	bytes, stale, err := keys.open(bytes)
+	if err != nil {
+		return r, false, err
+	}
+
+	return r, stale, json.Unmarshal(bytes, &r)
+}
+
+func readRecord(reader *bufio.Reader, keys *Keys) (record, bool, error) {
+	line, err := reader.ReadBytes('\n')
+	if err == io.EOF && len(line) == 0 {
+		return record{}, false, io.EOF
+	} else if err != nil && err != io.EOF {
+		return record{}, false, err
+	}
+	return decodeRecord(line, keys)
+}
+
+// ReadSnapshot reads the snapshot persisted under dir and applies its log.
+// Nil is returned if there is no snapshot.  A corrupt snapshot is an error,
+// while a corrupt log only leaves out the records from that point on.
+func ReadSnapshot(dir string, keys *Keys) (*Snapshot, error) {
+	f, err := os.Open(path.Join(dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	full, stale, err := readRecord(bufio.NewReader(f), keys)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path.Join(dir, snapshotFile), err)
+	}
+
+	snapshot := &Snapshot{
+		Generation: full.Generation,
+		Objects:    full.Updates,
+		Stale:      stale,
+	}
+	if snapshot.Objects == nil {
+		snapshot.Objects = map[string]interface{}{}
+	}
+
+	log, err := os.Open(path.Join(dir, logFile))
+	if os.IsNotExist(err) {
+		return snapshot, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer log.Close()
+
+	reader := bufio.NewReader(log)
+	for {
+		r, stale, err := readRecord(reader, keys)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			snapshot.Corrupt = fmt.Errorf("%s record %d: %v", path.Join(dir, logFile), snapshot.Records+1, err)
+			break
+		}
+
+		snapshot.Records++
+		snapshot.Stale = snapshot.Stale || stale
+		if r.Generation != snapshot.Generation {
+			continue
+		}
+
+		for uuid, obj := range r.Updates {
+			snapshot.Objects[uuid] = obj
+		}
+		for uuid := range r.Removes {
+			delete(snapshot.Objects, uuid)
+		}
+	}
+
+	return snapshot, nil
+}
+
+// snapshotLog persists a full snapshot written on every full sync and a log of
+// the incremental updates since, which is folded into a new snapshot once it
+// gets long
+type snapshotLog struct {
+	dir     string
+	mode    os.FileMode
+	keys    *Keys
+	records int
+}
+
+func NewSnapshot(dir string, mode os.FileMode, keys *Keys) Persistence {
+	return &snapshotLog{
+		dir:  dir,
+		mode: mode,
+		keys: keys,
+	}
+}
+
+func (s *snapshotLog) Save(request *client.MetadataSyncRequest) error {
+	if !request.Full {
+		return s.appendLog(request.Generation, request.Updates, request.Removes)
+	}
+
+	if err := s.writeSnapshot(request.Generation, request.Updates); err != nil {
+		return err
+	}
+
+	logrus.Infof("New generation %s", request.Generation)
+	return removeOwned(s.dir, snapshotFile, snapshotFile, logFile)
+}
+
+// Restore falls back to content persisted as one file per object and
+// converts it to a snapshot.  A snapshot that is not sealed with the current
+// key is compacted to seal it again.
+func (s *snapshotLog) Restore() (string, map[string]interface{}, error) {
+	snapshot, err := ReadSnapshot(s.dir, s.keys)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if snapshot == nil {
+		return s.restoreFiles()
+	}
+
+	s.records = snapshot.Records
+
+	if snapshot.Corrupt != nil {
+		logrus.Errorf("Restored generation %s up to a corrupt record, requesting a full sync: %v", snapshot.Generation, snapshot.Corrupt)
+		return "", snapshot.Objects, nil
+	}
+
+	if snapshot.Stale {
+		logrus.Infof("Encrypting generation %s with the current key", snapshot.Generation)
+		if err := s.writeSnapshot(snapshot.Generation, snapshot.Objects); err != nil {
+			return "", nil, err
+		}
+	}
+
+	return snapshot.Generation, snapshot.Objects, nil
+}
+
+func (s *snapshotLog) restoreFiles() (string, map[string]interface{}, error) {
+	generation, vals, _, err := readFiles(s.dir, s.keys)
+	if err != nil || generation == "" {
+		return "", nil, err
+	}
+
+	if err := s.writeSnapshot(generation, vals); err != nil {
+		logrus.Errorf("Failed to convert generation %s to a snapshot, requesting a full sync: %v", generation, err)
+		return "", vals, nil
+	}
+
+	return generation, vals, removeGeneration(s.dir, generation)
+}
+
+func (s *snapshotLog) Clear() error {
+	return removeFiles(s.dir, generationFile, snapshotFile, logFile)
+}
+
+// writeSnapshot replaces the snapshot and starts a new log
+func (s *snapshotLog) writeSnapshot(generation string, objects map[string]interface{}) error {
+	bytes, err := encodeRecord(record{
+		Generation: generation,
+		Full:       true,
+		Updates:    objects,
+	}, s.keys)
+	if err != nil {
+		return err
+	}
+
+	// The record is sealed already
+	if err := writeAtomic(s.dir, snapshotFile, string(bytes), s.mode, nil); err != nil {
+		return err
+	}
+
+	s.records = 0
+	return removeFiles(s.dir, logFile)
+}
+
+// appendLog appends an incremental update to the log and compacts the log
+// once it gets long
+func (s *snapshotLog) appendLog(generation string, updates, removes map[string]interface{}) error {
+	bytes, err := encodeRecord(record{
+		Generation: generation,
+		Updates:    updates,
+		Removes:    removes,
+	}, s.keys)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path.Join(s.dir, logFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, s.mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(bytes)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	s.records++
+	if s.records >= compactRecords {
+		return s.compact()
+	}
+
+	return nil
+}
+
+// compact folds the log into a new snapshot
+func (s *snapshotLog) compact() error {
+	snapshot, err := ReadSnapshot(s.dir, s.keys)
+	if err != nil {
+		return err
+	}
+	if snapshot == nil {
+		return fmt.Errorf("no snapshot to compact")
+	}
+	if snapshot.Corrupt != nil {
+		return snapshot.Corrupt
+	}
+
+	return s.writeSnapshot(snapshot.Generation, snapshot.Objects)
+}
@@ -0,0 +1,269 @@
+package subscriber
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher/v3"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		logrus.SetOutput(ioutil.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "persistence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func object(uuid, name string) map[string]interface{} {
+	return map[string]interface{}{
+		"infoType":   "stack",
+		"infoTypeId": uuid,
+		"uuid":       uuid,
+		"name":       name,
+	}
+}
+
+func objects(objs ...map[string]interface{}) map[string]interface{} {
+	result := map[string]interface{}{}
+	for _, obj := range objs {
+		result[obj["uuid"].(string)] = obj
+	}
+	return result
+}
+
+func save(t *testing.T, p Persistence, request *client.MetadataSyncRequest) {
+	if err := p.Save(request); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+}
+
+// expectRestore restores p and checks the generation and the names of the
+// objects
+func expectRestore(t *testing.T, p Persistence, generation, names string) {
+	actualGeneration, vals, err := p.Restore()
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+
+	var actual []string
+	for _, val := range vals {
+		actual = append(actual, val.(map[string]interface{})["name"].(string))
+	}
+	sort.Strings(actual)
+
+	if actualGeneration != generation || strings.Join(actual, ",") != names {
+		t.Errorf("Restore: expected generation %q with %q, got %q with %q", generation, names, actualGeneration, strings.Join(actual, ","))
+	}
+}
+
+func logRecords(t *testing.T, dir string) int {
+	bytes, err := ioutil.ReadFile(path.Join(dir, logFile))
+	if os.IsNotExist(err) {
+		return 0
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(bytes), "\n")
+}
+
+func TestSnapshotLog(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := NewSnapshot(dir, 0600, nil)
+	expectRestore(t, s, "", "")
+
+	save(t, s, &client.MetadataSyncRequest{
+		Generation: "g1",
+		Full:       true,
+		Updates:    objects(object("1", "a"), object("2", "b")),
+	})
+	save(t, s, &client.MetadataSyncRequest{
+		Generation: "g1",
+		Updates:    objects(object("3", "c")),
+		Removes:    objects(object("1", "a")),
+	})
+	// Records of another generation are left out
+	save(t, s, &client.MetadataSyncRequest{
+		Generation: "g0",
+		Updates:    objects(object("4", "d")),
+	})
+
+	if records := logRecords(t, dir); records != 2 {
+		t.Errorf("Expected 2 log records, got %d", records)
+	}
+	expectRestore(t, NewSnapshot(dir, 0600, nil), "g1", "b,c")
+
+	save(t, s, &client.MetadataSyncRequest{
+		Generation: "g2",
+		Full:       true,
+		Updates:    objects(object("5", "e")),
+	})
+	if records := logRecords(t, dir); records != 0 {
+		t.Errorf("Expected the log to be removed on a full sync, got %d records", records)
+	}
+	expectRestore(t, NewSnapshot(dir, 0600, nil), "g2", "e")
+
+	if err := s.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	expectRestore(t, NewSnapshot(dir, 0600, nil), "", "")
+}
+
+func TestSnapshotCompaction(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := NewSnapshot(dir, 0600, nil)
+	save(t, s, &client.MetadataSyncRequest{
+		Generation: "g1",
+		Full:       true,
+		Updates:    objects(object("0", "a")),
+	})
+
+	for i := 1; i < compactRecords; i++ {
+		save(t, s, &client.MetadataSyncRequest{
+			Generation: "g1",
+			Updates:    objects(object("1", "b")),
+		})
+	}
+	if records := logRecords(t, dir); records != compactRecords-1 {
+		t.Fatalf("Expected %d log records, got %d", compactRecords-1, records)
+	}
+
+	save(t, s, &client.MetadataSyncRequest{
+		Generation: "g1",
+		Updates:    objects(object("2", "c")),
+	})
+	if records := logRecords(t, dir); records != 0 {
+		t.Errorf("Expected the log to be compacted after %d records, got %d records", compactRecords, records)
+	}
+	expectRestore(t, NewSnapshot(dir, 0600, nil), "g1", "a,b,c")
+
+	// The count starts over after a compaction, also after a restart
+	restored := NewSnapshot(dir, 0600, nil)
+	expectRestore(t, restored, "g1", "a,b,c")
+	save(t, restored, &client.MetadataSyncRequest{
+		Generation: "g1",
+		Removes:    objects(object("0", "a")),
+	})
+	if records := logRecords(t, dir); records != 1 {
+		t.Errorf("Expected 1 log record after the compaction, got %d", records)
+	}
+	expectRestore(t, NewSnapshot(dir, 0600, nil), "g1", "b,c")
+}
+
+func TestSnapshotCorruptLog(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(log []byte) []byte
+		names   string
+	}{
+		{
+			name: "truncated tail",
+			corrupt: func(log []byte) []byte {
+				return log[:len(log)-5]
+			},
+			names: "a,b,c",
+		},
+		{
+			name: "checksum mismatch",
+			corrupt: func(log []byte) []byte {
+				// Change the name of the second record from c to x
+				i := strings.Index(string(log), `"c"`)
+				log[i+1] = 'x'
+				return log
+			},
+			names: "a,b",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+
+			s := NewSnapshot(dir, 0600, nil)
+			save(t, s, &client.MetadataSyncRequest{
+				Generation: "g1",
+				Full:       true,
+				Updates:    objects(object("1", "a")),
+			})
+			for _, obj := range []map[string]interface{}{object("2", "b"), object("3", "c"), object("4", "d")} {
+				save(t, s, &client.MetadataSyncRequest{
+					Generation: "g1",
+					Updates:    objects(obj),
+				})
+			}
+
+			file := path.Join(dir, logFile)
+			log, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(file, test.corrupt(log), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			// The records up to the corrupt one are served, but the
+			// generation is not restored so that a full sync is requested
+			restored := NewSnapshot(dir, 0600, nil)
+			expectRestore(t, restored, "", test.names)
+
+			save(t, restored, &client.MetadataSyncRequest{
+				Generation: "g2",
+				Full:       true,
+				Updates:    objects(object("5", "e")),
+			})
+			save(t, restored, &client.MetadataSyncRequest{
+				Generation: "g2",
+				Updates:    objects(object("6", "f")),
+			})
+			expectRestore(t, NewSnapshot(dir, 0600, nil), "g2", "e,f")
+		})
+	}
+}
+
+func TestSnapshotKeepsOtherFiles(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"metadata.db", "notes", snapshotFile + ".tmp"} {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	save(t, NewSnapshot(dir, 0600, nil), &client.MetadataSyncRequest{
+		Generation: "g1",
+		Full:       true,
+		Updates:    objects(object("1", "a")),
+	})
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	if actual := strings.Join(names, ","); actual != "metadata.db,notes,snapshot" {
+		t.Errorf("Expected only the files of the snapshot to be replaced, got %s", actual)
+	}
+}
@@ -1,15 +1,11 @@
 package subscriber
 
 import (
-	"encoding/json"
-	"io/ioutil"
-	"os"
-	"path"
+	"fmt"
+	"io"
 	"sync"
 	"time"
 
-	"strings"
-
 	"github.com/Sirupsen/logrus"
 	"github.com/mitchellh/mapstructure"
 	"github.com/rancher/event-subscriber/events"
@@ -17,30 +13,79 @@ import (
 	"github.com/rancher/metadata/content"
 )
 
-const data = "./metadata-content"
-const generationFile = "generation"
+const (
+	syncEvent = "metadata.sync"
+
+	// maxPending bounds the syncs buffered while waiting for a full sync, the
+	// oldest are dropped first as they are the most likely to be part of it
+	maxPending = 1000
+)
 
 type Subscriber struct {
 	sync.Mutex
 
-	client     *client.RancherClient
-	opts       *client.ClientOpts
-	store      content.Store
-	router     *events.EventRouter
-	generation string
+	client      *client.RancherClient
+	opts        *client.ClientOpts
+	store       content.Store
+	router      *events.EventRouter
+	generation  string
+	persistence Persistence
+	strict      bool
+	recorder    *Recorder
+
+	// pending holds the incremental syncs received while a full sync is
+	// requested.  Cattle may send some of them after it took the content of
+	// the full sync, so those of its generation are applied after it in the
+	// order they were received.
+	pending []*client.MetadataSyncRequest
+
+	outOfSyncSince time.Time
+	resyncRequests int
+	invalidObjects int
+	rejectedSyncs  int
+
+	digest           *digest
+	digestMismatches int
+}
+
+// Status reports whether the store is in sync with Cattle
+type Status struct {
+	Generation       string  `json:"generation"`
+	InSync           bool    `json:"inSync"`
+	OutOfSyncSeconds float64 `json:"outOfSyncSeconds"`
+	Buffered         int     `json:"buffered"`
+	ResyncRequests   int     `json:"resyncRequests"`
+	InvalidObjects   int     `json:"invalidObjects"`
+	RejectedSyncs    int     `json:"rejectedSyncs"`
+	DigestMismatches int     `json:"digestMismatches"`
+}
+
+// syncDigest is the part of a sync request the generated client does not
+// know about
+type syncDigest struct {
+	Digest string `mapstructure:"digest"`
 }
 
-func NewSubscriber(opts *client.ClientOpts, store content.Store) (*Subscriber, error) {
+// NewSubscriber returns a subscriber applying syncs to the store.  If strict
+// is set syncs with invalid objects are rejected as a whole, otherwise the
+// invalid objects are served as far as they could be decoded.
+func NewSubscriber(opts *client.ClientOpts, store content.Store, persistence Persistence, strict bool) (*Subscriber, error) {
 	s := &Subscriber{
-		opts:  opts,
-		store: store,
+		opts:        opts,
+		store:       store,
+		persistence: persistence,
+		strict:      strict,
+		digest:      newDigest(),
 	}
 
 	if err := s.restore(); err != nil {
-		s.clearGeneration()
 		return nil, err
 	}
 
+	if s.generation == "" {
+		s.outOfSyncSince = time.Now()
+	}
+
 	return s, nil
 }
 
@@ -48,7 +93,9 @@ func (s *Subscriber) Start() {
 	for {
 		client, err := client.NewRancherClient(s.opts)
 		if err == nil {
+			s.Lock()
 			s.client = client
+			s.Unlock()
 			break
 		}
 
@@ -58,7 +105,7 @@ func (s *Subscriber) Start() {
 
 	for {
 		router, err := events.NewEventRouter(s.client, 2, map[string]events.EventHandler{
-			"metadata.sync": events.EventHandler(s.sync),
+			syncEvent: events.EventHandler(s.sync),
 		})
 		if err == nil {
 			s.router = router
@@ -77,46 +124,35 @@ func (s *Subscriber) Start() {
 	}
 }
 
+// SetRecorder records every sync event received from now on
+func (s *Subscriber) SetRecorder(recorder *Recorder) {
+	s.Lock()
+	defer s.Unlock()
+	s.recorder = recorder
+}
+
 func (s *Subscriber) sync(event *events.Event, c *client.RancherClient) error {
 	s.Lock()
 	defer s.Unlock()
 
 	start := time.Now()
 
-	reload := false
-	request := &client.MetadataSyncRequest{}
-	if err := mapstructure.Decode(event.Data["metadataSyncRequest"], request); err != nil {
-		return err
-	}
-	if request.Full {
-		s.store.Reload(request.Updates)
-		s.generation = request.Generation
-		if err := s.save(request); err != nil {
-			return err
-		}
-	} else if s.generation == request.Generation {
-		for _, obj := range request.Updates {
-			s.store.Add(obj.(map[string]interface{}))
+	if s.recorder != nil {
+		if err := s.recorder.Record(event); err != nil {
+			logrus.Errorf("Failed to record event %s: %v", event.ID, err)
 		}
+	}
 
-		for _, obj := range request.Removes {
-			s.store.Remove(obj.(map[string]interface{}))
-		}
-		if err := s.save(request); err != nil {
-			return err
-		}
-	} else {
-		s.Reload()
-		reload = true
+	data, err := s.handle(event)
+	if err != nil {
+		return err
 	}
 
 	publishStart := time.Now()
-	_, err := c.Publish.Create(&client.Publish{
+	_, err = c.Publish.Create(&client.Publish{
 		Name:       event.ReplyTo,
 		PreviousId: event.ID,
-		Data: map[string]interface{}{
-			"reload": reload,
-		},
+		Data:       data,
 	})
 
 	end := time.Now()
@@ -125,146 +161,297 @@ func (s *Subscriber) sync(event *events.Event, c *client.RancherClient) error {
 	return err
 }
 
-func (s *Subscriber) Reload() {
-	logrus.Info("Requesting reload, on next event")
-	s.generation = ""
-}
+// handle applies a sync event and returns the data of the reply
+func (s *Subscriber) handle(event *events.Event) (map[string]interface{}, error) {
+	reload := false
+	request := &client.MetadataSyncRequest{}
+	if err := mapstructure.Decode(event.Data["metadataSyncRequest"], request); err != nil {
+		return nil, err
+	}
 
-func (s *Subscriber) save(request *client.MetadataSyncRequest) error {
-	base := path.Join(data, request.Generation)
-	if request.Full {
-		if err := os.RemoveAll(base); !os.IsNotExist(err) && err != nil {
-			return err
-		}
+	expected := syncDigest{}
+	if err := mapstructure.Decode(event.Data["metadataSyncRequest"], &expected); err != nil {
+		return nil, err
 	}
 
-	var lastError error
-	for uuid, obj := range request.Updates {
-		if err := s.writeAtomic(base, uuid, obj); err != nil {
-			lastError = err
-			continue
+	invalid := s.validate(request)
+	if len(invalid) > 0 && s.strict {
+		logrus.Errorf("Rejecting sync of generation %s with %d invalid objects", request.Generation, len(invalid))
+		s.rejectedSyncs++
+		s.reload()
+		reload = true
+	} else if request.Full {
+		if err := s.store.Reload(request.Updates); err != nil {
+			logrus.Errorf("Failed to apply the full sync of generation %s: %v", request.Generation, err)
+			s.reload()
+			reload = true
+		} else {
+			s.generation = request.Generation
+			s.outOfSyncSince = time.Time{}
+			s.digest.apply(request)
+			if err := s.persistence.Save(request); err != nil {
+				return nil, err
+			}
+			if reload, err = s.applyPending(); err != nil {
+				return nil, err
+			}
+		}
+	} else if s.generation == request.Generation {
+		// The store may be partly updated, it is not persisted and a full sync
+		// replaces it
+		if err := s.apply(request); err != nil {
+			logrus.Errorf("Failed to apply a sync of generation %s: %v", request.Generation, err)
+			if err := s.discard(); err != nil {
+				return nil, err
+			}
+			reload = true
+		} else if err := s.persistence.Save(request); err != nil {
+			return nil, err
 		}
+	} else {
+		logrus.Debugf("Buffering sync of generation %s until a full sync, expected %q", request.Generation, s.generation)
+		s.buffer(request)
+		s.reload()
+		reload = true
 	}
 
-	for uuid := range request.Removes {
-		if err := os.Remove(path.Join(base, uuid)); !os.IsNotExist(err) && err != nil {
-			lastError = err
-			continue
-		}
+	data := map[string]interface{}{
+		"reload": reload,
+	}
+	if len(invalid) > 0 {
+		data["invalid"] = invalid
+	}
+
+	digest := s.digest.value()
+	data["digest"] = digest
+	if !reload && expected.Digest != "" && expected.Digest != digest {
+		logrus.Errorf("Digest %s of generation %s does not match the expected %s", digest, s.generation, expected.Digest)
+		s.digestMismatches++
+		s.reload()
+		data["reload"] = true
+	}
+
+	if data["reload"] == true {
+		s.resyncRequests++
 	}
 
-	if request.Full {
-		if err := s.writeAtomic(data, generationFile, request.Generation); err != nil {
-			return err
+	return data, nil
+}
+
+// Replay applies the sync events of a recording sealed with keys, waiting
+// between them for the recorded time divided by speed.  A speed of 0 applies
+// them without waiting.
+func (s *Subscriber) Replay(reader io.Reader, keys *Keys, speed float64) error {
+	var last time.Time
+	return ReadRecording(reader, keys, func(recorded *RecordedEvent) error {
+		if recorded.Event.Name != syncEvent {
+			return nil
+		}
+
+		if speed > 0 && !last.IsZero() {
+			time.Sleep(time.Duration(float64(recorded.Received.Sub(last)) / speed))
 		}
+		last = recorded.Received
 
-		logrus.Infof("New generation %s", request.Generation)
+		s.Lock()
+		_, err := s.handle(recorded.Event)
+		generation := s.generation
+		s.Unlock()
 
-		files, err := ioutil.ReadDir(data)
+		received := recorded.Received.Format(time.RFC3339Nano)
 		if err != nil {
-			return err
+			logrus.Errorf("Failed to replay event %s received at %s: %v", recorded.Event.ID, received, err)
+		} else {
+			logrus.Infof("Replayed event %s received at %s, generation is %q", recorded.Event.ID, received, generation)
 		}
+		return nil
+	})
+}
 
-		for _, file := range files {
-			if file.Name() == generationFile || file.Name() == request.Generation {
-				continue
-			}
+// validate returns the updates that do not have the shape of their type
+func (s *Subscriber) validate(request *client.MetadataSyncRequest) []*content.ValidationError {
+	var invalid []*content.ValidationError
+	for uuid, obj := range request.Updates {
+		val, ok := obj.(map[string]interface{})
+		if !ok {
+			invalid = append(invalid, &content.ValidationError{
+				UUID:   uuid,
+				Reason: fmt.Sprintf("expected an object, got %T", obj),
+			})
+			continue
+		}
 
-			fullName := path.Join(data, file.Name())
-			logrus.Infof("Deleting %s", fullName)
-			os.RemoveAll(fullName)
+		if err := content.Validate(val); err != nil {
+			logrus.Warn(err)
+			invalid = append(invalid, err.(*content.ValidationError))
 		}
 	}
 
-	return lastError
+	s.invalidObjects += len(invalid)
+	return invalid
 }
 
-func (s *Subscriber) restore() error {
-	generation, err := ioutil.ReadFile(path.Join(data, generationFile))
-	if os.IsNotExist(err) {
-		return nil
-	} else if err != nil {
-		return err
-	}
-
-	logrus.Debugf("Restoring generation %s", generation)
-
-	base := path.Join(data, string(generation))
-	files, err := ioutil.ReadDir(base)
-	if err != nil {
-		return err
+// buffer keeps an incremental sync until the next full sync
+func (s *Subscriber) buffer(request *client.MetadataSyncRequest) {
+	if len(s.pending) >= maxPending {
+		s.pending = s.pending[1:]
 	}
+	s.pending = append(s.pending, request)
+}
 
-	vals := map[string]interface{}{}
+// applyPending applies the buffered syncs of the generation of the full sync
+// just applied and drops the others.  It returns true if one could not be
+// written and another full sync is needed.
+func (s *Subscriber) applyPending() (bool, error) {
+	pending := s.pending
+	s.pending = nil
 
-	for _, file := range files {
-		if strings.HasSuffix(file.Name(), ".tmp") {
+	for _, request := range pending {
+		if request.Generation != s.generation {
+			logrus.Debugf("Dropping buffered sync of generation %s", request.Generation)
 			continue
 		}
 
-		obj := map[string]interface{}{}
-		filename := path.Join(base, file.Name())
-		logrus.Debugf("Loading %s", filename)
-		f, err := os.Open(filename)
-		if err != nil {
-			return err
+		if err := s.apply(request); err != nil {
+			logrus.Errorf("Failed to apply a buffered sync of generation %s: %v", request.Generation, err)
+			return true, s.discard()
 		}
-
-		err = json.NewDecoder(f).Decode(&obj)
-		f.Close()
-		if err != nil {
-			return err
+		if err := s.persistence.Save(request); err != nil {
+			return false, err
 		}
+	}
 
-		uuid, _ := obj["uuid"].(string)
-		if uuid != "" {
-			vals[uuid] = obj
+	return false, nil
+}
+
+// apply writes an incremental sync to the store and adds it to the digest
+func (s *Subscriber) apply(request *client.MetadataSyncRequest) error {
+	if err := s.write(request); err != nil {
+		return err
+	}
+	s.digest.apply(request)
+	return nil
+}
+
+func (s *Subscriber) write(request *client.MetadataSyncRequest) error {
+	if batch, ok := s.store.(content.Batch); ok {
+		return batch.Apply(request.Updates, request.Removes)
+	}
+
+	for _, obj := range request.Updates {
+		if val, ok := obj.(map[string]interface{}); ok {
+			if err := s.store.Add(val); err != nil {
+				return err
+			}
 		}
 	}
 
-	s.store.Reload(vals)
-	s.generation = string(generation)
-	logrus.Debugf("Generation %s", s.generation)
+	for _, obj := range request.Removes {
+		if val, ok := obj.(map[string]interface{}); ok {
+			if err := s.store.Remove(val); err != nil {
+				return err
+			}
+		}
+	}
 
 	return nil
 }
 
-func (s *Subscriber) clearGeneration() error {
-	err := os.Remove(path.Join(data, generationFile))
-	if os.IsNotExist(err) {
-		return nil
+// discard requests a full sync after a sync could not be applied.  The
+// persisted generation misses that sync and is cleared so it is not restored
+// on the next start.
+func (s *Subscriber) discard() error {
+	s.reload()
+	return s.persistence.Clear()
+}
+
+func (s *Subscriber) Reload() {
+	s.Lock()
+	defer s.Unlock()
+	s.reload()
+}
+
+// reload forgets the generation so incremental syncs are buffered rather than
+// applied, the replies ask Cattle for a full sync until one arrives.  Cattle
+// knows no other request for a full sync.
+func (s *Subscriber) reload() {
+	logrus.Info("Requesting full sync")
+	s.generation = ""
+	if s.outOfSyncSince.IsZero() {
+		s.outOfSyncSince = time.Now()
 	}
-	return err
 }
 
-func (s *Subscriber) writeAtomic(base, uuid string, obj interface{}) error {
-	file := path.Join(base, uuid)
-	temp := file + ".tmp"
+func (s *Subscriber) Status() Status {
+	s.Lock()
+	defer s.Unlock()
 
-	logrus.Debugf("Writing %s", file)
+	status := Status{
+		Generation:       s.generation,
+		InSync:           s.generation != "",
+		Buffered:         len(s.pending),
+		ResyncRequests:   s.resyncRequests,
+		InvalidObjects:   s.invalidObjects,
+		RejectedSyncs:    s.rejectedSyncs,
+		DigestMismatches: s.digestMismatches,
+	}
+	if !status.InSync {
+		status.OutOfSyncSeconds = time.Since(s.outOfSyncSince).Seconds()
+	}
+	return status
+}
 
-	os.MkdirAll(path.Dir(temp), 0700)
-	f, err := os.Create(temp)
+// restore loads the persisted content into the store.  Content that can not
+// be read is cleared and left for the next full sync to replace.
+func (s *Subscriber) restore() error {
+	generation, vals, err := s.persistence.Restore()
 	if err != nil {
-		return err
+		logrus.Errorf("Failed to restore, waiting for a full sync: %v", err)
+		return s.persistence.Clear()
 	}
 
-	if s, ok := obj.(string); ok {
-		if _, err := f.Write([]byte(s)); err != nil {
-			f.Close()
-			os.Remove(temp)
-			return err
+	if vals != nil {
+		if err := s.store.Reload(vals); err != nil {
+			logrus.Errorf("Failed to restore generation %s, waiting for a full sync: %v", generation, err)
+			return s.persistence.Clear()
 		}
-	} else if err := json.NewEncoder(f).Encode(obj); err != nil {
-		f.Close()
-		os.Remove(temp)
-		return err
 	}
 
-	if err := f.Close(); err != nil {
-		os.Remove(temp)
-		return err
+	s.generation = generation
+	s.digest.restore(vals)
+	logrus.Debugf("Generation %s", s.generation)
+
+	return nil
+}
+
+// Load reads the current generation persisted under dir into the store and
+// returns the generation.  An empty generation is returned if nothing has been
+// persisted yet.
+func Load(dir string, store content.Store, keys *Keys) (string, error) {
+	generation, vals, err := ReadGeneration(dir, keys)
+	if err != nil || generation == "" {
+		return "", err
 	}
 
-	return os.Rename(temp, file)
+	if err := store.Reload(vals); err != nil {
+		return "", err
+	}
+	return generation, nil
+}
+
+// ReadGeneration reads the objects of the current generation persisted under
+// dir, keyed by UUID.  Log records after a corrupt one are left out.
+func ReadGeneration(dir string, keys *Keys) (string, map[string]interface{}, error) {
+	snapshot, err := ReadSnapshot(dir, keys)
+	if err != nil {
+		return "", nil, err
+	}
+	if snapshot == nil {
+		generation, vals, _, err := readFiles(dir, keys)
+		return generation, vals, err
+	}
+	if snapshot.Corrupt != nil {
+		logrus.Warnf("Skipping the rest of the log: %v", snapshot.Corrupt)
+	}
+	return snapshot.Generation, snapshot.Objects, nil
 }
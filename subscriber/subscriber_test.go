@@ -0,0 +1,223 @@
+package subscriber
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/rancher/event-subscriber/events"
+	"github.com/rancher/go-rancher/v3"
+	"github.com/rancher/metadata/content"
+	"github.com/rancher/metadata/content/memory"
+)
+
+// failingStore fails its writes once fail is set, as a store does when its
+// disk is full, or only the incremental ones once failAdd is set
+type failingStore struct {
+	*memory.Store
+	fail    bool
+	failAdd bool
+}
+
+var errWrite = errors.New("no space left on device")
+
+func (f *failingStore) Add(val map[string]interface{}) error {
+	if f.fail || f.failAdd {
+		return errWrite
+	}
+	return f.Store.Add(val)
+}
+
+func (f *failingStore) Reload(vals map[string]interface{}) error {
+	if f.fail {
+		return errWrite
+	}
+	return f.Store.Reload(vals)
+}
+
+// handle applies a request as Cattle sends it
+func handle(t *testing.T, s *Subscriber, request *client.MetadataSyncRequest) map[string]interface{} {
+	bytes, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := map[string]interface{}{}
+	if err := json.Unmarshal(bytes, &sent); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := s.handle(&events.Event{
+		Data: map[string]interface{}{
+			"metadataSyncRequest": sent,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestWriteFailure(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	store := &failingStore{Store: memory.NewMemoryStore()}
+	s, err := NewSubscriber(nil, store, NewSnapshot(dir, 0600, nil), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handle(t, s, &client.MetadataSyncRequest{
+		Generation: "g1",
+		Full:       true,
+		Updates:    objects(object("1", "a")),
+	})
+
+	store.fail = true
+	data := handle(t, s, &client.MetadataSyncRequest{
+		Generation: "g1",
+		Updates:    objects(object("2", "b")),
+	})
+	if data["reload"] != true {
+		t.Errorf("Expected a full sync to be requested after a failed write, got %v", data)
+	}
+	if status := s.Status(); status.InSync || status.Generation != "" {
+		t.Errorf("Expected to be out of sync after a failed write, got %+v", status)
+	}
+	// The persisted generation misses the failed sync
+	expectRestore(t, NewSnapshot(dir, 0600, nil), "", "")
+
+	data = handle(t, s, &client.MetadataSyncRequest{
+		Generation: "g2",
+		Full:       true,
+		Updates:    objects(object("3", "c")),
+	})
+	if data["reload"] != true || s.Status().InSync {
+		t.Errorf("Expected a failed full sync not to be in sync, got %v", data)
+	}
+	expectRestore(t, NewSnapshot(dir, 0600, nil), "", "")
+
+	store.fail = false
+	data = handle(t, s, &client.MetadataSyncRequest{
+		Generation: "g2",
+		Full:       true,
+		Updates:    objects(object("3", "c")),
+	})
+	if data["reload"] != false || !s.Status().InSync {
+		t.Errorf("Expected to be in sync after the full sync, got %v", data)
+	}
+	expectRestore(t, NewSnapshot(dir, 0600, nil), "g2", "c")
+}
+
+func TestBufferedWriteFailure(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	store := &failingStore{Store: memory.NewMemoryStore()}
+	s, err := NewSubscriber(nil, store, NewSnapshot(dir, 0600, nil), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handle(t, s, &client.MetadataSyncRequest{
+		Generation: "g1",
+		Full:       true,
+		Updates:    objects(object("1", "a")),
+	})
+	handle(t, s, &client.MetadataSyncRequest{
+		Generation: "g2",
+		Updates:    objects(object("2", "b")),
+	})
+
+	store.failAdd = true
+	data := handle(t, s, &client.MetadataSyncRequest{
+		Generation: "g2",
+		Full:       true,
+		Updates:    objects(object("1", "a2")),
+	})
+	if data["reload"] != true {
+		t.Errorf("Expected a full sync to be requested after a buffered sync failed, got %v", data)
+	}
+	if status := s.Status(); status.InSync || status.Buffered != 0 {
+		t.Errorf("Expected to be out of sync with nothing buffered, got %+v", status)
+	}
+	expectRestore(t, NewSnapshot(dir, 0600, nil), "", "")
+}
+
+func TestBuffering(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	store := memory.NewMemoryStore()
+	s, err := NewSubscriber(nil, store, NewSnapshot(dir, 0600, nil), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handle(t, s, &client.MetadataSyncRequest{
+		Generation: "g1",
+		Full:       true,
+		Updates:    objects(object("1", "a")),
+	})
+
+	for _, request := range []*client.MetadataSyncRequest{
+		{Generation: "g2", Updates: objects(object("2", "b"))},
+		{Generation: "g3", Updates: objects(object("3", "c"))},
+		{Generation: "g2", Updates: objects(object("2", "b2")), Removes: objects(object("4", "d"))},
+	} {
+		if data := handle(t, s, request); data["reload"] != true {
+			t.Errorf("Expected a full sync to be requested for generation %s, got %v", request.Generation, data)
+		}
+	}
+	if status := s.Status(); status.InSync || status.Buffered != 3 {
+		t.Errorf("Expected 3 buffered syncs, got %+v", status)
+	}
+
+	data := handle(t, s, &client.MetadataSyncRequest{
+		Generation: "g2",
+		Full:       true,
+		Updates:    objects(object("1", "a2"), object("4", "d")),
+	})
+	if data["reload"] != false {
+		t.Errorf("Expected the full sync to be applied, got %v", data)
+	}
+	if status := s.Status(); !status.InSync || status.Buffered != 0 {
+		t.Errorf("Expected to be in sync with nothing buffered, got %+v", status)
+	}
+
+	// The syncs of g2 are applied in order on top of the full sync and
+	// persisted with it
+	var names []string
+	for _, obj := range store.All(content.StackType) {
+		names = append(names, obj.(*client.StackInfo).Name)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "a2,b2" {
+		t.Errorf("Expected a2,b2, got %v", names)
+	}
+	expectRestore(t, NewSnapshot(dir, 0600, nil), "g2", "a2,b2")
+}
+
+func TestBufferLimit(t *testing.T) {
+	s, err := NewSubscriber(nil, memory.NewMemoryStore(), none{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < maxPending+10; i++ {
+		handle(t, s, &client.MetadataSyncRequest{
+			Generation: "g1",
+			Updates:    objects(object(strconv.Itoa(i), "a")),
+		})
+	}
+	if status := s.Status(); status.Buffered != maxPending {
+		t.Errorf("Expected %d buffered syncs, got %d", maxPending, status.Buffered)
+	}
+	if first := s.pending[0].Updates; first["10"] == nil {
+		t.Errorf("Expected the oldest syncs to be dropped, got %v first", first)
+	}
+}
@@ -30,6 +30,7 @@ type ContainerResponse struct {
 	NetworkFromContainerUUID string                 `json:"network_from_container_uuid"`
 	NetworkUUID              string                 `json:"network_uuid"`
 	Ports                    []string               `json:"ports"`
+	PortMappings             []PortMapping          `json:"port_mappings"`
 	ServiceIndex             string                 `json:"service_index"`
 	ServiceUUID              string                 `json:"service_uuid"`
 	ServiceName              string                 `json:"service_name"`
@@ -74,3 +75,24 @@ type PublicEndpoint struct {
 func (p PublicEndpoint) String() string {
 	return fmt.Sprintf("%s:%d:%d/%s", p.BindIPAddress, p.PublicPort, p.PrivatePort, p.Protocol)
 }
+
+type PortMapping struct {
+	BindIP        string `json:"bind_ip"`
+	PublicPort    int64  `json:"public_port"`
+	PrivatePort   int64  `json:"private_port"`
+	Protocol      string `json:"protocol"`
+	HostUUID      string `json:"host_uuid"`
+	ContainerUUID string `json:"container_uuid"`
+}
+
+type Endpoint struct {
+	IP            string `json:"ip"`
+	Port          int64  `json:"port"`
+	Protocol      string `json:"protocol"`
+	HostUUID      string `json:"host_uuid"`
+	ContainerUUID string `json:"container_uuid"`
+}
+
+func (e Endpoint) String() string {
+	return fmt.Sprintf("%s:%d/%s", e.IP, e.Port, e.Protocol)
+}
@@ -2,7 +2,6 @@ package convert
 
 import (
 	"strconv"
-	"strings"
 
 	"github.com/rancher/go-rancher/v3"
 	"github.com/rancher/metadata/content"
@@ -86,21 +85,11 @@ func (c *ContainerWrapper) wrapped() interface{} {
 		container.StackName = stack.Name
 	}
 
+	container.Ports = []string{}
+	container.PortMappings = []types.PortMapping{}
 	for _, port := range c.Container.Ports {
-		portString := types.PublicEndpoint{
-			AgentIPAddress: port.AgentIpAddress,
-			BindAll:        port.BindAll,
-			BindIPAddress:  port.BindIpAddress,
-			FQDN:           port.Fqdn,
-			HostID:         port.HostId,
-			InstanceID:     port.InstanceId,
-			IPAddress:      port.IpAddress,
-			PrivatePort:    port.PrivatePort,
-			Protocol:       port.Protocol,
-			PublicPort:     port.PublicPort,
-			ServiceID:      port.ServiceId,
-		}.String()
-		container.Ports = append(container.Ports, portString)
+		container.Ports = append(container.Ports, publicEndpoint(port).String())
+		container.PortMappings = append(container.PortMappings, portMapping(port, c.Store))
 	}
 
 	container.Links = resolveContainerLinks(&container, c.Container, c.Store)
@@ -111,6 +100,16 @@ func (c *ContainerWrapper) wrapped() interface{} {
 	return &container
 }
 
+// ContainerPrimaryIP returns the address the container is reachable on, which
+// is the host's address for containers on the host network
+func ContainerPrimaryIP(container *client.InstanceInfo, store content.Store) string {
+	response := &types.ContainerResponse{
+		PrimaryIP: container.PrimaryIp,
+	}
+	setupNetworking(response, container, store)
+	return response.PrimaryIP
+}
+
 func setupNetworking(response *types.ContainerResponse, container *client.InstanceInfo, store content.Store) {
 	network := store.NetworkByID(container.NetworkId)
 	if network != nil && network.Kind == "host" {
@@ -141,13 +140,7 @@ func resolveContainerLinks(response *types.ContainerResponse, container *client.
 			alias = link.Name
 		}
 
-		stackName := response.StackName
-		containerName := link.Name
-		parts := strings.SplitN(link.Name, "/", 2)
-		if len(parts) == 2 {
-			stackName = parts[0]
-			containerName = parts[1]
-		}
+		stackName, containerName := LinkTarget(response.StackName, link.Name)
 
 		target := store.ContainerByName(container.EnvironmentUuid, stackName, containerName)
 		if target == nil {
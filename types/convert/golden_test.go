@@ -0,0 +1,212 @@
+package convert_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/metadata/content"
+	"github.com/rancher/metadata/content/memory"
+	"github.com/rancher/metadata/server"
+)
+
+var update = flag.Bool("update", false, "Rewrite the golden files in testdata with the actual output")
+
+// fixture describes the content of a store and the metadata paths to look up.
+// Each fixture testdata/<name>.json has its expected output in
+// testdata/<name>.golden, keyed by API version and then by "<client IP>
+// /<path>".
+type fixture struct {
+	// Objects are added to the store in order, in the form they are synced
+	Objects []map[string]interface{} `json:"objects"`
+	// Versions to look the paths up with, defaults to every version
+	Versions []string `json:"versions"`
+	Requests []struct {
+		IP   string `json:"ip"`
+		Path string `json:"path"`
+	} `json:"requests"`
+}
+
+func TestGolden(t *testing.T) {
+	if !testing.Verbose() {
+		logrus.SetOutput(ioutil.Discard)
+	}
+
+	files, err := filepath.Glob(filepath.Join("testdata", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("No fixtures in testdata")
+	}
+
+	for _, file := range files {
+		file := file
+		t.Run(strings.TrimSuffix(filepath.Base(file), ".json"), func(t *testing.T) {
+			runFixture(t, file)
+		})
+	}
+}
+
+func runFixture(t *testing.T, file string) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := fixture{}
+	if err := json.Unmarshal(data, &f); err != nil {
+		t.Fatalf("%s: %v", file, err)
+	}
+	if len(f.Versions) == 0 {
+		f.Versions = []string{content.V1, content.V2, content.V3, "latest"}
+	}
+
+	store := memory.NewMemoryStore()
+	for _, obj := range f.Objects {
+		store.Add(obj)
+	}
+
+	actual := map[string]map[string]interface{}{}
+	for _, version := range f.Versions {
+		actual[version] = map[string]interface{}{}
+		for _, request := range f.Requests {
+			p := strings.Trim(request.Path, "/")
+			var segments []string
+			if p != "" {
+				segments = strings.Split(p, "/")
+			}
+
+			key := request.IP + " /" + p
+			val, ok := server.Lookup(store, version, request.IP, segments)
+			if !ok {
+				actual[version][key] = "<not found>"
+				continue
+			}
+
+			normalized, err := normalize(val)
+			if err != nil {
+				t.Fatalf("%s %s: %v", version, key, err)
+			}
+			actual[version][key] = normalized
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(actual); err != nil {
+		t.Fatal(err)
+	}
+	output := buf.Bytes()
+
+	golden := strings.TrimSuffix(file, ".json") + ".golden"
+	if *update {
+		if err := ioutil.WriteFile(golden, output, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	expected, err := ioutil.ReadFile(golden)
+	if os.IsNotExist(err) {
+		t.Fatalf("%s does not exist, run the tests with -update to create it", golden)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := diffLines(string(expected), string(output)); diff != "" {
+		t.Errorf("Output differs from %s, run the tests with -update if the change is intended:\n%s", golden, diff)
+	}
+}
+
+// normalize converts a value to its JSON form as served.  Lists of objects
+// come out of the store in no particular order and are sorted by UUID, and the
+// version of the store changes on every run so it is left out.
+func normalize(val interface{}) (interface{}, error) {
+	bytes, err := json.Marshal(val)
+	if err != nil {
+		return nil, err
+	}
+
+	var result interface{}
+	if err := json.Unmarshal(bytes, &result); err != nil {
+		return nil, err
+	}
+
+	return sortObjects(result), nil
+}
+
+func sortObjects(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = sortObjects(item)
+		}
+		if _, ok := v["containers"]; ok && v["version"] != nil {
+			v["version"] = "<version>"
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = sortObjects(item)
+		}
+		sort.SliceStable(v, func(i, j int) bool {
+			return uuidOf(v[i]) < uuidOf(v[j])
+		})
+	}
+	return val
+}
+
+func uuidOf(val interface{}) string {
+	if obj, ok := val.(map[string]interface{}); ok {
+		uuid, _ := obj["uuid"].(string)
+		return uuid
+	}
+	return ""
+}
+
+// diffLines returns the lines that differ, prefixed with - if expected and +
+// if actual, with the line number of the expected output
+func diffLines(expected, actual string) string {
+	if expected == actual {
+		return ""
+	}
+
+	a := strings.Split(expected, "\n")
+	b := strings.Split(actual, "\n")
+
+	buf := &bytes.Buffer{}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case i < len(a) && indexOf(b[j:], a[i]) < 0:
+			fmt.Fprintf(buf, "%4d -%s\n", i+1, a[i])
+			i++
+		default:
+			fmt.Fprintf(buf, "%4d +%s\n", i+1, b[j])
+			j++
+		}
+	}
+	return buf.String()
+}
+
+func indexOf(lines []string, line string) int {
+	for i, l := range lines {
+		if l == line {
+			return i
+		}
+	}
+	return -1
+}
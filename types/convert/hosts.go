@@ -0,0 +1,128 @@
+package convert
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/rancher/go-rancher/v3"
+	"github.com/rancher/metadata/content"
+)
+
+const (
+	launchConfigLabel   = "io.rancher.service.launch.config"
+	primaryLaunchConfig = "io.rancher.service.primary.launch.config"
+)
+
+// HostsFile renders an /etc/hosts file for the client's container with its
+// own names, its link aliases and the names of its sidekicks
+func HostsFile(version, ip string, store content.Store) (string, bool) {
+	self := store.SelfContainer(content.Client{
+		Version: version,
+		IP:      ip,
+	})
+	if self == nil {
+		return "", false
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintln(buf, "127.0.0.1\tlocalhost")
+	fmt.Fprintln(buf, "::1\tlocalhost ip6-localhost ip6-loopback")
+
+	if selfIP := ContainerPrimaryIP(self, store); selfIP != "" {
+		names := []string{}
+		if self.Hostname != "" {
+			names = append(names, self.Hostname)
+		}
+		if self.Name != "" && self.Name != self.Hostname {
+			names = append(names, self.Name)
+		}
+		writeHostsLine(buf, selfIP, names)
+	}
+
+	stackName := ""
+	if stack := store.StackByID(self.StackId); stack != nil {
+		stackName = stack.Name
+	}
+
+	entries := map[string][]string{}
+	var ips []string
+	addEntry := func(ip, name string) {
+		if ip == "" || name == "" {
+			return
+		}
+		if _, ok := entries[ip]; !ok {
+			ips = append(ips, ip)
+		}
+		for _, existing := range entries[ip] {
+			if existing == name {
+				return
+			}
+		}
+		entries[ip] = append(entries[ip], name)
+	}
+
+	for _, link := range self.Links {
+		alias := link.Alias
+		if alias == "" {
+			alias = link.Name
+		}
+
+		targetStack, targetName := LinkTarget(stackName, link.Name)
+		target := store.ContainerByName(self.EnvironmentUuid, targetStack, targetName)
+		if target != nil {
+			addEntry(ContainerPrimaryIP(target, store), alias)
+		}
+	}
+
+	for _, sidekick := range sidekicks(self, store) {
+		ip := ContainerPrimaryIP(sidekick, store)
+		if name := sidekick.Labels[launchConfigLabel]; name != "" && name != primaryLaunchConfig {
+			addEntry(ip, name)
+		}
+		addEntry(ip, sidekick.Name)
+	}
+
+	sort.Strings(ips)
+	for _, ip := range ips {
+		writeHostsLine(buf, ip, entries[ip])
+	}
+
+	return buf.String(), true
+}
+
+func writeHostsLine(buf *bytes.Buffer, ip string, names []string) {
+	if len(names) == 0 {
+		return
+	}
+	fmt.Fprintf(buf, "%s\t", ip)
+	for i, name := range names {
+		if i > 0 {
+			buf.WriteString(" ")
+		}
+		buf.WriteString(name)
+	}
+	buf.WriteString("\n")
+}
+
+// sidekicks returns the other containers of the container's deployment unit
+func sidekicks(container *client.InstanceInfo, store content.Store) []*client.InstanceInfo {
+	var result []*client.InstanceInfo
+	if container.DeploymentUnitId == "" {
+		return result
+	}
+
+	for _, obj := range store.All(content.ContainerType) {
+		other := obj.(*client.InstanceInfo)
+		if other.Uuid != container.Uuid && other.DeploymentUnitId == container.DeploymentUnitId &&
+			other.EnvironmentUuid == container.EnvironmentUuid {
+			result = append(result, other)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+
+	return result
+}
@@ -0,0 +1,117 @@
+package convert_test
+
+import (
+	"testing"
+
+	"github.com/rancher/metadata/content"
+	"github.com/rancher/metadata/content/memory"
+	"github.com/rancher/metadata/types/convert"
+)
+
+func container(id, name string, fields map[string]interface{}) map[string]interface{} {
+	obj := map[string]interface{}{
+		"infoType":        "instance",
+		"infoTypeId":      id,
+		"uuid":            "container-" + id,
+		"name":            name,
+		"environmentUuid": "env-1",
+		"stackId":         "1",
+	}
+	for key, value := range fields {
+		obj[key] = value
+	}
+	return obj
+}
+
+func hostsStore(t *testing.T) content.Store {
+	store := memory.NewMemoryStore()
+	for _, obj := range []map[string]interface{}{
+		{"infoType": "environment", "infoTypeId": "1", "uuid": "env-1", "name": "Default"},
+		{"infoType": "stack", "infoTypeId": "1", "uuid": "stack-web", "name": "web", "environmentUuid": "env-1"},
+		{"infoType": "stack", "infoTypeId": "2", "uuid": "stack-db", "name": "db", "environmentUuid": "env-1"},
+		{"infoType": "host", "infoTypeId": "1", "uuid": "host-1", "name": "host-1", "agentIp": "192.168.0.10", "environmentUuid": "env-1"},
+		{"infoType": "network", "infoTypeId": "1", "uuid": "network-host", "kind": "host", "environmentUuid": "env-1"},
+
+		container("1", "web-1", map[string]interface{}{
+			"hostname":         "web-1",
+			"primaryIp":        "10.42.0.1",
+			"deploymentUnitId": "du-1",
+			"labels": map[string]interface{}{
+				"io.rancher.service.launch.config": "io.rancher.service.primary.launch.config",
+			},
+			"links": []interface{}{
+				map[string]interface{}{"name": "db/mysql-1", "alias": "database"},
+				map[string]interface{}{"name": "db/mysql-1", "alias": "mysql"},
+				map[string]interface{}{"name": "cache-1"},
+				map[string]interface{}{"name": "missing"},
+			},
+		}),
+		// Sidekicks, the host network one has the IP of its host
+		container("2", "web-1-log", map[string]interface{}{
+			"primaryIp":        "10.42.0.2",
+			"deploymentUnitId": "du-1",
+			"labels": map[string]interface{}{
+				"io.rancher.service.launch.config": "log",
+			},
+		}),
+		container("3", "web-1-agent", map[string]interface{}{
+			"deploymentUnitId": "du-1",
+			"networkId":        "1",
+			"hostId":           "1",
+		}),
+		// Same deployment unit ID in another environment
+		container("4", "stranger", map[string]interface{}{
+			"primaryIp":        "10.42.0.4",
+			"deploymentUnitId": "du-1",
+			"environmentUuid":  "env-2",
+		}),
+		container("5", "mysql-1", map[string]interface{}{
+			"stackId":   "2",
+			"primaryIp": "10.42.0.5",
+		}),
+		container("6", "cache-1", map[string]interface{}{
+			"primaryIp": "10.42.0.6",
+		}),
+	} {
+		if err := store.Add(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestHostsFile(t *testing.T) {
+	store := hostsStore(t)
+
+	tests := []struct {
+		ip       string
+		expected string
+	}{
+		{"10.42.0.1", "127.0.0.1\tlocalhost\n" +
+			"::1\tlocalhost ip6-localhost ip6-loopback\n" +
+			"10.42.0.1\tweb-1\n" +
+			"10.42.0.2\tlog web-1-log\n" +
+			"10.42.0.5\tdatabase mysql\n" +
+			"10.42.0.6\tcache-1\n" +
+			"192.168.0.10\tweb-1-agent\n"},
+		{"10.42.0.2", "127.0.0.1\tlocalhost\n" +
+			"::1\tlocalhost ip6-localhost ip6-loopback\n" +
+			"10.42.0.2\tweb-1-log\n" +
+			"10.42.0.1\tweb-1\n" +
+			"192.168.0.10\tweb-1-agent\n"},
+		{"10.42.0.6", "127.0.0.1\tlocalhost\n" +
+			"::1\tlocalhost ip6-localhost ip6-loopback\n" +
+			"10.42.0.6\tcache-1\n"},
+	}
+
+	for _, test := range tests {
+		actual, ok := convert.HostsFile(content.V3, test.ip, store)
+		if !ok || actual != test.expected {
+			t.Errorf("%s: expected\n%s\ngot %v\n%s", test.ip, test.expected, ok, actual)
+		}
+	}
+
+	if actual, ok := convert.HostsFile(content.V3, "10.42.9.9", store); ok {
+		t.Errorf("Expected no hosts file for an unknown client, got\n%s", actual)
+	}
+}
@@ -0,0 +1,13 @@
+package convert
+
+import "strings"
+
+// LinkTarget splits a link name of the form [stack/]name into the stack and
+// target names, defaulting to the stack of the linking object
+func LinkTarget(defaultStack, linkName string) (string, string) {
+	parts := strings.SplitN(linkName, "/", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return defaultStack, linkName
+}
@@ -0,0 +1,67 @@
+package convert
+
+import (
+	"github.com/rancher/go-rancher/v3"
+	"github.com/rancher/metadata/content"
+	"github.com/rancher/metadata/types"
+)
+
+func publicEndpoint(port client.PublicEndpoint) types.PublicEndpoint {
+	return types.PublicEndpoint{
+		AgentIPAddress: port.AgentIpAddress,
+		BindAll:        port.BindAll,
+		BindIPAddress:  port.BindIpAddress,
+		FQDN:           port.Fqdn,
+		HostID:         port.HostId,
+		InstanceID:     port.InstanceId,
+		IPAddress:      port.IpAddress,
+		PrivatePort:    port.PrivatePort,
+		Protocol:       port.Protocol,
+		PublicPort:     port.PublicPort,
+		ServiceID:      port.ServiceId,
+	}
+}
+
+func portMapping(port client.PublicEndpoint, store content.Store) types.PortMapping {
+	return types.PortMapping{
+		BindIP:        port.BindIpAddress,
+		PublicPort:    port.PublicPort,
+		PrivatePort:   port.PrivatePort,
+		Protocol:      port.Protocol,
+		HostUUID:      store.IDtoUUID(content.HostType, port.HostId),
+		ContainerUUID: store.IDtoUUID(content.ContainerType, port.InstanceId),
+	}
+}
+
+// endpoint returns the address a published port is reachable on.  A port
+// bound to a specific address is only reachable on that address, otherwise
+// the host's address is used.
+func endpoint(port client.PublicEndpoint, store content.Store) (types.Endpoint, bool) {
+	if port.PublicPort == 0 {
+		return types.Endpoint{}, false
+	}
+
+	ip := port.BindIpAddress
+	if ip == "" || ip == "0.0.0.0" || ip == "::" {
+		ip = port.IpAddress
+	}
+	if ip == "" {
+		ip = port.AgentIpAddress
+	}
+	if ip == "" {
+		if host := store.HostByID(port.HostId); host != nil {
+			ip = host.AgentIp
+		}
+	}
+	if ip == "" {
+		return types.Endpoint{}, false
+	}
+
+	return types.Endpoint{
+		IP:            ip,
+		Port:          port.PublicPort,
+		Protocol:      port.Protocol,
+		HostUUID:      store.IDtoUUID(content.HostType, port.HostId),
+		ContainerUUID: store.IDtoUUID(content.ContainerType, port.InstanceId),
+	}, true
+}
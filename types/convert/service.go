@@ -2,7 +2,6 @@ package convert
 
 import (
 	"fmt"
-	"strings"
 
 	"github.com/rancher/go-rancher/v3"
 	"github.com/rancher/metadata/content"
@@ -73,21 +72,14 @@ func (c *ServiceWrapper) wrapped() interface{} {
 	}
 
 	result.Ports = []string{}
+	result.PortMappings = []types.PortMapping{}
+	result.Endpoints = []types.Endpoint{}
 	for _, port := range c.Service.Ports {
-		portString := types.PublicEndpoint{
-			AgentIPAddress: port.AgentIpAddress,
-			BindAll:        port.BindAll,
-			BindIPAddress:  port.BindIpAddress,
-			FQDN:           port.Fqdn,
-			HostID:         port.HostId,
-			InstanceID:     port.InstanceId,
-			IPAddress:      port.IpAddress,
-			PrivatePort:    port.PrivatePort,
-			Protocol:       port.Protocol,
-			PublicPort:     port.PublicPort,
-			ServiceID:      port.ServiceId,
-		}.String()
-		result.Ports = append(result.Ports, portString)
+		result.Ports = append(result.Ports, publicEndpoint(port).String())
+		result.PortMappings = append(result.PortMappings, portMapping(port, c.Store))
+		if endpoint, ok := endpoint(port, c.Store); ok {
+			result.Endpoints = append(result.Endpoints, endpoint)
+		}
 	}
 
 	stack := c.Store.StackByID(c.Service.StackId)
@@ -180,13 +172,7 @@ func resolveServiceLinks(response *types.ServiceResponse, service *client.Servic
 			alias = link.Name
 		}
 
-		stackName := response.StackName
-		containerName := link.Name
-		parts := strings.SplitN(link.Name, "/", 2)
-		if len(parts) == 2 {
-			stackName = parts[0]
-			containerName = parts[1]
-		}
+		stackName, containerName := LinkTarget(response.StackName, link.Name)
 
 		target := store.ServiceByName(service.EnvironmentUuid, stackName, containerName)
 		if target == nil {
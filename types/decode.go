@@ -0,0 +1,110 @@
+package types
+
+import (
+	"encoding/json"
+
+	"github.com/rancher/metadata/content"
+)
+
+// The responses hold nested objects as content.Object which can not be decoded
+// directly, these decode them as content.MapObject instead
+
+func toObjects(maps []content.MapObject) []content.Object {
+	if maps == nil {
+		return nil
+	}
+	result := make([]content.Object, len(maps))
+	for i, m := range maps {
+		result[i] = m
+	}
+	return result
+}
+
+func toObject(m content.MapObject) content.Object {
+	if m == nil {
+		return nil
+	}
+	return m
+}
+
+func (e *EnvironmentResponse) UnmarshalJSON(data []byte) error {
+	type alias EnvironmentResponse
+	aux := struct {
+		*alias
+		Containers []content.MapObject `json:"containers"`
+		Services   []content.MapObject `json:"services"`
+		Networks   []content.MapObject `json:"networks"`
+		Hosts      []content.MapObject `json:"hosts"`
+		Stacks     []content.MapObject `json:"stacks"`
+	}{
+		alias: (*alias)(e),
+	}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	e.Containers = toObjects(aux.Containers)
+	e.Services = toObjects(aux.Services)
+	e.Networks = toObjects(aux.Networks)
+	e.Hosts = toObjects(aux.Hosts)
+	e.Stacks = toObjects(aux.Stacks)
+	return nil
+}
+
+func (s *ServiceResponse) UnmarshalJSON(data []byte) error {
+	type alias ServiceResponse
+	aux := struct {
+		*alias
+		Containers []content.MapObject `json:"containers"`
+	}{
+		alias: (*alias)(s),
+	}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	s.Containers = toObjects(aux.Containers)
+	return nil
+}
+
+func (s *StackResponse) UnmarshalJSON(data []byte) error {
+	type alias StackResponse
+	aux := struct {
+		*alias
+		Services []content.MapObject `json:"services"`
+	}{
+		alias: (*alias)(s),
+	}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	s.Services = toObjects(aux.Services)
+	return nil
+}
+
+func (m *MetadataSelf) UnmarshalJSON(data []byte) error {
+	aux := struct {
+		Container   content.MapObject `json:"container"`
+		Service     content.MapObject `json:"service"`
+		Host        content.MapObject `json:"host"`
+		Environment content.MapObject `json:"environment"`
+		Network     content.MapObject `json:"network"`
+		Stack       content.MapObject `json:"stack"`
+	}{}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	m.Container = toObject(aux.Container)
+	m.Service = toObject(aux.Service)
+	m.Host = toObject(aux.Host)
+	m.Environment = toObject(aux.Environment)
+	m.Network = toObject(aux.Network)
+	m.Stack = toObject(aux.Stack)
+	return nil
+}
@@ -25,6 +25,8 @@ type ServiceResponse struct {
 	Kind         string           `json:"kind"`
 	MetadataKind string           `json:"metadata_kind"`
 	Ports        []string         `json:"ports"`
+	PortMappings []PortMapping    `json:"port_mappings"`
+	Endpoints    []Endpoint       `json:"endpoints"`
 	StackName    string           `json:"stack_name"`
 	StackUUID    string           `json:"stack_uuid"`
 	Token        string           `json:"token"`